@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/chattycathy/api/config"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+)
+
+func main() {
+	// Initialize logger
+	logger.Init("info", true)
+
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load config")
+	}
+
+	overlap := flag.Duration("overlap", time.Hour, "how long the previous key keeps verifying tokens")
+	flag.Parse()
+
+	// The old key must outlive every access token it signed
+	minOverlap := time.Duration(cfg.JWT.AccessTokenExpiryMins) * time.Minute
+	if *overlap < minOverlap {
+		logger.Warn().
+			Dur("requested", *overlap).
+			Dur("access_token_lifetime", minOverlap).
+			Msg("Overlap shorter than access token lifetime, using access token lifetime")
+		*overlap = minOverlap
+	}
+
+	// Rotate keys
+	kid, err := auth.RotateKeys(cfg.JWT.KeysDir, *overlap)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to rotate JWT keys")
+	}
+
+	logger.Info().
+		Str("kid", kid).
+		Str("dir", cfg.JWT.KeysDir).
+		Dur("overlap", *overlap).
+		Msg("JWT signing key rotated")
+	os.Exit(0)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,14 +16,22 @@ import (
 	"github.com/chattycathy/api/db"
 	"github.com/chattycathy/api/docs"
 	"github.com/chattycathy/api/internal/admin"
+	"github.com/chattycathy/api/internal/audit"
 	internalauth "github.com/chattycathy/api/internal/auth"
+	"github.com/chattycathy/api/internal/bot"
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/internal/gateway"
 	"github.com/chattycathy/api/internal/health"
+	"github.com/chattycathy/api/internal/integration"
 	"github.com/chattycathy/api/internal/ping"
 	"github.com/chattycathy/api/internal/protected"
+	"github.com/chattycathy/api/internal/webhook"
 	"github.com/chattycathy/api/pkg/auth"
 	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/mailer"
 	"github.com/chattycathy/api/pkg/middleware"
 	"github.com/chattycathy/api/pkg/redis"
+	"github.com/chattycathy/api/pkg/storage"
 )
 
 func main() {
@@ -55,8 +64,8 @@ func main() {
 
 	// Initialize JWT
 	if err := auth.Init(&auth.Config{
+		KeysDir:                cfg.JWT.KeysDir,
 		PrivateKeyPath:         cfg.JWT.PrivateKeyPath,
-		PublicKeyPath:          cfg.JWT.PublicKeyPath,
 		Issuer:                 cfg.JWT.Issuer,
 		AccessTokenExpiryMins:  cfg.JWT.AccessTokenExpiryMins,
 		RefreshTokenExpiryDays: cfg.JWT.RefreshTokenExpiryDays,
@@ -68,6 +77,87 @@ func main() {
 		Int("refresh_expiry_days", cfg.JWT.RefreshTokenExpiryDays).
 		Msg("JWT initialized with RSA-256")
 
+	// Pick up key rotations made by the rotate-keys command or other replicas
+	keyWatchCtx, stopKeyWatch := context.WithCancel(context.Background())
+	defer stopKeyWatch()
+	go auth.WatchKeys(keyWatchCtx, time.Minute)
+
+	// Initialize mailer
+	mail, err := mailer.New(&mailer.Config{
+		Driver: cfg.Mail.Driver,
+		From:   cfg.Mail.From,
+		Dir:    cfg.Mail.Dir,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize mailer")
+	}
+	logger.Info().Str("driver", cfg.Mail.Driver).Msg("Mailer initialized")
+
+	// Initialize attachment storage
+	blobs, err := storage.New(&storage.Config{
+		Driver:          cfg.Storage.Driver,
+		Dir:             cfg.Storage.Dir,
+		PublicURL:       cfg.Storage.PublicURL,
+		SigningKey:      cfg.Storage.SigningKey,
+		Endpoint:        cfg.Storage.S3Endpoint,
+		Region:          cfg.Storage.S3Region,
+		Bucket:          cfg.Storage.S3Bucket,
+		AccessKeyID:     cfg.Storage.S3AccessKeyID,
+		SecretAccessKey: cfg.Storage.S3SecretAccessKey,
+		PathStyle:       cfg.Storage.S3PathStyle,
+	})
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize storage")
+	}
+	logger.Info().Str("driver", cfg.Storage.Driver).Msg("Storage initialized")
+
+	// Real-time events, relayed between replicas by the broker
+	broker, err := redis.NewBroker(cfg.Realtime.Broker)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize event broker")
+	}
+	backlog, err := redis.NewBacklog(
+		cfg.Realtime.Broker,
+		cfg.Realtime.BacklogSize,
+		time.Duration(cfg.Realtime.BacklogMinutes)*time.Minute,
+	)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to initialize event backlog")
+	}
+	hub := gateway.NewHub(broker, backlog)
+	go hub.Run()
+	logger.Info().Str("driver", cfg.Realtime.Broker).Msg("Event broker initialized")
+
+	// Enforce the audit log retention policy
+	if cfg.Audit.RetentionDays > 0 {
+		auditPurgeCtx, stopAuditPurge := context.WithCancel(context.Background())
+		defer stopAuditPurge()
+		go audit.PurgeLoop(auditPurgeCtx, database, time.Duration(cfg.Audit.RetentionDays)*24*time.Hour)
+	}
+
+	// Send queued webhook deliveries
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	dispatcher := webhook.NewDispatcher(database, webhook.Config{
+		Workers:     cfg.Webhook.Workers,
+		Timeout:     time.Duration(cfg.Webhook.TimeoutSeconds) * time.Second,
+		MaxAttempts: cfg.Webhook.MaxAttempts,
+		Retention:   time.Duration(cfg.Webhook.RetentionDays) * 24 * time.Hour,
+	})
+	go dispatcher.Run(webhookCtx)
+
+	// Attachments uploaded but never sent are removed by the chat service
+	attachmentPurgeCtx, stopAttachmentPurge := context.WithCancel(context.Background())
+	defer stopAttachmentPurge()
+
+	// Presence of connections whose heartbeat lapsed is ended by the chat service
+	presenceSweepCtx, stopPresenceSweep := context.WithCancel(context.Background())
+	defer stopPresenceSweep()
+
+	// Reminders set with /remind are sent by the integration service
+	remindersCtx, stopReminders := context.WithCancel(context.Background())
+	defer stopReminders()
+
 	// Setup router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
@@ -93,6 +183,9 @@ func main() {
 	// Register OpenAPI docs
 	docs.RegisterRoutes(router)
 
+	// Public signing keys for token verification by other services
+	internalauth.RegisterWellKnownRoutes(router)
+
 	// API v1 routes
 	v1 := router.Group("/api/v1")
 	{
@@ -102,9 +195,13 @@ func main() {
 		pingHandler.RegisterRoutes(v1)
 
 		// Auth routes (public)
-		authHandler := internalauth.NewHandler(cfg.JWT.Issuer, cfg.JWT.AccessTokenExpiryMins, cfg.JWT.RefreshTokenExpiryDays)
+		authHandler := internalauth.NewHandler(database, cfg.JWT.Issuer, cfg.JWT.AccessTokenExpiryMins, cfg.JWT.RefreshTokenExpiryDays)
 		authHandler.RegisterRoutes(v1)
 
+		// Account routes (registration, email verification, password reset)
+		accountHandler := internalauth.NewAccountHandler(database, mail, cfg.Mail.AppURL)
+		accountHandler.RegisterRoutes(v1)
+
 		// Google OAuth routes
 		googleHandler := internalauth.NewGoogleHandler(
 			database,
@@ -124,9 +221,54 @@ func main() {
 		// Admin routes (require admin role)
 		adminHandler := admin.NewHandler(database)
 		adminHandler.RegisterRoutes(v1)
+
+		// Audit log (requires audit:read)
+		auditHandler := audit.NewHandler(database)
+		auditHandler.RegisterRoutes(v1)
+
+		// Bot accounts and their API keys (requires bots:manage). Chat,
+		// protected and ping routes accept the keys alongside access tokens.
+		middleware.SetAPIKeyResolver(bot.NewResolver(database))
+		botHandler := bot.NewHandler(database)
+		botHandler.RegisterRoutes(v1)
+
+		// Outbound webhooks (requires webhooks:manage)
+		webhookHandler := webhook.NewHandler(database)
+		webhookHandler.RegisterRoutes(v1)
+
+		// Chat routes (require chat:* permissions)
+		chatService := chat.NewService(database, hub, chat.Config{
+			EditWindow:        time.Duration(cfg.Chat.EditWindowMinutes) * time.Minute,
+			Storage:           blobs,
+			MaxAttachmentSize: int64(cfg.Chat.MaxAttachmentMB) << 20,
+			AttachmentTypes:   strings.Split(cfg.Chat.AttachmentTypes, ","),
+			AttachmentURLTTL:  time.Duration(cfg.Chat.AttachmentURLMinutes) * time.Minute,
+		})
+		go chatService.PurgeAttachmentsLoop(attachmentPurgeCtx)
+		go chatService.PresenceSweepLoop(presenceSweepCtx)
+
+		// Slash commands and incoming webhooks (managing them requires
+		// integrations:manage). Messages starting with a command run it.
+		integrationService := integration.NewService(database, chatService, hub, integration.Config{
+			CommandTimeout:   time.Duration(cfg.Integration.CommandTimeoutSeconds) * time.Second,
+			CommandRateLimit: cfg.Integration.CommandRateLimit,
+			WebhookRateLimit: cfg.Integration.IncomingWebhookRateLimit,
+		})
+		go integrationService.RemindersLoop(remindersCtx)
+		integrationHandler := integration.NewHandler(database, integrationService)
+		integrationHandler.RegisterRoutes(v1)
+
+		chatHandler := chat.NewHandler(database, chatService, integrationService)
+		chatHandler.RegisterRoutes(v1)
+
+		// WebSocket gateway for live events
+		gatewayHandler := gateway.NewHandler(hub, chatService)
+		gatewayHandler.RegisterRoutes(v1)
 	}
 
-	// Create HTTP server
+	// Create HTTP server. The timeouts apply to ordinary requests; the SSE
+	// stream clears them and sets a deadline per write, and WebSocket
+	// connections are hijacked and manage their own.
 	addr := ":" + cfg.Server.Port
 	srv := &http.Server{
 		Addr:         addr,
@@ -151,6 +293,12 @@ func main() {
 
 	logger.Info().Msg("Shutting down server...")
 
+	// WebSocket connections are hijacked and not tracked by Shutdown
+	hub.Shutdown()
+	if err := broker.Close(); err != nil {
+		logger.Warn().Err(err).Msg("Error closing event broker")
+	}
+
 	// Give outstanding requests 30 seconds to complete
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -9,12 +9,19 @@ import (
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Redis    RedisConfig
-	Log      LogConfig
-	JWT      JWTConfig
-	Google   GoogleConfig
+	Server      ServerConfig
+	Database    DatabaseConfig
+	Redis       RedisConfig
+	Log         LogConfig
+	JWT         JWTConfig
+	Google      GoogleConfig
+	Mail        MailConfig
+	Audit       AuditConfig
+	Realtime    RealtimeConfig
+	Chat        ChatConfig
+	Storage     StorageConfig
+	Webhook     WebhookConfig
+	Integration IntegrationConfig
 }
 
 type ServerConfig struct {
@@ -27,9 +34,60 @@ type GoogleConfig struct {
 	RedirectURL  string
 }
 
+type MailConfig struct {
+	Driver string
+	From   string
+	Dir    string
+	AppURL string // base URL of the frontend, used in links sent by email
+}
+
+type AuditConfig struct {
+	RetentionDays int // audit events older than this are deleted; 0 keeps them forever
+}
+
+type RealtimeConfig struct {
+	Broker         string // "redis" to share events across replicas, or "memory" for a single instance
+	BacklogSize    int    // events kept per channel for clients resuming an event stream
+	BacklogMinutes int    // how long kept events stay available
+}
+
+type ChatConfig struct {
+	EditWindowMinutes    int    // how long authors can edit a message; 0 means no limit
+	MaxAttachmentMB      int    // largest attachment accepted
+	AttachmentTypes      string // comma-separated content types accepted, e.g. "image/*,application/pdf"
+	AttachmentURLMinutes int    // how long attachment download links stay valid
+}
+
+type WebhookConfig struct {
+	Workers        int // deliveries sent at once by each instance
+	TimeoutSeconds int // per delivery attempt
+	MaxAttempts    int // attempts before a delivery becomes a dead letter
+	RetentionDays  int // delivered and dead deliveries older than this are deleted; 0 keeps them forever
+}
+
+type IntegrationConfig struct {
+	CommandTimeoutSeconds    int // how long an external slash command may take to answer
+	CommandRateLimit         int // slash commands a user may run per minute
+	IncomingWebhookRateLimit int // messages each incoming webhook may post per minute
+}
+
+type StorageConfig struct {
+	Driver     string // "local" or "s3"
+	Dir        string
+	PublicURL  string // where the API serves local files, ending in /api/v1/files
+	SigningKey string
+
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3PathStyle       bool
+}
+
 type JWTConfig struct {
+	KeysDir                string
 	PrivateKeyPath         string
-	PublicKeyPath          string
 	Issuer                 string
 	AccessTokenExpiryMins  int
 	RefreshTokenExpiryDays int
@@ -85,8 +143,8 @@ func Load() (*Config, error) {
 			Pretty: getEnv("LOG_PRETTY", "true") == "true",
 		},
 		JWT: JWTConfig{
+			KeysDir:                getEnv("JWT_KEYS_DIR", "./jwt"),
 			PrivateKeyPath:         getEnv("JWT_PRIVATE_KEY", ""),
-			PublicKeyPath:          getEnv("JWT_PUBLIC_KEY", ""),
 			Issuer:                 getEnv("JWT_ISSUER", "chattycathy"),
 			AccessTokenExpiryMins:  getEnvInt("JWT_ACCESS_EXPIRY_MINS", 15),
 			RefreshTokenExpiryDays: getEnvInt("JWT_REFRESH_EXPIRY_DAYS", 7),
@@ -96,6 +154,49 @@ func Load() (*Config, error) {
 			ClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
 			RedirectURL:  getEnv("GOOGLE_REDIRECT_URL", "http://localhost:3000"),
 		},
+		Mail: MailConfig{
+			Driver: getEnv("MAIL_DRIVER", "log"),
+			From:   getEnv("MAIL_FROM", "ChattyCathy <no-reply@chattycathy.localhost>"),
+			Dir:    getEnv("MAIL_DIR", "./mail"),
+			AppURL: getEnv("APP_URL", "http://localhost:3000"),
+		},
+		Audit: AuditConfig{
+			RetentionDays: getEnvInt("AUDIT_RETENTION_DAYS", 365),
+		},
+		Realtime: RealtimeConfig{
+			Broker:         getEnv("REALTIME_BROKER", "redis"),
+			BacklogSize:    getEnvInt("REALTIME_BACKLOG_SIZE", 100),
+			BacklogMinutes: getEnvInt("REALTIME_BACKLOG_MINUTES", 10),
+		},
+		Chat: ChatConfig{
+			EditWindowMinutes:    getEnvInt("CHAT_EDIT_WINDOW_MINUTES", 15),
+			MaxAttachmentMB:      getEnvInt("ATTACHMENT_MAX_MB", 25),
+			AttachmentTypes:      getEnv("ATTACHMENT_TYPES", "image/*,audio/*,video/*,application/pdf,application/zip,text/plain"),
+			AttachmentURLMinutes: getEnvInt("ATTACHMENT_URL_MINUTES", 15),
+		},
+		Webhook: WebhookConfig{
+			Workers:        getEnvInt("WEBHOOK_WORKERS", 4),
+			TimeoutSeconds: getEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10),
+			MaxAttempts:    getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+			RetentionDays:  getEnvInt("WEBHOOK_RETENTION_DAYS", 30),
+		},
+		Integration: IntegrationConfig{
+			CommandTimeoutSeconds:    getEnvInt("COMMAND_TIMEOUT_SECONDS", 5),
+			CommandRateLimit:         getEnvInt("COMMAND_RATE_LIMIT", 20),
+			IncomingWebhookRateLimit: getEnvInt("INCOMING_WEBHOOK_RATE_LIMIT", 60),
+		},
+		Storage: StorageConfig{
+			Driver:            getEnv("STORAGE_DRIVER", "local"),
+			Dir:               getEnv("STORAGE_DIR", "./uploads"),
+			PublicURL:         getEnv("STORAGE_PUBLIC_URL", "http://localhost:8080/api/v1/files"),
+			SigningKey:        getEnv("STORAGE_SIGNING_KEY", ""),
+			S3Endpoint:        getEnv("S3_ENDPOINT", ""),
+			S3Region:          getEnv("S3_REGION", "us-east-1"),
+			S3Bucket:          getEnv("S3_BUCKET", ""),
+			S3AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+			S3SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+			S3PathStyle:       getEnv("S3_PATH_STYLE", "false") == "true",
+		},
 	}
 
 	return cfg, nil
@@ -10,29 +10,67 @@ import (
 func Migrate(db *gorm.DB) error {
 	logger.Info().Msg("Running database migrations...")
 
+	// Checked before AutoMigrate adds the column, see requireAdminMFA
+	hadRequireMFA := db.Migrator().HasColumn(&models.Role{}, "RequireMFA")
+
 	err := db.AutoMigrate(
 		&models.Ping{},
 		&models.User{},
 		&models.Permission{},
 		&models.Role{},
 		&models.UserRole{},
+		&models.RoleBinding{},
+		&models.MFARecoveryCode{},
+		&models.AuditEvent{},
+		&models.Conversation{},
+		&models.ConversationMember{},
+		&models.Message{},
+		&models.MessageRevision{},
+		&models.MessageReaction{},
+		&models.ThreadFollower{},
+		&models.Attachment{},
+		&models.JoinRequest{},
+		&models.ChannelInvite{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.WebhookAttempt{},
+		&models.APIKey{},
+		&models.SlashCommand{},
+		&models.IncomingWebhook{},
+		&models.Reminder{},
 	)
 	if err != nil {
 		return err
 	}
 
+	logger.Info().Msg("Creating message search index...")
+	if err := migrateMessageSearch(db); err != nil {
+		return err
+	}
+
 	// Seed default roles and permissions
 	logger.Info().Msg("Seeding default roles and permissions...")
 	if err := models.SeedDefaultRolesAndPermissions(db); err != nil {
 		logger.Warn().Err(err).Msg("Failed to seed roles and permissions")
 	}
 
+	if !hadRequireMFA {
+		if err := requireAdminMFA(db); err != nil {
+			logger.Warn().Err(err).Msg("Failed to require MFA for the admin role")
+		}
+	}
+
 	// Assign default role to existing users without any role
 	logger.Info().Msg("Assigning default roles to users without roles...")
 	if err := assignDefaultRoleToExistingUsers(db); err != nil {
 		logger.Warn().Err(err).Msg("Failed to assign default roles to existing users")
 	}
 
+	// Bind channel roles for conversation members from before role bindings
+	if err := bindExistingConversationMembers(db); err != nil {
+		logger.Warn().Err(err).Msg("Failed to bind channel roles to conversation members")
+	}
+
 	logger.Info().Msg("Database migrations completed")
 	return nil
 }
@@ -67,3 +105,51 @@ func assignDefaultRoleToExistingUsers(db *gorm.DB) error {
 
 	return nil
 }
+
+// requireAdminMFA turns on MFA for the built-in admin role. The seed only sets
+// it on a fresh role, and an existing one gets the column's false default, so
+// this runs once when the column is added. Later changes by admins stand.
+func requireAdminMFA(db *gorm.DB) error {
+	result := db.Model(&models.Role{}).Where("name = ? AND is_system", "admin").Update("require_mfa", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logger.Info().Msg("Required MFA for the admin role")
+	}
+	return nil
+}
+
+// migrateMessageSearch adds a generated tsvector column to messages and a GIN
+// index over it. Bodies are indexed stemmed in the message's language, plus
+// unstemmed so readers of other languages can still find exact words.
+func migrateMessageSearch(db *gorm.DB) error {
+	err := db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector(` + models.SearchConfigSQL("language") + `, body) || to_tsvector('simple', body)) STORED`).Error
+	if err != nil {
+		return err
+	}
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)").Error
+}
+
+// bindExistingConversationMembers grants each conversation member without a
+// role binding the channel role matching their member role
+func bindExistingConversationMembers(db *gorm.DB) error {
+	result := db.Exec(`
+		INSERT INTO role_bindings (user_id, role_id, resource_type, resource_id, created_at)
+		SELECT cm.user_id, r.id, ?, cm.conversation_id, NOW()
+		FROM conversation_members cm
+		JOIN roles r ON r.name = 'channel_' || cm.role AND r.scope = ?
+		WHERE NOT EXISTS (
+			SELECT 1 FROM role_bindings rb
+			WHERE rb.resource_type = ? AND rb.resource_id = cm.conversation_id AND rb.user_id = cm.user_id
+		)
+	`, models.ResourceTypeConversation, models.ResourceTypeConversation, models.ResourceTypeConversation)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logger.Info().Int64("count", result.RowsAffected).Msg("Bound channel roles to conversation members")
+	}
+	return nil
+}
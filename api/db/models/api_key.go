@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// APIKey is a long-lived credential for a bot account. Only the SHA-256 of the
+// key is stored; Prefix is the public part used to look it up.
+type APIKey struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	UserID      uint       `gorm:"not null;index" json:"user_id"`
+	Name        string     `gorm:"type:varchar(100);not null" json:"name"`
+	Prefix      string     `gorm:"type:varchar(32);uniqueIndex;not null" json:"prefix"`
+	Hash        string     `gorm:"type:varchar(64);not null" json:"-"`
+	ExpiresAt   *time.Time `json:"expires_at"` // nil never expires
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	LastUsedIP  string     `gorm:"type:varchar(45)" json:"last_used_ip,omitempty"`
+	CreatedByID uint       `gorm:"not null" json:"created_by_id"`
+	CreatedAt   time.Time  `gorm:"autoCreateTime" json:"created_at"`
+
+	// Permissions limits the key to a subset of the account's permissions;
+	// nil grants all of them
+	Permissions []string `gorm:"type:jsonb;serializer:json" json:"permissions"`
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// Expired reports whether the key has expired at now
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEvent records a security-relevant or administrative action
+type AuditEvent struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	ActorID    *uint     `gorm:"index" json:"actor_id"` // nil for anonymous requests, e.g. failed logins
+	ActorEmail string    `gorm:"type:varchar(255)" json:"actor_email,omitempty"`
+	Action     string    `gorm:"type:varchar(100);not null;index" json:"action"` // e.g. "role.create", "auth.login"
+	TargetType string    `gorm:"type:varchar(50);index:idx_audit_events_target" json:"target_type,omitempty"`
+	TargetID   string    `gorm:"type:varchar(100);index:idx_audit_events_target" json:"target_id,omitempty"`
+	Before     JSON      `gorm:"type:jsonb" json:"before,omitempty"`
+	After      JSON      `gorm:"type:jsonb" json:"after,omitempty"`
+	RequestID  string    `gorm:"type:varchar(64)" json:"request_id,omitempty"`
+	IP         string    `gorm:"type:varchar(64)" json:"ip,omitempty"`
+	UserAgent  string    `gorm:"type:varchar(512)" json:"user_agent,omitempty"`
+	CreatedAt  time.Time `gorm:"autoCreateTime;index" json:"created_at"`
+}
+
+func (AuditEvent) TableName() string {
+	return "audit_events"
+}
+
+// DeleteAuditEventsBefore removes audit events older than the cutoff
+func DeleteAuditEventsBefore(db *gorm.DB, cutoff time.Time) (int64, error) {
+	result := db.Where("created_at < ?", cutoff).Delete(&AuditEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// JSON is a raw JSON value stored in a jsonb column. Empty values are stored as NULL.
+type JSON json.RawMessage
+
+// Value implements driver.Valuer
+func (j JSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+// Scan implements sql.Scanner
+func (j *JSON) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*j = nil
+	case []byte:
+		*j = append((*j)[:0], v...)
+	case string:
+		*j = JSON(v)
+	default:
+		return fmt.Errorf("cannot scan %T into JSON", value)
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler
+func (j JSON) MarshalJSON() ([]byte, error) {
+	if len(j) == 0 {
+		return []byte("null"), nil
+	}
+	return j, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (j *JSON) UnmarshalJSON(data []byte) error {
+	*j = append((*j)[:0], data...)
+	return nil
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Conversation types
+const (
+	ConversationTypeDirect = "direct"
+	ConversationTypeGroup  = "group"
+)
+
+// Conversation member roles
+const (
+	MemberRoleOwner  = "owner"
+	MemberRoleAdmin  = "admin"
+	MemberRoleMember = "member"
+)
+
+// Group visibility. Public groups are listed in the channel directory and
+// anyone can join them; private groups are joined by invitation or approval.
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+// ChannelRoleName is the scoped role backing a member role, e.g. channel_admin
+func ChannelRoleName(memberRole string) string {
+	return "channel_" + memberRole
+}
+
+// Conversation is a direct chat between two users or a named group chat
+type Conversation struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Type string `gorm:"type:varchar(20);not null" json:"type"`
+	Name string `gorm:"type:varchar(255)" json:"name"` // empty for direct conversations
+	// Description and Visibility apply to groups
+	Description string `gorm:"type:varchar(500);not null;default:''" json:"description"`
+	Visibility  string `gorm:"type:varchar(20);not null;default:'private';index" json:"visibility"`
+	// DirectKey is "<lower user id>:<higher user id>" for direct conversations so
+	// each pair of users has at most one; nil for groups
+	DirectKey     *string    `gorm:"type:varchar(64);uniqueIndex" json:"-"`
+	CreatedByID   uint       `gorm:"not null" json:"created_by_id"`
+	LastMessageAt *time.Time `gorm:"index" json:"last_message_at"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Conversation) TableName() string {
+	return "conversations"
+}
+
+// ConversationMember links a user to a conversation
+type ConversationMember struct {
+	ConversationID    uint       `gorm:"primaryKey" json:"conversation_id"`
+	UserID            uint       `gorm:"primaryKey;index" json:"user_id"`
+	Role              string     `gorm:"type:varchar(20);not null;default:'member'" json:"role"`
+	LastReadMessageID uint       `gorm:"not null;default:0" json:"last_read_message_id"` // messages after this are unread
+	LastReadAt        *time.Time `json:"last_read_at"`
+	JoinedAt          time.Time  `gorm:"autoCreateTime" json:"joined_at"`
+}
+
+func (ConversationMember) TableName() string {
+	return "conversation_members"
+}
+
+// Message is a chat message posted to a conversation, or a reply in the
+// thread of one when ParentID is set. Deleted messages stay as tombstones with
+// an empty body so history keeps its shape.
+type Message struct {
+	ID             uint       `gorm:"primaryKey;index:idx_messages_conversation_id,priority:2;index:idx_messages_parent_id,priority:2" json:"id"`
+	ConversationID uint       `gorm:"not null;index:idx_messages_conversation_id,priority:1" json:"conversation_id"`
+	SenderID       uint       `gorm:"not null;index" json:"sender_id"`
+	ParentID       *uint      `gorm:"index:idx_messages_parent_id,priority:1" json:"parent_id"`
+	Body           string     `gorm:"type:text;not null" json:"body"` // empty for system messages
+	Kind           string     `gorm:"type:varchar(20);not null;default:'user'" json:"kind"`
+	Language       string     `gorm:"type:varchar(10);not null;default:'en'" json:"language"` // author's locale; picks the search stemmer
+	ReplyCount     int        `gorm:"not null;default:0" json:"reply_count"`                  // replies in the thread, on parent messages
+	LastReplyAt    *time.Time `json:"last_reply_at"`
+	EditedAt       *time.Time `json:"edited_at"`
+	DeletedAt      *time.Time `json:"deleted_at"`
+	DeletedByID    *uint      `json:"deleted_by_id"` // differs from SenderID when a moderator deleted it
+	PinnedAt       *time.Time `json:"pinned_at"`
+	PinnedByID     *uint      `json:"pinned_by_id"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt      time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+
+	// System describes the change a system message records; nil on user messages
+	System *SystemMessage `gorm:"type:jsonb;serializer:json" json:"system,omitempty"`
+
+	// Reactions is filled in for the user reading the message; omitted when there are none
+	Reactions   []ReactionCount `gorm:"-" json:"reactions,omitempty"`
+	Attachments []Attachment    `gorm:"-" json:"attachments,omitempty"`
+}
+
+func (Message) TableName() string {
+	return "messages"
+}
+
+// SearchLanguages maps the locales messages can be written in to PostgreSQL
+// text search configurations. Other locales are indexed without stemming.
+var SearchLanguages = map[string]string{
+	"en": "english",
+	"es": "spanish",
+	"fr": "french",
+}
+
+// SearchConfigSQL returns an SQL expression giving the text search
+// configuration for the locale in column. Each branch is a constant so the
+// expression can be used in a generated column.
+func SearchConfigSQL(column string) string {
+	locales := make([]string, 0, len(SearchLanguages))
+	for locale := range SearchLanguages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	var b strings.Builder
+	b.WriteString("CASE " + column)
+	for _, locale := range locales {
+		fmt.Fprintf(&b, " WHEN '%s' THEN '%s'::regconfig", locale, SearchLanguages[locale])
+	}
+	b.WriteString(" ELSE 'simple'::regconfig END")
+	return b.String()
+}
+
+// Message kinds. System messages record membership changes in the timeline;
+// the sender is the user who made the change.
+const (
+	MessageKindUser   = "user"
+	MessageKindSystem = "system"
+)
+
+// System message events
+const (
+	SystemEventMemberJoined  = "member.joined" // joined a public group or by invite link
+	SystemEventMemberLeft    = "member.left"
+	SystemEventMemberAdded   = "member.added"   // added by the sender, or their join request approved
+	SystemEventMemberRemoved = "member.removed" // removed by the sender
+)
+
+// SystemMessage is the content of a system message. Clients render it in the
+// reader's language.
+type SystemMessage struct {
+	Event   string `json:"event"`
+	UserIDs []uint `json:"user_ids,omitempty"` // the members affected
+}
+
+// IsSystem reports whether the message is a system message
+func (m *Message) IsSystem() bool {
+	return m.Kind == MessageKindSystem
+}
+
+// Deleted reports whether the message has been deleted
+func (m *Message) Deleted() bool {
+	return m.DeletedAt != nil
+}
+
+// Message revision actions
+const (
+	RevisionActionEdit   = "edit"
+	RevisionActionDelete = "delete"
+)
+
+// MessageRevision is a previous version of a message, kept when it is edited
+// or deleted
+type MessageRevision struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;index" json:"message_id"`
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	Action    string    `gorm:"type:varchar(20);not null" json:"action"` // the change that replaced this version
+	EditorID  uint      `gorm:"not null" json:"editor_id"`               // who made that change
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (MessageRevision) TableName() string {
+	return "message_revisions"
+}
+
+// Attachment is a file uploaded to a conversation. It is pending until a
+// message is posted with it, after which MessageID is set.
+type Attachment struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ConversationID uint      `gorm:"not null;index" json:"conversation_id"`
+	UploaderID     uint      `gorm:"not null;index" json:"uploader_id"`
+	MessageID      *uint     `gorm:"index" json:"message_id"`
+	Filename       string    `gorm:"type:varchar(255);not null" json:"filename"`
+	ContentType    string    `gorm:"type:varchar(255);not null" json:"content_type"`
+	Size           int64     `gorm:"not null" json:"size"`
+	Width          int       `json:"width,omitempty"`  // images only
+	Height         int       `json:"height,omitempty"` // images only
+	StorageKey     string    `gorm:"type:varchar(255);not null;uniqueIndex" json:"-"`
+	HasThumbnail   bool      `gorm:"not null;default:false" json:"has_thumbnail"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (Attachment) TableName() string {
+	return "attachments"
+}
+
+// ThumbnailKey is where the attachment's thumbnail is stored
+func (a *Attachment) ThumbnailKey() string {
+	return a.StorageKey + ".thumb.jpg"
+}
+
+// JoinRequest is a pending request by a user to join a private group
+type JoinRequest struct {
+	ConversationID uint      `gorm:"primaryKey" json:"conversation_id"`
+	UserID         uint      `gorm:"primaryKey;index" json:"user_id"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (JoinRequest) TableName() string {
+	return "join_requests"
+}
+
+// ChannelInvite is a link that lets anyone holding its code join a group,
+// until it expires or runs out of uses
+type ChannelInvite struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ConversationID uint      `gorm:"not null;index" json:"conversation_id"`
+	Code           string    `gorm:"type:varchar(64);uniqueIndex;not null" json:"code"`
+	CreatedByID    uint      `gorm:"not null" json:"created_by_id"`
+	MaxUses        int       `gorm:"not null;default:0" json:"max_uses"` // 0 for unlimited
+	Uses           int       `gorm:"not null;default:0" json:"uses"`
+	ExpiresAt      time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt      time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (ChannelInvite) TableName() string {
+	return "channel_invites"
+}
+
+// Usable reports whether the invite has neither expired nor run out of uses
+func (i *ChannelInvite) Usable(now time.Time) bool {
+	return now.Before(i.ExpiresAt) && (i.MaxUses == 0 || i.Uses < i.MaxUses)
+}
+
+// ThreadFollower is a user notified of new replies to a message. The author
+// of the parent and everyone who replies follow automatically; others can
+// follow by hand.
+type ThreadFollower struct {
+	MessageID uint      `gorm:"primaryKey" json:"message_id"`
+	UserID    uint      `gorm:"primaryKey;index" json:"user_id"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (ThreadFollower) TableName() string {
+	return "thread_followers"
+}
+
+// MessageReaction is one user's emoji reaction to a message
+type MessageReaction struct {
+	MessageID uint      `gorm:"primaryKey" json:"message_id"`
+	UserID    uint      `gorm:"primaryKey;index" json:"user_id"`
+	Emoji     string    `gorm:"primaryKey;type:varchar(64)" json:"emoji"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (MessageReaction) TableName() string {
+	return "message_reactions"
+}
+
+// ReactionCount is the number of users who reacted to a message with an emoji
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"` // whether the reading user is one of them
+}
+
+// GetReactionCounts returns the reactions to each message, keyed by message ID,
+// in the order each emoji was first used. Reacted is set for userID.
+func GetReactionCounts(db *gorm.DB, messageIDs []uint, userID uint) (map[uint][]ReactionCount, error) {
+	result := make(map[uint][]ReactionCount, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		MessageID uint
+		ReactionCount
+	}
+	err := db.Raw(`
+		SELECT message_id, emoji, COUNT(*) AS count, BOOL_OR(user_id = ?) AS reacted
+		FROM message_reactions
+		WHERE message_id IN ?
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at), emoji
+	`, userID, messageIDs).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		result[r.MessageID] = append(result[r.MessageID], r.ReactionCount)
+	}
+	return result, nil
+}
+
+// GetUnreadCounts returns the number of unread messages in each of the given
+// conversations for a user, in one query. Conversations with nothing unread
+// are omitted.
+func GetUnreadCounts(db *gorm.DB, userID uint, conversationIDs []uint) (map[uint]int64, error) {
+	counts := make(map[uint]int64, len(conversationIDs))
+	if len(conversationIDs) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		ConversationID uint
+		Count          int64
+	}
+
+	// Each count is a range scan of idx_messages_conversation_id past the
+	// member's read position
+	err := db.Raw(`
+		SELECT m.conversation_id, COUNT(*) AS count
+		FROM conversation_members cm
+		JOIN messages m ON m.conversation_id = cm.conversation_id AND m.id > cm.last_read_message_id
+		WHERE cm.user_id = ? AND cm.conversation_id IN ? AND m.sender_id <> ?
+			AND m.deleted_at IS NULL AND m.parent_id IS NULL AND m.kind = 'user'
+		GROUP BY m.conversation_id
+	`, userID, conversationIDs, userID).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		counts[r.ConversationID] = r.Count
+	}
+	return counts, nil
+}
+
+// GetLastMessages returns the latest message of each conversation outside
+// threads, keyed by conversation ID
+func GetLastMessages(db *gorm.DB, conversationIDs []uint) (map[uint]Message, error) {
+	result := make(map[uint]Message, len(conversationIDs))
+	if len(conversationIDs) == 0 {
+		return result, nil
+	}
+
+	var messages []Message
+	err := db.Raw(`
+		SELECT DISTINCT ON (conversation_id) *
+		FROM messages
+		WHERE conversation_id IN ? AND parent_id IS NULL
+		ORDER BY conversation_id, id DESC
+	`, conversationIDs).Scan(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range messages {
+		result[m.ConversationID] = m
+	}
+	return result, nil
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+)
+
+// SlashCommand is a slash command answered by an external HTTP endpoint.
+// Built-in commands such as /remind are not stored.
+type SlashCommand struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"type:varchar(32);uniqueIndex;not null" json:"name"` // without the slash
+	Description string    `gorm:"type:varchar(255)" json:"description"`
+	Usage       string    `gorm:"type:varchar(255)" json:"usage"` // argument hint, e.g. "<service> [version]"
+	URL         string    `gorm:"type:varchar(2048);not null" json:"url"`
+	Secret      string    `gorm:"type:varchar(128);not null" json:"-"` // signs requests
+	BotID       uint      `gorm:"not null;index" json:"bot_id"`        // posts the command's public replies
+	Active      bool      `gorm:"not null;default:true" json:"active"`
+	CreatedByID uint      `gorm:"not null" json:"created_by_id"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (SlashCommand) TableName() string {
+	return "slash_commands"
+}
+
+// IncomingWebhook lets an external system post into a conversation as a bot,
+// authenticated by a secret token in its URL. Only the token's SHA-256 is stored.
+type IncomingWebhook struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	Name           string     `gorm:"type:varchar(100);not null" json:"name"`
+	ConversationID uint       `gorm:"not null;index" json:"conversation_id"`
+	BotID          uint       `gorm:"not null;index" json:"bot_id"`
+	TokenHash      string     `gorm:"type:varchar(64);uniqueIndex;not null" json:"-"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	CreatedByID    uint       `gorm:"not null" json:"created_by_id"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (IncomingWebhook) TableName() string {
+	return "incoming_webhooks"
+}
+
+// Reminder is a reminder set with the /remind command
+type Reminder struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         uint       `gorm:"not null;index" json:"user_id"`
+	ConversationID uint       `gorm:"not null" json:"conversation_id"` // where it was set
+	Text           string     `gorm:"type:text;not null" json:"text"`
+	DueAt          time.Time  `gorm:"not null;index" json:"due_at"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	CreatedAt      time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (Reminder) TableName() string {
+	return "reminders"
+}
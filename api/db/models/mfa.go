@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MFARecoveryCode is a one-time code that can replace a TOTP code
+type MFARecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"type:varchar(64);not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (MFARecoveryCode) TableName() string {
+	return "mfa_recovery_codes"
+}
+
+// UserRequiresMFA reports whether any of the user's roles makes MFA mandatory
+func UserRequiresMFA(db *gorm.DB, userID uint) (bool, error) {
+	var count int64
+
+	err := db.Raw(`
+		SELECT COUNT(*)
+		FROM roles r
+		JOIN user_roles ur ON r.id = ur.role_id
+		WHERE ur.user_id = ? AND r.require_mfa = true
+	`, userID).Scan(&count).Error
+
+	return count > 0, err
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores new ones
+func ReplaceRecoveryCodes(db *gorm.DB, userID uint, codeHashes []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		codes := make([]MFARecoveryCode, len(codeHashes))
+		for i, hash := range codeHashes {
+			codes[i] = MFARecoveryCode{UserID: userID, CodeHash: hash}
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// UseRecoveryCode marks an unused recovery code as used.
+// It reports false if the code does not exist or was already used.
+func UseRecoveryCode(db *gorm.DB, userID uint, codeHash string) (bool, error) {
+	result := db.Model(&MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+
+	return result.RowsAffected > 0, result.Error
+}
+
+// CountUnusedRecoveryCodes returns how many recovery codes the user has left
+func CountUnusedRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
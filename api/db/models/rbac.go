@@ -1,9 +1,17 @@
 package models
 
 import (
+	"database/sql"
+	"sort"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Resource types roles can be bound to
+const (
+	ResourceTypeConversation = "conversation"
 )
 
 // Permission represents a single permission
@@ -20,12 +28,16 @@ func (Permission) TableName() string {
 	return "permissions"
 }
 
-// Role represents a role that can have multiple permissions
+// Role represents a role that can have multiple permissions. Global roles are
+// assigned to users directly; scoped roles, whose Scope names a resource type
+// such as "conversation", are granted on one resource with a RoleBinding.
 type Role struct {
 	ID          uint         `gorm:"primaryKey" json:"id"`
 	Name        string       `gorm:"type:varchar(100);uniqueIndex;not null" json:"name"`
 	Description string       `gorm:"type:varchar(255)" json:"description"`
-	IsSystem    bool         `gorm:"default:false" json:"is_system"` // System roles cannot be deleted
+	IsSystem    bool         `gorm:"default:false" json:"is_system"`   // System roles cannot be deleted
+	RequireMFA  bool         `gorm:"default:false" json:"require_mfa"` // Members must use MFA to get a full session
+	Scope       string       `gorm:"type:varchar(50);not null;default:''" json:"scope"`
 	Permissions []Permission `gorm:"many2many:role_permissions;" json:"permissions"`
 	CreatedAt   time.Time    `gorm:"autoCreateTime" json:"created_at"`
 	UpdatedAt   time.Time    `gorm:"autoUpdateTime" json:"updated_at"`
@@ -46,6 +58,21 @@ func (UserRole) TableName() string {
 	return "user_roles"
 }
 
+// RoleBinding grants a scoped role to a user on one resource instance, e.g.
+// channel_admin on conversation 42. A user holds at most one role per resource.
+type RoleBinding struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       uint      `gorm:"not null;index;uniqueIndex:idx_role_bindings_resource_user,priority:3" json:"user_id"`
+	RoleID       uint      `gorm:"not null;index" json:"role_id"`
+	ResourceType string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_role_bindings_resource_user,priority:1" json:"resource_type"`
+	ResourceID   uint      `gorm:"not null;uniqueIndex:idx_role_bindings_resource_user,priority:2" json:"resource_id"`
+	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (RoleBinding) TableName() string {
+	return "role_bindings"
+}
+
 // SeedDefaultRolesAndPermissions creates default roles and permissions
 func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 	// Define default permissions
@@ -70,12 +97,43 @@ func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 		{Name: "roles:create", Description: "Can create roles", Resource: "roles", Action: "create"},
 		{Name: "roles:update", Description: "Can update roles", Resource: "roles", Action: "update"},
 		{Name: "roles:delete", Description: "Can delete roles", Resource: "roles", Action: "delete"},
+
+		// Audit log permissions
+		{Name: "audit:read", Description: "Can view the audit log", Resource: "audit", Action: "read"},
+
+		// Bot account permissions
+		{Name: "bots:manage", Description: "Can create bot accounts and their API keys", Resource: "bots", Action: "manage"},
+
+		// Webhook permissions
+		{Name: "webhooks:manage", Description: "Can manage outbound webhooks", Resource: "webhooks", Action: "manage"},
+
+		// Integration permissions
+		{Name: "integrations:manage", Description: "Can manage slash commands and incoming webhooks", Resource: "integrations", Action: "manage"},
+
+		// Chat permissions
+		{Name: "chat:read", Description: "Can read conversations and messages", Resource: "chat", Action: "read"},
+		{Name: "chat:write", Description: "Can post messages", Resource: "chat", Action: "write"},
+		{Name: "chat:create", Description: "Can start conversations", Resource: "chat", Action: "create"},
+		{Name: "chat:moderate", Description: "Can delete any message and view edit history", Resource: "chat", Action: "moderate"},
+
+		// Channel permissions, granted per conversation by channel roles or
+		// globally to act on every conversation
+		{Name: "channel:rename", Description: "Can rename a group", Resource: "channel", Action: "rename"},
+		{Name: "channel:invite", Description: "Can add members to a group", Resource: "channel", Action: "invite"},
+		{Name: "channel:kick", Description: "Can remove members from a group", Resource: "channel", Action: "kick"},
+		{Name: "channel:pin", Description: "Can pin messages", Resource: "channel", Action: "pin"},
+		{Name: "channel:manage_roles", Description: "Can change members' channel roles", Resource: "channel", Action: "manage_roles"},
 	}
 
 	// Create permissions if they don't exist
+	var created []Permission
 	for _, perm := range permissions {
-		if err := db.Where("name = ?", perm.Name).FirstOrCreate(&perm).Error; err != nil {
-			return err
+		result := db.Where("name = ?", perm.Name).FirstOrCreate(&perm)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected > 0 {
+			created = append(created, perm)
 		}
 	}
 
@@ -87,10 +145,16 @@ func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 
 	// Get basic permissions for user role
 	var userPerms []Permission
-	if err := db.Where("name IN ?", []string{"ping:read", "news:read"}).Find(&userPerms).Error; err != nil {
+	if err := db.Where("name IN ?", []string{"ping:read", "news:read", "chat:read", "chat:write", "chat:create"}).Find(&userPerms).Error; err != nil {
 		return err
 	}
 
+	channelPerms := func(names ...string) []Permission {
+		var perms []Permission
+		db.Where("name IN ?", names).Find(&perms)
+		return perms
+	}
+
 	// Define default roles
 	roles := []struct {
 		Role        Role
@@ -101,6 +165,7 @@ func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 				Name:        "admin",
 				Description: "Administrator with full access",
 				IsSystem:    true,
+				RequireMFA:  true,
 			},
 			Permissions: allPerms,
 		},
@@ -124,6 +189,33 @@ func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 				return editorPerms
 			}(),
 		},
+		{
+			Role: Role{
+				Name:        ChannelRoleName(MemberRoleOwner),
+				Description: "Owner of a group conversation",
+				IsSystem:    true,
+				Scope:       ResourceTypeConversation,
+			},
+			Permissions: channelPerms("channel:rename", "channel:invite", "channel:kick", "channel:pin", "channel:manage_roles"),
+		},
+		{
+			Role: Role{
+				Name:        ChannelRoleName(MemberRoleAdmin),
+				Description: "Administrator of a group conversation",
+				IsSystem:    true,
+				Scope:       ResourceTypeConversation,
+			},
+			Permissions: channelPerms("channel:rename", "channel:invite", "channel:kick", "channel:pin"),
+		},
+		{
+			Role: Role{
+				Name:        ChannelRoleName(MemberRoleMember),
+				Description: "Member of a conversation",
+				IsSystem:    true,
+				Scope:       ResourceTypeConversation,
+			},
+			Permissions: channelPerms("channel:pin"),
+		},
 	}
 
 	// Create roles if they don't exist
@@ -135,12 +227,36 @@ func SeedDefaultRolesAndPermissions(db *gorm.DB) error {
 			if err := db.Create(&r.Role).Error; err != nil {
 				return err
 			}
+		} else if result.Error == nil {
+			// Grant permissions introduced since the role was created, e.g. so
+			// admins keep full access after an upgrade
+			if added := newPermissions(r.Permissions, created); len(added) > 0 {
+				if err := db.Model(&existingRole).Association("Permissions").Append(added); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// newPermissions returns the permissions in defaults that were just created
+func newPermissions(defaults, created []Permission) []Permission {
+	isNew := make(map[string]bool, len(created))
+	for _, p := range created {
+		isNew[p.Name] = true
+	}
+
+	var added []Permission
+	for _, p := range defaults {
+		if isNew[p.Name] {
+			added = append(added, p)
+		}
+	}
+	return added
+}
+
 // GetUserPermissions returns all permissions for a user across all their roles
 func GetUserPermissions(db *gorm.DB, userID uint) ([]string, error) {
 	var permissions []string
@@ -170,10 +286,23 @@ func GetUserRoles(db *gorm.DB, userID uint) ([]Role, error) {
 	return roles, err
 }
 
-// AssignRoleToUser assigns a role to a user
+// GetRoleUserIDs returns the IDs of all users that have a role
+func GetRoleUserIDs(db *gorm.DB, roleID uint) ([]uint, error) {
+	var userIDs []uint
+
+	err := db.Raw(`
+		SELECT user_id
+		FROM user_roles
+		WHERE role_id = ?
+	`, roleID).Scan(&userIDs).Error
+
+	return userIDs, err
+}
+
+// AssignRoleToUser assigns a global role to a user
 func AssignRoleToUser(db *gorm.DB, userID uint, roleName string) error {
 	var role Role
-	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+	if err := db.Where("name = ? AND scope = ''", roleName).First(&role).Error; err != nil {
 		return err
 	}
 
@@ -185,16 +314,56 @@ func AssignRoleToUser(db *gorm.DB, userID uint, roleName string) error {
 	return db.Where("user_id = ? AND role_id = ?", userID, role.ID).FirstOrCreate(&userRole).Error
 }
 
-// RemoveRoleFromUser removes a role from a user
+// RemoveRoleFromUser removes a global role from a user. Scoped roles granted
+// through role bindings are left alone.
 func RemoveRoleFromUser(db *gorm.DB, userID uint, roleName string) error {
 	var role Role
-	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+	if err := db.Where("name = ? AND scope = ''", roleName).First(&role).Error; err != nil {
 		return err
 	}
 
 	return db.Where("user_id = ? AND role_id = ?", userID, role.ID).Delete(&UserRole{}).Error
 }
 
+// SyncUserRole updates the user's primary role column after their role
+// assignments change. It is what role-based middleware and token claims see:
+// "admin" if the user holds it, otherwise the current value if still held,
+// otherwise the oldest role they hold, or "user" if they hold none.
+func SyncUserRole(db *gorm.DB, userID uint) (string, error) {
+	var user User
+	if err := db.Select("id", "role").First(&user, userID).Error; err != nil {
+		return "", err
+	}
+
+	roles, err := GetUserRoles(db, userID)
+	if err != nil {
+		return "", err
+	}
+
+	primary := "user"
+	if len(roles) > 0 {
+		sort.Slice(roles, func(i, j int) bool { return roles[i].ID < roles[j].ID })
+		primary = roles[0].Name
+		for _, r := range roles {
+			if r.Name == user.Role {
+				primary = r.Name
+			}
+		}
+		for _, r := range roles {
+			if r.Name == "admin" {
+				primary = r.Name
+			}
+		}
+	}
+
+	if primary != user.Role {
+		if err := db.Model(&User{}).Where("id = ?", userID).Update("role", primary).Error; err != nil {
+			return "", err
+		}
+	}
+	return primary, nil
+}
+
 // HasPermission checks if a user has a specific permission
 func HasPermission(db *gorm.DB, userID uint, permissionName string) (bool, error) {
 	var count int64
@@ -209,3 +378,73 @@ func HasPermission(db *gorm.DB, userID uint, permissionName string) (bool, error
 
 	return count > 0, err
 }
+
+// HasScopedPermission checks if a user has a permission on a resource
+// through the role bound to them there. Global grants are not included; see
+// HasPermission.
+func HasScopedPermission(db *gorm.DB, userID uint, permissionName, resourceType string, resourceID uint) (bool, error) {
+	var count int64
+
+	err := db.Raw(`
+		SELECT COUNT(*)
+		FROM permissions p
+		JOIN role_permissions rp ON p.id = rp.permission_id
+		JOIN role_bindings rb ON rp.role_id = rb.role_id
+		WHERE rb.user_id = ? AND rb.resource_type = ? AND rb.resource_id = ? AND p.name = ?
+	`, userID, resourceType, resourceID, permissionName).Scan(&count).Error
+
+	return count > 0, err
+}
+
+// GetScopedPermissions returns the permissions a user has on a resource
+// through the role bound to them there, and whether they have a role there at all
+func GetScopedPermissions(db *gorm.DB, userID uint, resourceType string, resourceID uint) ([]string, bool, error) {
+	var names []sql.NullString
+
+	err := db.Raw(`
+		SELECT p.name
+		FROM role_bindings rb
+		LEFT JOIN role_permissions rp ON rp.role_id = rb.role_id
+		LEFT JOIN permissions p ON p.id = rp.permission_id
+		WHERE rb.user_id = ? AND rb.resource_type = ? AND rb.resource_id = ?
+	`, userID, resourceType, resourceID).Scan(&names).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	permissions := make([]string, 0, len(names))
+	for _, n := range names {
+		if n.Valid {
+			permissions = append(permissions, n.String)
+		}
+	}
+	return permissions, len(names) > 0, nil
+}
+
+// BindRole grants a scoped role to users on a resource, replacing any role
+// they held there
+func BindRole(db *gorm.DB, roleName, resourceType string, resourceID uint, userIDs ...uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	var role Role
+	if err := db.Where("name = ? AND scope = ?", roleName, resourceType).First(&role).Error; err != nil {
+		return err
+	}
+
+	bindings := make([]RoleBinding, len(userIDs))
+	for i, id := range userIDs {
+		bindings[i] = RoleBinding{UserID: id, RoleID: role.ID, ResourceType: resourceType, ResourceID: resourceID}
+	}
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "resource_type"}, {Name: "resource_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"role_id"}),
+	}).Create(&bindings).Error
+}
+
+// UnbindRoles removes users' roles on a resource
+func UnbindRoles(db *gorm.DB, resourceType string, resourceID uint, userIDs ...uint) error {
+	return db.Where("resource_type = ? AND resource_id = ? AND user_id IN ?", resourceType, resourceID, userIDs).
+		Delete(&RoleBinding{}).Error
+}
@@ -6,17 +6,29 @@ import (
 
 // User represents a user in the database
 type User struct {
-	ID          uint      `gorm:"primaryKey" json:"id"`
-	GoogleID    string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"google_id"`
-	Email       string    `gorm:"type:varchar(255);uniqueIndex;not null" json:"email"`
-	Name        string    `gorm:"type:varchar(255);not null" json:"name"`
-	Picture     string    `gorm:"type:varchar(512)" json:"picture"`
-	Role        string    `gorm:"type:varchar(50);default:'user'" json:"role"`
-	LastLoginAt time.Time `gorm:"autoUpdateTime" json:"last_login_at"`
-	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
-	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	GoogleID      *string    `gorm:"type:varchar(255);uniqueIndex" json:"google_id,omitempty"` // nil for local-only accounts
+	Email         string     `gorm:"type:varchar(255);uniqueIndex;not null" json:"email"`
+	Name          string     `gorm:"type:varchar(255);not null" json:"name"`
+	Picture       string     `gorm:"type:varchar(512)" json:"picture"`
+	PasswordHash  string     `gorm:"type:varchar(255)" json:"-"` // empty for Google-only accounts
+	EmailVerified bool       `gorm:"default:false" json:"email_verified"`
+	MFAEnabled    bool       `gorm:"default:false" json:"mfa_enabled"`
+	TOTPSecret    string     `gorm:"type:varchar(64)" json:"-"`
+	TOTPLastStep  int64      `gorm:"default:0" json:"-"` // last accepted TOTP time step, prevents code replay
+	Role          string     `gorm:"type:varchar(50);default:'user'" json:"role"`
+	Bot           bool       `gorm:"not null;default:false" json:"bot"`  // service account that signs in with API keys only
+	DisabledAt    *time.Time `gorm:"index" json:"disabled_at,omitempty"` // set while an admin has disabled the account
+	LastLoginAt   time.Time  `gorm:"autoUpdateTime" json:"last_login_at"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
 func (User) TableName() string {
 	return "users"
 }
+
+// Disabled reports whether an admin has disabled the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusPending   = "pending"   // waiting for its first or next attempt
+	DeliveryStatusDelivered = "delivered" // the receiver answered 2xx
+	DeliveryStatusDead      = "dead"      // gave up after the last attempt; kept as a dead letter
+)
+
+// Webhook is a subscription that sends events to an external URL
+type Webhook struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	URL         string    `gorm:"type:varchar(2048);not null" json:"url"`
+	Description string    `gorm:"type:varchar(255)" json:"description"`
+	Secret      string    `gorm:"type:varchar(128);not null" json:"-"` // signs payloads
+	Events      []string  `gorm:"type:jsonb;serializer:json;not null" json:"events"`
+	Active      bool      `gorm:"not null;default:true" json:"active"`
+	CreatedByID uint      `gorm:"not null" json:"created_by_id"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (Webhook) TableName() string {
+	return "webhooks"
+}
+
+// WebhookDelivery is one event queued for one webhook. Pending deliveries are
+// the queue; delivered and dead ones are kept for the delivery log.
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	WebhookID     uint       `gorm:"not null;index" json:"webhook_id"`
+	EventID       string     `gorm:"type:varchar(36);not null" json:"event_id"` // shared by the deliveries of one event
+	Event         string     `gorm:"type:varchar(100);not null" json:"event"`
+	Payload       JSON       `gorm:"type:jsonb;not null" json:"payload"`
+	Status        string     `gorm:"type:varchar(20);not null;index:idx_webhook_deliveries_queue,priority:1" json:"status"`
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"not null;index:idx_webhook_deliveries_queue,priority:2" json:"next_attempt_at"`
+	LastError     string     `gorm:"type:text" json:"last_error,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime;index" json:"created_at"`
+	UpdatedAt     time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+// WebhookAttempt records one try at sending a delivery
+type WebhookAttempt struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	DeliveryID uint      `gorm:"not null;index" json:"delivery_id"`
+	StatusCode int       `json:"status_code"` // 0 when no response was received
+	Error      string    `gorm:"type:text" json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+func (WebhookAttempt) TableName() string {
+	return "webhook_attempts"
+}
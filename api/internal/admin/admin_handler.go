@@ -5,6 +5,8 @@ import (
 	"strconv"
 
 	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/webhook"
 	"github.com/chattycathy/api/pkg/logger"
 	"github.com/chattycathy/api/pkg/middleware"
 	"github.com/gin-gonic/gin"
@@ -21,24 +23,45 @@ func NewHandler(db *gorm.DB) *Handler {
 	return &Handler{db: db}
 }
 
-// RegisterRoutes registers admin routes (requires admin role)
+// RegisterRoutes registers admin routes. Role management requires the admin
+// role; user management is guarded by the users:* permissions.
 func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
 	admin := router.Group("/admin")
 	admin.Use(middleware.JWTAuth())
-	admin.Use(middleware.RequireRole("admin"))
+	admin.Use(middleware.RequireMFA())
+
+	rbac := admin.Group("")
+	rbac.Use(middleware.RequireRole("admin"))
 	{
 		// Permissions
-		admin.GET("/permissions", h.ListPermissions)
+		rbac.GET("/permissions", h.ListPermissions)
 
 		// Roles
-		admin.GET("/roles", h.ListRoles)
-		admin.GET("/roles/:id", h.GetRole)
-		admin.POST("/roles", h.CreateRole)
-		admin.PUT("/roles/:id", h.UpdateRole)
-		admin.DELETE("/roles/:id", h.DeleteRole)
+		rbac.GET("/roles", h.ListRoles)
+		rbac.GET("/roles/:id", h.GetRole)
+		rbac.POST("/roles", h.CreateRole)
+		rbac.PUT("/roles/:id", h.UpdateRole)
+		rbac.DELETE("/roles/:id", h.DeleteRole)
 
 		// Role permissions
-		admin.PUT("/roles/:id/permissions", h.SetRolePermissions)
+		rbac.PUT("/roles/:id/permissions", h.SetRolePermissions)
+	}
+
+	users := admin.Group("/users")
+	{
+		users.GET("", middleware.RequirePermission("users:read"), h.ListUsers)
+		users.GET("/:id", middleware.RequirePermission("users:read"), h.GetUser)
+		users.POST("/:id/disable", middleware.RequirePermission("users:update"), h.DisableUser)
+		users.POST("/:id/enable", middleware.RequirePermission("users:update"), h.EnableUser)
+		users.DELETE("/:id", middleware.RequirePermission("users:delete"), h.DeleteUser)
+
+		// User roles
+		users.POST("/:id/roles", middleware.RequirePermission("users:manage_roles"), h.AssignUserRole)
+		users.DELETE("/:id/roles/:role", middleware.RequirePermission("users:manage_roles"), h.RemoveUserRole)
+
+		// User sessions
+		users.GET("/:id/sessions", middleware.RequirePermission("users:read"), h.ListUserSessions)
+		users.DELETE("/:id/sessions/:session_id", middleware.RequirePermission("users:update"), h.RevokeUserSession)
 	}
 }
 
@@ -57,6 +80,8 @@ type RoleResponse struct {
 	Name        string               `json:"name"`
 	Description string               `json:"description"`
 	IsSystem    bool                 `json:"is_system"`
+	RequireMFA  bool                 `json:"require_mfa"`
+	Scope       string               `json:"scope"` // resource type for channel roles; empty for global roles
 	Permissions []PermissionResponse `json:"permissions"`
 }
 
@@ -109,6 +134,8 @@ func (h *Handler) ListRoles(c *gin.Context) {
 			Name:        r.Name,
 			Description: r.Description,
 			IsSystem:    r.IsSystem,
+			RequireMFA:  r.RequireMFA,
+			Scope:       r.Scope,
 			Permissions: permissions,
 		}
 	}
@@ -151,6 +178,8 @@ func (h *Handler) GetRole(c *gin.Context) {
 		Name:        role.Name,
 		Description: role.Description,
 		IsSystem:    role.IsSystem,
+		RequireMFA:  role.RequireMFA,
+		Scope:       role.Scope,
 		Permissions: permissions,
 	})
 }
@@ -159,6 +188,7 @@ func (h *Handler) GetRole(c *gin.Context) {
 type CreateRoleRequest struct {
 	Name        string `json:"name" binding:"required,min=2,max=100"`
 	Description string `json:"description" binding:"max=255"`
+	RequireMFA  bool   `json:"require_mfa"`
 }
 
 // CreateRole creates a new role
@@ -180,6 +210,7 @@ func (h *Handler) CreateRole(c *gin.Context) {
 		Name:        req.Name,
 		Description: req.Description,
 		IsSystem:    false, // User-created roles are never system roles
+		RequireMFA:  req.RequireMFA,
 	}
 
 	if err := h.db.Create(&role).Error; err != nil {
@@ -188,11 +219,21 @@ func (h *Handler) CreateRole(c *gin.Context) {
 		return
 	}
 
+	audit.Record(c, h.db, audit.Event{
+		Action:     "role.create",
+		TargetType: "role",
+		TargetID:   roleTarget(role.ID),
+		After:      roleAuditState(&role),
+	})
+	webhook.Notify(h.db, webhook.EventRoleCreated, roleEvent(&role))
+
 	c.JSON(http.StatusCreated, RoleResponse{
 		ID:          role.ID,
 		Name:        role.Name,
 		Description: role.Description,
 		IsSystem:    role.IsSystem,
+		RequireMFA:  role.RequireMFA,
+		Scope:       role.Scope,
 		Permissions: []PermissionResponse{},
 	})
 }
@@ -201,6 +242,7 @@ func (h *Handler) CreateRole(c *gin.Context) {
 type UpdateRoleRequest struct {
 	Name        string `json:"name" binding:"required,min=2,max=100"`
 	Description string `json:"description" binding:"max=255"`
+	RequireMFA  *bool  `json:"require_mfa"` // Unchanged when omitted
 }
 
 // UpdateRole updates an existing role
@@ -218,7 +260,7 @@ func (h *Handler) UpdateRole(c *gin.Context) {
 	}
 
 	var role models.Role
-	if err := h.db.First(&role, id).Error; err != nil {
+	if err := h.db.Preload("Permissions").First(&role, id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
 			return
@@ -241,15 +283,34 @@ func (h *Handler) UpdateRole(c *gin.Context) {
 		return
 	}
 
+	requireMFAChanged := req.RequireMFA != nil && *req.RequireMFA != role.RequireMFA
+	before := roleAuditState(&role)
+
 	role.Name = req.Name
 	role.Description = req.Description
+	if req.RequireMFA != nil {
+		role.RequireMFA = *req.RequireMFA
+	}
 
-	if err := h.db.Save(&role).Error; err != nil {
+	if err := h.db.Omit("Permissions").Save(&role).Error; err != nil {
 		logger.Error().Err(err).Msg("Failed to update role")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update role"})
 		return
 	}
 
+	if requireMFAChanged {
+		h.revokeRoleAccessTokens(role.ID)
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "role.update",
+		TargetType: "role",
+		TargetID:   roleTarget(role.ID),
+		Before:     before,
+		After:      roleAuditState(&role),
+	})
+	webhook.Notify(h.db, webhook.EventRoleUpdated, roleEvent(&role))
+
 	// Reload with permissions
 	h.db.Preload("Permissions").First(&role, id)
 
@@ -269,6 +330,8 @@ func (h *Handler) UpdateRole(c *gin.Context) {
 		Name:        role.Name,
 		Description: role.Description,
 		IsSystem:    role.IsSystem,
+		RequireMFA:  role.RequireMFA,
+		Scope:       role.Scope,
 		Permissions: permissions,
 	})
 }
@@ -298,6 +361,9 @@ func (h *Handler) DeleteRole(c *gin.Context) {
 		return
 	}
 
+	h.db.Preload("Permissions").First(&role, id)
+	before := roleAuditState(&role)
+
 	// Delete role (GORM will handle the role_permissions junction table)
 	if err := h.db.Select("Permissions").Delete(&role).Error; err != nil {
 		logger.Error().Err(err).Msg("Failed to delete role")
@@ -305,9 +371,20 @@ func (h *Handler) DeleteRole(c *gin.Context) {
 		return
 	}
 
+	// Members lose the role's permissions immediately
+	h.revokeRoleAccessTokens(role.ID)
+
 	// Also delete user_roles associations
 	h.db.Where("role_id = ?", id).Delete(&models.UserRole{})
 
+	audit.Record(c, h.db, audit.Event{
+		Action:     "role.delete",
+		TargetType: "role",
+		TargetID:   roleTarget(role.ID),
+		Before:     before,
+	})
+	webhook.Notify(h.db, webhook.EventRoleDeleted, roleEvent(&role))
+
 	c.JSON(http.StatusOK, gin.H{"message": "role deleted"})
 }
 
@@ -351,6 +428,9 @@ func (h *Handler) SetRolePermissions(c *gin.Context) {
 		}
 	}
 
+	h.db.Preload("Permissions").First(&role, id)
+	before := roleAuditState(&role)
+
 	// Replace the role's permissions
 	if err := h.db.Model(&role).Association("Permissions").Replace(permissions); err != nil {
 		logger.Error().Err(err).Msg("Failed to update role permissions")
@@ -358,6 +438,9 @@ func (h *Handler) SetRolePermissions(c *gin.Context) {
 		return
 	}
 
+	// Members must pick up the new permissions on their next refresh
+	h.revokeRoleAccessTokens(role.ID)
+
 	// Return updated role
 	h.db.Preload("Permissions").First(&role, id)
 
@@ -378,11 +461,62 @@ func (h *Handler) SetRolePermissions(c *gin.Context) {
 		Int("permission_count", len(permissions)).
 		Msg("Role permissions updated")
 
+	audit.Record(c, h.db, audit.Event{
+		Action:     "role.set_permissions",
+		TargetType: "role",
+		TargetID:   roleTarget(role.ID),
+		Before:     before,
+		After:      roleAuditState(&role),
+	})
+	webhook.Notify(h.db, webhook.EventRoleUpdated, roleEvent(&role))
+
 	c.JSON(http.StatusOK, RoleResponse{
 		ID:          role.ID,
 		Name:        role.Name,
 		Description: role.Description,
 		IsSystem:    role.IsSystem,
+		RequireMFA:  role.RequireMFA,
+		Scope:       role.Scope,
 		Permissions: permResponse,
 	})
 }
+
+// revokeRoleAccessTokens invalidates the access tokens of every user with a role,
+// forcing them to refresh and pick up their current permissions
+func (h *Handler) revokeRoleAccessTokens(roleID uint) {
+	userIDs, err := models.GetRoleUserIDs(h.db, roleID)
+	if err != nil {
+		logger.Error().Err(err).Uint("role_id", roleID).Msg("Failed to get role members")
+		return
+	}
+
+	for _, userID := range userIDs {
+		h.revokeUserAccessTokens(userID)
+	}
+}
+
+// roleAuditState is the snapshot of a role stored in audit events
+func roleAuditState(role *models.Role) gin.H {
+	permissions := make([]string, len(role.Permissions))
+	for i, p := range role.Permissions {
+		permissions[i] = p.Name
+	}
+	return gin.H{
+		"name":        role.Name,
+		"description": role.Description,
+		"require_mfa": role.RequireMFA,
+		"permissions": permissions,
+	}
+}
+
+// roleEvent is the webhook payload for a role change
+func roleEvent(role *models.Role) gin.H {
+	event := roleAuditState(role)
+	event["id"] = role.ID
+	event["scope"] = role.Scope
+	return event
+}
+
+func roleTarget(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// ListUserSessions returns the active sessions of any user
+func (h *Handler) ListUserSessions(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+
+	sessions, err := auth.ListUserTokens(context.Background(), userID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list sessions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": auth.SessionInfos(sessions, "")})
+}
+
+// RevokeUserSession signs out one session of any user
+func (h *Handler) RevokeUserSession(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+
+	sessionID := c.Param("session_id")
+	if err := auth.RevokeUserSession(context.Background(), userID, sessionID); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to revoke session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+
+	logger.Info().
+		Str("admin_id", adminID(c)).
+		Str("user_id", userID).
+		Str("session_id", sessionID).
+		Msg("Session revoked by admin")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "session.revoke",
+		TargetType: "user",
+		TargetID:   userID,
+		Before:     gin.H{"session_id": sessionID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
@@ -0,0 +1,473 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/webhook"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultUsersPerPage = 20
+	maxUsersPerPage     = 100
+)
+
+// UserResponse represents a user in the API response
+type UserResponse struct {
+	ID            uint       `json:"id"`
+	Email         string     `json:"email"`
+	Name          string     `json:"name"`
+	Picture       string     `json:"picture"`
+	Role          string     `json:"role"`
+	Bot           bool       `json:"bot"`
+	EmailVerified bool       `json:"email_verified"`
+	MFAEnabled    bool       `json:"mfa_enabled"`
+	Disabled      bool       `json:"disabled"`
+	DisabledAt    *time.Time `json:"disabled_at,omitempty"`
+	LastLoginAt   time.Time  `json:"last_login_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// UserRoleResponse represents a role assigned to a user
+type UserRoleResponse struct {
+	ID         uint   `json:"id"`
+	Name       string `json:"name"`
+	RequireMFA bool   `json:"require_mfa"`
+}
+
+// UserDetailResponse represents a user with their roles and effective permissions
+type UserDetailResponse struct {
+	UserResponse
+	Roles       []UserRoleResponse `json:"roles"`
+	Permissions []string           `json:"permissions"`
+}
+
+// UserListResponse represents a page of users
+type UserListResponse struct {
+	Users   []UserResponse `json:"users"`
+	Total   int64          `json:"total"`
+	Page    int            `json:"page"`
+	PerPage int            `json:"per_page"`
+}
+
+func newUserResponse(u *models.User) UserResponse {
+	return UserResponse{
+		ID:            u.ID,
+		Email:         u.Email,
+		Name:          u.Name,
+		Picture:       u.Picture,
+		Role:          u.Role,
+		Bot:           u.Bot,
+		EmailVerified: u.EmailVerified,
+		MFAEnabled:    u.MFAEnabled,
+		Disabled:      u.Disabled(),
+		DisabledAt:    u.DisabledAt,
+		LastLoginAt:   u.LastLoginAt,
+		CreatedAt:     u.CreatedAt,
+	}
+}
+
+// ListUsers returns a page of users.
+// Query parameters: page, per_page, q (matches email or name), role, disabled
+// (true/false), bot (true/false).
+func (h *Handler) ListUsers(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultUsersPerPage)))
+	if perPage < 1 || perPage > maxUsersPerPage {
+		perPage = defaultUsersPerPage
+	}
+
+	query := h.db.Model(&models.User{})
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + strings.ToLower(q) + "%"
+		query = query.Where("LOWER(email) LIKE ? OR LOWER(name) LIKE ?", pattern, pattern)
+	}
+	if role := c.Query("role"); role != "" {
+		query = query.Where(`id IN (
+			SELECT ur.user_id
+			FROM user_roles ur
+			JOIN roles r ON r.id = ur.role_id
+			WHERE r.name = ?
+		)`, role)
+	}
+	switch c.Query("disabled") {
+	case "true":
+		query = query.Where("disabled_at IS NOT NULL")
+	case "false":
+		query = query.Where("disabled_at IS NULL")
+	}
+	switch c.Query("bot") {
+	case "true":
+		query = query.Where("bot")
+	case "false":
+		query = query.Where("NOT bot")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to count users")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch users"})
+		return
+	}
+
+	var users []models.User
+	if err := query.Order("id").Offset((page - 1) * perPage).Limit(perPage).Find(&users).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list users")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch users"})
+		return
+	}
+
+	response := make([]UserResponse, len(users))
+	for i := range users {
+		response[i] = newUserResponse(&users[i])
+	}
+
+	c.JSON(http.StatusOK, UserListResponse{
+		Users:   response,
+		Total:   total,
+		Page:    page,
+		PerPage: perPage,
+	})
+}
+
+// GetUser returns a user with their roles and effective permissions
+func (h *Handler) GetUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+	h.respondUserDetail(c, user)
+}
+
+// AssignUserRoleRequest represents a request to give a user a role
+type AssignUserRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// AssignUserRole gives a user a role
+func (h *Handler) AssignUserRole(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+
+	var req AssignUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	before := h.userRoleNames(user.ID)
+	if err := models.AssignRoleToUser(h.db, user.ID, req.Role); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to assign role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to assign role"})
+		return
+	}
+
+	h.userRolesChanged(c, user, "user.assign_role", req.Role, before)
+}
+
+// RemoveUserRole takes a role away from a user
+func (h *Handler) RemoveUserRole(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+
+	roleName := c.Param("role")
+	before := h.userRoleNames(user.ID)
+	if err := models.RemoveRoleFromUser(h.db, user.ID, roleName); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to remove role")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove role"})
+		return
+	}
+
+	h.userRolesChanged(c, user, "user.remove_role", roleName, before)
+}
+
+// userRolesChanged syncs the primary role, revokes stale access tokens, records
+// the change and responds with the updated user
+func (h *Handler) userRolesChanged(c *gin.Context, user *models.User, action, roleName string, before []string) {
+	role, err := models.SyncUserRole(h.db, user.ID)
+	if err != nil {
+		logger.Error().Err(err).Uint("user_id", user.ID).Msg("Failed to sync user role")
+	} else {
+		user.Role = role
+	}
+
+	h.revokeUserAccessTokens(user.ID)
+
+	logger.Info().
+		Str("admin_id", adminID(c)).
+		Uint("user_id", user.ID).
+		Str("role", roleName).
+		Str("action", action).
+		Msg("User roles changed")
+
+	roles := h.userRoleNames(user.ID)
+	audit.Record(c, h.db, audit.Event{
+		Action:     action,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		Before:     gin.H{"roles": before},
+		After:      gin.H{"roles": roles, "primary_role": user.Role},
+	})
+	webhook.Notify(h.db, webhook.EventUserRolesChanged, gin.H{
+		"user_id":      user.ID,
+		"roles":        roles,
+		"primary_role": user.Role,
+	})
+
+	h.respondUserDetail(c, user)
+}
+
+// DisableUser blocks a user from signing in and ends their sessions
+func (h *Handler) DisableUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+
+	if strconv.FormatUint(uint64(user.ID), 10) == adminID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot disable your own account"})
+		return
+	}
+
+	if !user.Disabled() {
+		now := time.Now()
+		if err := h.db.Model(user).Update("disabled_at", now).Error; err != nil {
+			logger.Error().Err(err).Msg("Failed to disable user")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable user"})
+			return
+		}
+		user.DisabledAt = &now
+	}
+
+	h.revokeUserSessions(user.ID)
+
+	logger.Info().
+		Str("admin_id", adminID(c)).
+		Uint("user_id", user.ID).
+		Msg("User disabled")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "user.disable",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+	})
+
+	c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// EnableUser lets a disabled user sign in again
+func (h *Handler) EnableUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+
+	if user.Disabled() {
+		if err := h.db.Model(user).Update("disabled_at", nil).Error; err != nil {
+			logger.Error().Err(err).Msg("Failed to enable user")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable user"})
+			return
+		}
+		user.DisabledAt = nil
+	}
+
+	logger.Info().
+		Str("admin_id", adminID(c)).
+		Uint("user_id", user.ID).
+		Msg("User enabled")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "user.enable",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+	})
+
+	c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// DeleteUser permanently deletes a user and ends their sessions
+func (h *Handler) DeleteUser(c *gin.Context) {
+	user, ok := h.loadUser(c)
+	if !ok {
+		return
+	}
+
+	if strconv.FormatUint(uint64(user.ID), 10) == adminID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete your own account"})
+		return
+	}
+
+	before := gin.H{"email": user.Email, "name": user.Name, "roles": h.userRoleNames(user.ID)}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.ConversationMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RoleBinding{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.MessageReaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.ThreadFollower{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.APIKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Reminder{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("bot_id = ?", user.ID).Delete(&models.SlashCommand{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("bot_id = ?", user.ID).Delete(&models.IncomingWebhook{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to delete user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user"})
+		return
+	}
+
+	h.revokeUserSessions(user.ID)
+
+	logger.Info().
+		Str("admin_id", adminID(c)).
+		Uint("user_id", user.ID).
+		Str("email", user.Email).
+		Msg("User deleted")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "user.delete",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		Before:     before,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
+}
+
+// respondUserDetail writes the user with their current roles and permissions
+func (h *Handler) respondUserDetail(c *gin.Context, user *models.User) {
+	roles, err := models.GetUserRoles(h.db, user.ID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get user roles")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+
+	permissions, err := models.GetUserPermissions(h.db, user.ID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get user permissions")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	roleResponse := make([]UserRoleResponse, len(roles))
+	for i, r := range roles {
+		roleResponse[i] = UserRoleResponse{ID: r.ID, Name: r.Name, RequireMFA: r.RequireMFA}
+	}
+
+	c.JSON(http.StatusOK, UserDetailResponse{
+		UserResponse: newUserResponse(user),
+		Roles:        roleResponse,
+		Permissions:  permissions,
+	})
+}
+
+// userRoleNames returns the names of the user's roles for audit snapshots
+func (h *Handler) userRoleNames(userID uint) []string {
+	roles, err := models.GetUserRoles(h.db, userID)
+	if err != nil {
+		logger.Warn().Err(err).Uint("user_id", userID).Msg("Failed to get user roles")
+	}
+	names := make([]string, len(roles))
+	for i, r := range roles {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// loadUser fetches the user named by the :id parameter.
+// It writes the error response and returns false if that fails.
+func (h *Handler) loadUser(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return nil, false
+	}
+
+	var user models.User
+	if err := h.db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// revokeUserAccessTokens makes a user's clients refresh to pick up changed permissions
+func (h *Handler) revokeUserAccessTokens(userID uint) {
+	if err := auth.RevokeUserAccessTokens(context.Background(), strconv.FormatUint(uint64(userID), 10)); err != nil {
+		logger.Error().Err(err).Uint("user_id", userID).Msg("Failed to revoke access tokens")
+	}
+}
+
+// revokeUserSessions signs a user out everywhere
+func (h *Handler) revokeUserSessions(userID uint) {
+	if err := auth.RevokeAllUserTokens(context.Background(), strconv.FormatUint(uint64(userID), 10)); err != nil {
+		logger.Error().Err(err).Uint("user_id", userID).Msg("Failed to revoke sessions")
+	}
+	h.revokeUserAccessTokens(userID)
+}
+
+// adminID returns the ID of the admin making the request
+func adminID(c *gin.Context) string {
+	if claims, ok := middleware.GetClaims(c); ok {
+		return claims.UserID
+	}
+	return ""
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Column sizes of the request details, which come from the client. Longer
+// values would fail the insert, so they are cut to fit.
+const (
+	maxRequestIDLength = 64
+	maxIPLength        = 64
+	maxUserAgentLength = 512
+	maxEmailLength     = 255
+)
+
+// Event describes an action to record in the audit log
+type Event struct {
+	Action     string
+	TargetType string
+	TargetID   string
+	Before     interface{} // state before the change, marshalled to JSON
+	After      interface{} // state after the change, marshalled to JSON
+
+	// ActorID and ActorEmail identify who acted. When nil, the authenticated
+	// user of the request is used.
+	ActorID    *uint
+	ActorEmail string
+}
+
+// Record writes an event to the audit log, filling in the actor and request
+// details from the request context. Failures are logged but never fail the request.
+func Record(c *gin.Context, db *gorm.DB, e Event) {
+	entry := models.AuditEvent{
+		ActorID:    e.ActorID,
+		ActorEmail: e.ActorEmail,
+		Action:     e.Action,
+		TargetType: e.TargetType,
+		TargetID:   e.TargetID,
+		Before:     marshal(e.Before),
+		After:      marshal(e.After),
+		RequestID:  truncate(middleware.GetRequestID(c), maxRequestIDLength),
+		IP:         truncate(c.ClientIP(), maxIPLength),
+		UserAgent:  truncate(c.Request.UserAgent(), maxUserAgentLength),
+	}
+
+	if entry.ActorID == nil {
+		if claims, ok := middleware.GetClaims(c); ok {
+			if id, err := strconv.ParseUint(claims.UserID, 10, 32); err == nil {
+				actorID := uint(id)
+				entry.ActorID = &actorID
+				entry.ActorEmail = claims.Username
+			}
+		}
+	}
+	entry.ActorEmail = truncate(entry.ActorEmail, maxEmailLength)
+
+	if err := db.Create(&entry).Error; err != nil {
+		logger.Error().Err(err).Str("action", e.Action).Msg("Failed to record audit event")
+	}
+}
+
+// IDTarget returns the target ID for a record with a numeric ID, such as a user
+func IDTarget(id uint) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// truncate makes a value storable in a varchar(n) column: valid UTF-8 without
+// NUL bytes, and at most n characters
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func marshal(v interface{}) models.JSON {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to marshal audit state")
+		return nil
+	}
+	return data
+}
+
+// PurgeLoop deletes events older than the retention period once a day until
+// the context is cancelled
+func PurgeLoop(ctx context.Context, db *gorm.DB, retention time.Duration) {
+	purge := func() {
+		deleted, err := models.DeleteAuditEventsBefore(db, time.Now().Add(-retention))
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to purge audit events")
+			return
+		}
+		if deleted > 0 {
+			logger.Info().Int64("deleted", deleted).Msg("Purged expired audit events")
+		}
+	}
+
+	purge()
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purge()
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultEventLimit = 50
+	maxEventLimit     = 200
+)
+
+// Handler serves the audit log
+type Handler struct {
+	db *gorm.DB
+}
+
+// NewHandler creates a new audit handler
+func NewHandler(db *gorm.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// RegisterRoutes registers audit routes (requires audit:read and an MFA session)
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	audit := router.Group("/admin/audit")
+	audit.Use(middleware.JWTAuth())
+	audit.Use(middleware.RequireMFA())
+	audit.Use(middleware.RequirePermission("audit:read"))
+	{
+		audit.GET("", h.ListEvents)
+	}
+}
+
+// EventListResponse represents a page of audit events
+type EventListResponse struct {
+	Events     []models.AuditEvent `json:"events"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// ListEvents returns audit events, newest first.
+// Query parameters: actor_id, action, target_type, target_id, since, until (RFC 3339),
+// limit and cursor (the next_cursor of the previous page).
+func (h *Handler) ListEvents(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultEventLimit)))
+	if limit < 1 || limit > maxEventLimit {
+		limit = defaultEventLimit
+	}
+
+	query := h.db.Model(&models.AuditEvent{})
+
+	if v := c.Query("actor_id"); v != "" {
+		actorID, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid actor_id"})
+			return
+		}
+		query = query.Where("actor_id = ?", actorID)
+	}
+	if v := c.Query("action"); v != "" {
+		query = query.Where("action = ?", v)
+	}
+	if v := c.Query("target_type"); v != "" {
+		query = query.Where("target_type = ?", v)
+	}
+	if v := c.Query("target_id"); v != "" {
+		query = query.Where("target_id = ?", v)
+	}
+	for param, cond := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + ", expected RFC 3339"})
+			return
+		}
+		query = query.Where(cond, t)
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		query = query.Where("id < ?", cursor)
+	}
+
+	// Fetch one extra row to know whether there is another page
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&events).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list audit events")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch audit events"})
+		return
+	}
+
+	response := EventListResponse{Events: events}
+	if len(events) > limit {
+		response.Events = events[:limit]
+		response.NextCursor = strconv.FormatUint(uint64(events[limit-1].ID), 10)
+	}
+	if response.Events == nil {
+		response.Events = []models.AuditEvent{}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
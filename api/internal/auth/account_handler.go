@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/webhook"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/mailer"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AccountHandler handles self-service registration, email verification and password resets
+type AccountHandler struct {
+	db     *gorm.DB
+	mailer mailer.Mailer
+	appURL string
+}
+
+// NewAccountHandler creates a new account handler
+func NewAccountHandler(db *gorm.DB, m mailer.Mailer, appURL string) *AccountHandler {
+	return &AccountHandler{
+		db:     db,
+		mailer: m,
+		appURL: strings.TrimRight(appURL, "/"),
+	}
+}
+
+// RegisterRoutes registers account routes
+func (h *AccountHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.POST("/auth/register", h.Register)
+	router.POST("/auth/verify-email", h.VerifyEmail)
+	router.POST("/auth/password/forgot", h.ForgotPassword)
+	router.POST("/auth/password/reset", h.ResetPassword)
+}
+
+// RegisterRequest represents a registration request
+type RegisterRequest struct {
+	Email    string `json:"email" binding:"required,email,max=255"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+	Name     string `json:"name" binding:"required,min=1,max=255"`
+}
+
+// Register creates a new local account and sends a verification email. If
+// the address is taken, its owner is told by email instead. The response is
+// the same either way so it cannot be used to probe for accounts.
+func (h *AccountHandler) Register(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	response := gin.H{"message": "check your email to finish registering"}
+
+	// Hash before the lookup so both paths take as long
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to hash password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create account"})
+		return
+	}
+
+	var existing models.User
+	err = h.db.Where("LOWER(email) = ?", email).First(&existing).Error
+	if err == nil {
+		h.registeredExisting(c, &existing, email)
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Error().Err(err).Msg("Failed to look up user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create account"})
+		return
+	}
+
+	user := models.User{
+		Email:        email,
+		Name:         strings.TrimSpace(req.Name),
+		PasswordHash: hash,
+		Role:         "user",
+	}
+	created := false
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// A concurrent registration of the same address may have won since
+		// the lookup; it must get the same answer as any existing account
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&user)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		created = true
+		return models.AssignRoleToUser(tx, user.ID, "user")
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to create user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create account"})
+		return
+	}
+	if !created {
+		if err := h.db.Where("LOWER(email) = ?", email).First(&existing).Error; err != nil {
+			logger.Error().Err(err).Msg("Failed to look up user")
+		} else {
+			h.registeredExisting(c, &existing, email)
+		}
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+
+	if err := h.sendVerificationEmail(c.Request.Context(), &user); err != nil {
+		logger.Error().Err(err).Uint("user_id", user.ID).Msg("Failed to send verification email")
+	}
+
+	logger.Info().
+		Str("email", user.Email).
+		Uint("user_id", user.ID).
+		Msg("New user registered")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "account.register",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"method": "password"},
+	})
+	webhook.Notify(h.db, webhook.EventUserCreated, userCreatedEvent(&user, "password"))
+
+	c.JSON(http.StatusAccepted, response)
+}
+
+// TokenRequest represents a request carrying a single-use email token
+type TokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// VerifyEmail marks the user's email as verified
+func (h *AccountHandler) VerifyEmail(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	userID, err := auth.ConsumeEmailVerificationToken(c.Request.Context(), req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	}
+
+	result := h.db.Model(&models.User{}).Where("id = ?", userID).Update("email_verified", true)
+	if result.Error != nil {
+		logger.Error().Err(result.Error).Str("user_id", userID).Msg("Failed to verify email")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify email"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	}
+
+	logger.Info().Str("user_id", userID).Msg("Email verified")
+	c.JSON(http.StatusOK, gin.H{"message": "email verified"})
+}
+
+// ForgotPasswordRequest represents a request to start a password reset
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// ForgotPassword sends a password reset link if the account exists.
+// The response is the same either way so it cannot be used to probe for accounts.
+func (h *AccountHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	response := gin.H{"message": "if the account exists, a reset link has been sent"}
+
+	var user models.User
+	err := h.db.Where("LOWER(email) = LOWER(?)", req.Email).First(&user).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Error().Err(err).Msg("Failed to look up user")
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if err := h.sendPasswordResetEmail(c.Request.Context(), &user); err != nil {
+		logger.Error().Err(err).Uint("user_id", user.ID).Msg("Failed to send password reset email")
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ResetPasswordRequest represents a request to set a new password
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+// ResetPassword sets a new password and signs the user out everywhere
+func (h *AccountHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID, err := auth.ConsumePasswordResetToken(ctx, req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to hash password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+
+	// Completing a reset proves ownership of the address
+	result := h.db.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password_hash":  hash,
+		"email_verified": true,
+	})
+	if result.Error != nil {
+		logger.Error().Err(result.Error).Str("user_id", userID).Msg("Failed to reset password")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset password"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	}
+
+	if err := auth.RevokeAllUserTokens(ctx, userID); err != nil {
+		logger.Warn().Err(err).Str("user_id", userID).Msg("Failed to revoke sessions after password reset")
+	}
+	if err := auth.RevokeUserAccessTokens(ctx, userID); err != nil {
+		logger.Warn().Err(err).Str("user_id", userID).Msg("Failed to revoke access tokens after password reset")
+	}
+
+	logger.Info().Str("user_id", userID).Msg("Password reset")
+
+	event := audit.Event{
+		Action:     "account.password_reset",
+		TargetType: "user",
+		TargetID:   userID,
+	}
+	if id, err := strconv.ParseUint(userID, 10, 32); err == nil {
+		actorID := uint(id)
+		event.ActorID = &actorID
+	}
+	audit.Record(c, h.db, event)
+	c.JSON(http.StatusOK, gin.H{"message": "password has been reset"})
+}
+
+func (h *AccountHandler) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, err := auth.GenerateActionToken()
+	if err != nil {
+		return err
+	}
+	if err := auth.StoreEmailVerificationToken(ctx, token, strconv.FormatUint(uint64(user.ID), 10)); err != nil {
+		return err
+	}
+
+	link := h.appURL + "/verify-email?token=" + url.QueryEscape(token)
+	return h.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your ChattyCathy email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.Name, link, auth.EmailVerificationExpiry,
+		),
+	})
+}
+
+func (h *AccountHandler) sendPasswordResetEmail(ctx context.Context, user *models.User) error {
+	token, err := auth.GenerateActionToken()
+	if err != nil {
+		return err
+	}
+	if err := auth.StorePasswordResetToken(ctx, token, strconv.FormatUint(uint64(user.ID), 10)); err != nil {
+		return err
+	}
+
+	link := h.appURL + "/reset-password?token=" + url.QueryEscape(token)
+	return h.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your ChattyCathy password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below:\n\n%s\n\nThe link expires in %s. If you didn't ask for this, you can ignore this email.\n",
+			user.Name, link, auth.PasswordResetExpiry,
+		),
+	})
+}
+
+// registeredExisting handles a registration for an address that already has
+// an account: the holder is told by email and the attempt is audited
+func (h *AccountHandler) registeredExisting(c *gin.Context, existing *models.User, email string) {
+	if err := h.sendAccountExistsEmail(c.Request.Context(), existing); err != nil {
+		logger.Error().Err(err).Uint("user_id", existing.ID).Msg("Failed to send account exists email")
+	}
+	audit.Record(c, h.db, audit.Event{
+		Action:     "account.register_existing",
+		ActorEmail: email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(existing.ID),
+	})
+}
+
+// sendAccountExistsEmail tells an account holder that someone tried to
+// register with their address
+func (h *AccountHandler) sendAccountExistsEmail(ctx context.Context, user *models.User) error {
+	return h.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Someone tried to register with your ChattyCathy email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone tried to create a ChattyCathy account with this email address, which already has an account. If it was you, sign in instead, or use \"Forgot password\" if you no longer know your password:\n\n%s\n\nIf it wasn't you, you can ignore this email. Your account has not been changed.\n",
+			user.Name, h.appURL,
+		),
+	})
+}
+
+// userCreatedEvent is the webhook payload for a new account
+func userCreatedEvent(user *models.User, method string) gin.H {
+	return gin.H{
+		"id":             user.ID,
+		"email":          user.Email,
+		"name":           user.Name,
+		"email_verified": user.EmailVerified,
+		"method":         method,
+		"created_at":     user.CreatedAt,
+	}
+}
@@ -2,13 +2,18 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
 	"github.com/chattycathy/api/pkg/auth"
 	"github.com/chattycathy/api/pkg/logger"
 	"github.com/chattycathy/api/pkg/middleware"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
 const (
@@ -17,14 +22,18 @@ const (
 
 // Handler handles authentication endpoints
 type Handler struct {
+	db                     *gorm.DB
+	sessions               *sessionIssuer
 	issuer                 string
 	accessTokenExpiryMins  int
 	refreshTokenExpiryDays int
 }
 
 // NewHandler creates a new auth handler
-func NewHandler(issuer string, accessExpiryMins, refreshExpiryDays int) *Handler {
+func NewHandler(db *gorm.DB, issuer string, accessExpiryMins, refreshExpiryDays int) *Handler {
 	return &Handler{
+		db:                     db,
+		sessions:               newSessionIssuer(db, issuer, accessExpiryMins, refreshExpiryDays),
 		issuer:                 issuer,
 		accessTokenExpiryMins:  accessExpiryMins,
 		refreshTokenExpiryDays: refreshExpiryDays,
@@ -38,15 +47,23 @@ func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
 	router.POST("/auth/logout", h.Logout)
 	router.POST("/auth/logout-all", middleware.JWTAuth(), h.LogoutAll)
 	router.GET("/auth/sessions", middleware.JWTAuth(), h.ListSessions)
+	router.DELETE("/auth/sessions/:id", middleware.JWTAuth(), h.RevokeSession)
+
+	// Multi-factor authentication
+	router.POST("/auth/mfa/verify", h.VerifyMFA)
+	router.POST("/auth/mfa/enroll", middleware.JWTAuth(), h.EnrollMFA)
+	router.POST("/auth/mfa/enroll/confirm", middleware.JWTAuth(), h.ConfirmMFAEnrollment)
+	router.POST("/auth/mfa/disable", middleware.JWTAuth(), h.DisableMFA)
+	router.POST("/auth/mfa/recovery-codes", middleware.JWTAuth(), h.RegenerateRecoveryCodes)
 }
 
 // LoginRequest represents a login request
 type LoginRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required,max=72"`
 }
 
-// Login authenticates a user and returns access + refresh tokens
+// Login authenticates a local account and returns access + refresh tokens
 func (h *Handler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -54,62 +71,69 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	// Demo authentication - in production, verify against DB
-	if req.Password != "password123" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+	var user models.User
+	err := h.db.Where("LOWER(email) = LOWER(?)", req.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Error().Err(err).Msg("Failed to look up user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process login"})
 		return
 	}
 
-	// In production, get user ID and role from database
-	userID := "user-" + req.Username
-	role := "user"
-	if req.Username == "admin" {
-		role = "admin"
+	// Unknown users and Google-only accounts have an empty hash and are
+	// rejected by the same constant-time comparison as a wrong password
+	if !auth.VerifyPassword(user.PasswordHash, req.Password) {
+		h.recordLoginFailure(c, &user, req.Email, "invalid_credentials")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return
 	}
 
-	// Demo permissions - in production, get from database
-	permissions := []string{"ping:read", "news:read"}
-	if role == "admin" {
-		permissions = []string{"ping:read", "news:read", "news:create", "news:update", "news:delete", "users:read", "users:update"}
+	if !user.EmailVerified {
+		h.recordLoginFailure(c, &user, req.Email, "email_not_verified")
+		c.JSON(http.StatusForbidden, gin.H{"error": "email not verified"})
+		return
 	}
 
-	// Generate token pair
-	tokenPair, err := auth.GenerateTokenPair(
-		userID, req.Username, role,
-		permissions,
-		h.issuer,
-		h.accessTokenExpiryMins,
-		h.refreshTokenExpiryDays,
-	)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to generate token pair")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate tokens"})
+	if user.Disabled() {
+		h.recordLoginFailure(c, &user, req.Email, "account_disabled")
+		respondSessionError(c, errAccountDisabled)
 		return
 	}
 
-	// Store refresh token in Redis
-	ctx := context.Background()
-	refreshData := &auth.RefreshTokenData{
-		UserID:      userID,
-		Username:    req.Username,
-		Role:        role,
-		Permissions: permissions,
-		CreatedAt:   time.Now(),
-		UserAgent:   c.Request.UserAgent(),
-		IP:          c.ClientIP(),
+	if err := h.db.Model(&user).Update("last_login_at", time.Now()).Error; err != nil {
+		logger.Warn().Err(err).Uint("user_id", user.ID).Msg("Failed to update last login")
 	}
-	expiry := time.Duration(h.refreshTokenExpiryDays) * 24 * time.Hour
-	if err := auth.StoreRefreshToken(ctx, tokenPair.RefreshToken, refreshData, expiry); err != nil {
-		logger.Error().Err(err).Msg("Failed to store refresh token")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "auth.login",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"method": "password", "mfa_required": user.MFAEnabled},
+	})
+
+	amr := []string{auth.AMRPassword}
+
+	// Users enrolled in MFA get a challenge instead of tokens
+	if user.MFAEnabled {
+		h.sessions.startMFAChallenge(c, &user, amr)
+		return
+	}
+
+	session, err := h.sessions.issue(c, &user, amr)
+	if err != nil {
+		respondSessionError(c, err)
 		return
 	}
 
 	// Set refresh token as httpOnly cookie (for web clients)
-	h.setRefreshTokenCookie(c, tokenPair.RefreshToken)
+	h.setRefreshTokenCookie(c, session.TokenPair.RefreshToken)
 
 	// Return tokens in response body (for mobile/API clients)
-	c.JSON(http.StatusOK, tokenPair)
+	c.JSON(http.StatusOK, loginResponse{
+		TokenPair:             session.TokenPair,
+		MFAEnrollmentRequired: session.MFAEnrollmentRequired,
+	})
 }
 
 // RefreshRequest for mobile clients that send refresh token in body
@@ -126,9 +150,46 @@ func (h *Handler) Refresh(c *gin.Context) {
 		return
 	}
 
-	// Validate refresh token
+	// Rotate refresh token: the old one is consumed and kept as a tombstone
 	ctx := context.Background()
-	tokenData, err := auth.GetRefreshTokenData(ctx, refreshToken)
+	expiry := time.Duration(h.refreshTokenExpiryDays) * 24 * time.Hour
+	tokenData, err := auth.RotateRefreshToken(ctx, refreshToken, expiry)
+	if errors.Is(err, auth.ErrRefreshTokenReused) {
+		// A rotated token came back: either the client or an attacker holds a
+		// copy. Kill the family so neither can continue.
+		audit.Record(c, h.db, audit.Event{
+			Action:     "auth.refresh_token_reuse",
+			ActorEmail: tokenData.Username,
+			TargetType: "user",
+			TargetID:   tokenData.UserID,
+			Before:     gin.H{"session_id": tokenData.SessionID},
+		})
+		logger.Warn().
+			Err(err).
+			Str("event", "refresh_token_reuse").
+			Str("user_id", tokenData.UserID).
+			Str("family_id", tokenData.FamilyID).
+			Str("ip", c.ClientIP()).
+			Str("user_agent", c.Request.UserAgent()).
+			Msg("Refresh token reuse detected, token family revoked")
+		// Only this login's access tokens: the session ID survives rotation, so
+		// it covers the whole family. Tokens from before session IDs have no
+		// narrower handle than the user.
+		if tokenData.SessionID != "" {
+			err = auth.RevokeSessionAccessTokens(ctx, tokenData.SessionID)
+		} else {
+			err = auth.RevokeUserAccessTokens(ctx, tokenData.UserID)
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to revoke access tokens")
+		}
+		h.clearRefreshTokenCookie(c)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "refresh token reuse detected",
+			"code":  "refresh_token_reused",
+		})
+		return
+	}
 	if err != nil {
 		logger.Warn().Err(err).Msg("Invalid refresh token")
 		h.clearRefreshTokenCookie(c)
@@ -136,58 +197,65 @@ func (h *Handler) Refresh(c *gin.Context) {
 		return
 	}
 
-	// Rotate refresh token (issue new one, revoke old)
-	if err := auth.RevokeRefreshToken(ctx, refreshToken); err != nil {
-		logger.Warn().Err(err).Msg("Failed to revoke old refresh token")
-	}
-
-	// Generate new token pair
-	tokenPair, err := auth.GenerateTokenPair(
-		tokenData.UserID, tokenData.Username, tokenData.Role,
-		tokenData.Permissions,
-		h.issuer,
-		h.accessTokenExpiryMins,
-		h.refreshTokenExpiryDays,
-	)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to generate new token pair")
+	// Reload the user so role and permission changes since login take effect
+	var user models.User
+	if err := h.db.Where("id = ?", tokenData.UserID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			h.clearRefreshTokenCookie(c)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to get user")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to refresh tokens"})
 		return
 	}
 
-	// Store new refresh token
-	newRefreshData := &auth.RefreshTokenData{
-		UserID:      tokenData.UserID,
-		Username:    tokenData.Username,
-		Role:        tokenData.Role,
-		Permissions: tokenData.Permissions,
-		CreatedAt:   time.Now(),
-		UserAgent:   c.Request.UserAgent(),
-		IP:          c.ClientIP(),
-	}
-	expiry := time.Duration(h.refreshTokenExpiryDays) * 24 * time.Hour
-	if err := auth.StoreRefreshToken(ctx, tokenPair.RefreshToken, newRefreshData, expiry); err != nil {
-		logger.Error().Err(err).Msg("Failed to store new refresh token")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+	// Generate and store new token pair
+	session, err := h.sessions.reissue(c, &user, tokenData)
+	if err != nil {
+		respondSessionError(c, err)
 		return
 	}
 
 	// Update cookie
-	h.setRefreshTokenCookie(c, tokenPair.RefreshToken)
+	h.setRefreshTokenCookie(c, session.TokenPair.RefreshToken)
 
-	c.JSON(http.StatusOK, tokenPair)
+	c.JSON(http.StatusOK, loginResponse{
+		TokenPair:             session.TokenPair,
+		MFAEnrollmentRequired: session.MFAEnrollmentRequired,
+	})
 }
 
-// Logout revokes the current refresh token
+// Logout revokes the current refresh token and, if presented, the access token
 func (h *Handler) Logout(c *gin.Context) {
+	ctx := context.Background()
+	var session *auth.RefreshTokenData
 	refreshToken := h.getRefreshToken(c)
 	if refreshToken != "" {
-		ctx := context.Background()
+		session, _ = auth.GetRefreshTokenData(ctx, refreshToken)
 		if err := auth.RevokeRefreshToken(ctx, refreshToken); err != nil {
 			logger.Warn().Err(err).Msg("Failed to revoke refresh token")
 		}
 	}
 
+	if header := c.GetHeader(middleware.AuthorizationHeader); strings.HasPrefix(header, middleware.BearerPrefix) {
+		if claims, err := auth.ValidateToken(strings.TrimPrefix(header, middleware.BearerPrefix)); err == nil {
+			if err := auth.RevokeAccessToken(ctx, claims); err != nil {
+				logger.Warn().Err(err).Msg("Failed to revoke access token")
+			}
+		}
+	}
+
+	if session != nil {
+		audit.Record(c, h.db, audit.Event{
+			Action:     "auth.logout",
+			ActorEmail: session.Username,
+			TargetType: "user",
+			TargetID:   session.UserID,
+			Before:     gin.H{"session_id": session.SessionID},
+		})
+	}
+
 	h.clearRefreshTokenCookie(c)
 	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
 }
@@ -206,6 +274,17 @@ func (h *Handler) LogoutAll(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout all sessions"})
 		return
 	}
+	if err := auth.RevokeUserAccessTokens(ctx, claims.UserID); err != nil {
+		logger.Error().Err(err).Msg("Failed to revoke access tokens")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to logout all sessions"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "auth.logout_all",
+		TargetType: "user",
+		TargetID:   claims.UserID,
+	})
 
 	h.clearRefreshTokenCookie(c)
 	c.JSON(http.StatusOK, gin.H{"message": "all sessions logged out"})
@@ -227,17 +306,62 @@ func (h *Handler) ListSessions(c *gin.Context) {
 		return
 	}
 
-	// Format sessions for response (don't expose tokens)
-	var result []gin.H
-	for _, s := range sessions {
-		result = append(result, gin.H{
-			"created_at": s.CreatedAt,
-			"user_agent": s.UserAgent,
-			"ip":         s.IP,
-		})
+	c.JSON(http.StatusOK, gin.H{"sessions": auth.SessionInfos(sessions, claims.SessionID)})
+}
+
+// RevokeSession signs out one of the current user's sessions
+func (h *Handler) RevokeSession(c *gin.Context) {
+	claims, ok := middleware.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	sessionID := c.Param("id")
+	ctx := context.Background()
+	if err := auth.RevokeUserSession(ctx, claims.UserID, sessionID); err != nil {
+		if errors.Is(err, auth.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to revoke session")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"sessions": result})
+	if sessionID == claims.SessionID {
+		h.clearRefreshTokenCookie(c)
+	}
+
+	logger.Info().
+		Str("user_id", claims.UserID).
+		Str("session_id", sessionID).
+		Msg("Session revoked")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "session.revoke",
+		TargetType: "user",
+		TargetID:   claims.UserID,
+		Before:     gin.H{"session_id": sessionID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+// recordLoginFailure writes a failed password login to the audit log.
+// user is the zero value when no account matched the email.
+func (h *Handler) recordLoginFailure(c *gin.Context, user *models.User, email, reason string) {
+	event := audit.Event{
+		Action:     "auth.login_failed",
+		ActorEmail: email,
+		After:      gin.H{"reason": reason},
+	}
+	if user.ID != 0 {
+		event.ActorID = &user.ID
+		event.TargetType = "user"
+		event.TargetID = audit.IDTarget(user.ID)
+	}
+	audit.Record(c, h.db, event)
 }
 
 // Helper methods for refresh token handling
@@ -1,15 +1,15 @@
 package auth
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/webhook"
 	"github.com/chattycathy/api/pkg/auth"
 	"github.com/chattycathy/api/pkg/logger"
 	"github.com/gin-gonic/gin"
@@ -30,6 +30,7 @@ type GoogleUserInfo struct {
 // GoogleHandler handles Google OAuth authentication
 type GoogleHandler struct {
 	db                     *gorm.DB
+	sessions               *sessionIssuer
 	clientID               string
 	clientSecret           string
 	redirectURL            string
@@ -47,6 +48,7 @@ func NewGoogleHandler(
 ) *GoogleHandler {
 	return &GoogleHandler{
 		db:                     db,
+		sessions:               newSessionIssuer(db, issuer, accessExpiryMins, refreshExpiryDays),
 		clientID:               clientID,
 		clientSecret:           clientSecret,
 		redirectURL:            redirectURL,
@@ -106,74 +108,53 @@ func (h *GoogleHandler) GoogleCallback(c *gin.Context) {
 	}
 
 	// Find or create user
-	user, err := h.findOrCreateUser(googleUser)
+	user, err := h.findOrCreateUser(c, googleUser)
 	if err != nil {
 		logger.Error().Err(err).Msg("Failed to find or create user")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process user"})
 		return
 	}
 
-	// Get user permissions
-	permissions, err := models.GetUserPermissions(h.db, user.ID)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to get user permissions")
-		permissions = []string{} // Continue with empty permissions
-	}
+	audit.Record(c, h.db, audit.Event{
+		Action:     "auth.login",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"method": "google", "mfa_required": user.MFAEnabled},
+	})
 
-	// Generate token pair
-	userID := strconv.FormatUint(uint64(user.ID), 10)
-	tokenPair, err := auth.GenerateTokenPair(
-		userID, user.Email, user.Role,
-		permissions,
-		h.issuer,
-		h.accessTokenExpiryMins,
-		h.refreshTokenExpiryDays,
-	)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to generate token pair")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate tokens"})
+	amr := []string{auth.AMRFederated}
+
+	// Users enrolled in MFA get a challenge instead of tokens
+	if user.MFAEnabled {
+		h.sessions.startMFAChallenge(c, user, amr)
 		return
 	}
 
-	// Store refresh token in Redis
-	ctx := context.Background()
-	refreshData := &auth.RefreshTokenData{
-		UserID:      userID,
-		Username:    user.Email,
-		Role:        user.Role,
-		Permissions: permissions,
-		CreatedAt:   time.Now(),
-		UserAgent:   c.Request.UserAgent(),
-		IP:          c.ClientIP(),
-	}
-	expiry := time.Duration(h.refreshTokenExpiryDays) * 24 * time.Hour
-	if err := auth.StoreRefreshToken(ctx, tokenPair.RefreshToken, refreshData, expiry); err != nil {
-		logger.Error().Err(err).Msg("Failed to store refresh token")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+	session, err := h.sessions.issue(c, user, amr)
+	if err != nil {
+		respondSessionError(c, err)
 		return
 	}
 
 	// Set refresh token as httpOnly cookie
-	h.setRefreshTokenCookie(c, tokenPair.RefreshToken)
-
-	// Ensure permissions is never null (JSON serialization)
-	if permissions == nil {
-		permissions = []string{}
-	}
+	h.setRefreshTokenCookie(c, session.TokenPair.RefreshToken)
 
 	// Return tokens and user info
 	c.JSON(http.StatusOK, gin.H{
-		"access_token":            tokenPair.AccessToken,
-		"refresh_token":           tokenPair.RefreshToken,
-		"access_token_expires_in": tokenPair.AccessTokenExpiresIn,
-		"token_type":              tokenPair.TokenType,
+		"access_token":            session.TokenPair.AccessToken,
+		"refresh_token":           session.TokenPair.RefreshToken,
+		"access_token_expires_in": session.TokenPair.AccessTokenExpiresIn,
+		"token_type":              session.TokenPair.TokenType,
+		"mfa_enrollment_required": session.MFAEnrollmentRequired,
 		"user": gin.H{
 			"id":          user.ID,
 			"email":       user.Email,
 			"name":        user.Name,
 			"picture":     user.Picture,
 			"role":        user.Role,
-			"permissions": permissions,
+			"permissions": session.Permissions,
 		},
 	})
 }
@@ -234,7 +215,7 @@ func (h *GoogleHandler) exchangeCodeForUserInfo(code string) (*GoogleUserInfo, e
 }
 
 // findOrCreateUser finds an existing user or creates a new one
-func (h *GoogleHandler) findOrCreateUser(googleUser *GoogleUserInfo) (*models.User, error) {
+func (h *GoogleHandler) findOrCreateUser(c *gin.Context, googleUser *GoogleUserInfo) (*models.User, error) {
 	var user models.User
 
 	// Try to find by Google ID first
@@ -255,11 +236,18 @@ func (h *GoogleHandler) findOrCreateUser(googleUser *GoogleUserInfo) (*models.Us
 		return &user, nil
 	}
 
-	// Check if user exists with same email (legacy or different provider)
+	// Check if user exists with same email (legacy or local account)
 	result = h.db.Where("email = ?", googleUser.Email).First(&user)
 	if result.Error == nil {
+		// Only link when Google has verified the address, otherwise anyone could
+		// claim a local account by creating a Google account with its email
+		if !googleUser.VerifiedEmail {
+			return nil, fmt.Errorf("google email %s is not verified", googleUser.Email)
+		}
+
 		// Link Google account to existing user
-		user.GoogleID = googleUser.ID
+		user.GoogleID = &googleUser.ID
+		user.EmailVerified = true
 		user.Name = googleUser.Name
 		user.Picture = googleUser.Picture
 		user.LastLoginAt = time.Now()
@@ -270,17 +258,26 @@ func (h *GoogleHandler) findOrCreateUser(googleUser *GoogleUserInfo) (*models.Us
 			Str("email", user.Email).
 			Uint("user_id", user.ID).
 			Msg("Linked Google account to existing user")
+		audit.Record(c, h.db, audit.Event{
+			Action:     "auth.google_link",
+			ActorID:    &user.ID,
+			ActorEmail: user.Email,
+			TargetType: "user",
+			TargetID:   audit.IDTarget(user.ID),
+			After:      gin.H{"google_id": googleUser.ID},
+		})
 		return &user, nil
 	}
 
 	// Create new user
 	user = models.User{
-		GoogleID:    googleUser.ID,
-		Email:       googleUser.Email,
-		Name:        googleUser.Name,
-		Picture:     googleUser.Picture,
-		Role:        "user",
-		LastLoginAt: time.Now(),
+		GoogleID:      &googleUser.ID,
+		Email:         googleUser.Email,
+		Name:          googleUser.Name,
+		Picture:       googleUser.Picture,
+		EmailVerified: googleUser.VerifiedEmail,
+		Role:          "user",
+		LastLoginAt:   time.Now(),
 	}
 
 	if err := h.db.Create(&user).Error; err != nil {
@@ -296,6 +293,15 @@ func (h *GoogleHandler) findOrCreateUser(googleUser *GoogleUserInfo) (*models.Us
 		Str("email", user.Email).
 		Uint("user_id", user.ID).
 		Msg("New user created via Google OAuth")
+	audit.Record(c, h.db, audit.Event{
+		Action:     "account.register",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"method": "google"},
+	})
+	webhook.Notify(h.db, webhook.EventUserCreated, userCreatedEvent(&user, "google"))
 
 	return &user, nil
 }
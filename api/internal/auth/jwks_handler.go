@@ -0,0 +1,20 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterWellKnownRoutes registers discovery endpoints at the server root
+func RegisterWellKnownRoutes(router *gin.Engine) {
+	router.GET("/.well-known/jwks.json", JWKS)
+}
+
+// JWKS returns the public keys that currently verify access tokens, including
+// keys rotated out but still inside their overlap window
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, auth.GetJWKS())
+}
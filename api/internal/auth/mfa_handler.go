@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// MFAVerifyRequest completes a login with a second factor
+type MFAVerifyRequest struct {
+	MFAToken     string `json:"mfa_token" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFACodeRequest carries a TOTP or recovery code for account-level MFA changes
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// VerifyMFA exchanges an MFA challenge token and a valid code for a token pair
+func (h *Handler) VerifyMFA(c *gin.Context) {
+	var req MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	ctx := context.Background()
+	challenge, err := auth.GetMFAChallenge(ctx, req.MFAToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired MFA token"})
+		return
+	}
+
+	var user models.User
+	if err := h.db.Where("id = ?", challenge.UserID).First(&user).Error; err != nil || !user.MFAEnabled {
+		auth.DeleteMFAChallenge(ctx, req.MFAToken)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired MFA token"})
+		return
+	}
+	if mfaLockedOut(c, challenge.UserID) {
+		auth.DeleteMFAChallenge(ctx, req.MFAToken)
+		return
+	}
+
+	method, ok, err := h.verifySecondFactor(&user, req.Code, req.RecoveryCode)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to verify second factor")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+	if !ok {
+		audit.Record(c, h.db, audit.Event{
+			Action:     "auth.mfa_failed",
+			ActorID:    &user.ID,
+			ActorEmail: user.Email,
+			TargetType: "user",
+			TargetID:   audit.IDTarget(user.ID),
+		})
+		// Failures are counted per user as well as per challenge, since anyone
+		// with the password can start new challenges
+		locked := h.recordMFAFailure(c, &user)
+		attempts, err := auth.RecordMFAChallengeFailure(ctx, req.MFAToken)
+		if err != nil || locked || attempts >= auth.MFAChallengeMaxAttempts {
+			auth.DeleteMFAChallenge(ctx, req.MFAToken)
+			logger.Warn().Uint("user_id", user.ID).Msg("MFA challenge exhausted")
+		}
+		if !locked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		}
+		return
+	}
+
+	auth.DeleteMFAChallenge(ctx, req.MFAToken)
+
+	amr := append(append([]string{}, challenge.AMR...), method, auth.AMRMFA)
+	session, err := h.sessions.issue(c, &user, amr)
+	if err != nil {
+		respondSessionError(c, err)
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "auth.mfa_verified",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"method": method},
+	})
+
+	h.setRefreshTokenCookie(c, session.TokenPair.RefreshToken)
+
+	c.JSON(http.StatusOK, loginResponse{
+		TokenPair:             session.TokenPair,
+		MFAEnrollmentRequired: session.MFAEnrollmentRequired,
+	})
+}
+
+// mfaLockedOut responds with 429 and returns true if the user has entered too
+// many wrong MFA codes recently. A failed check lets the request through:
+// challenges live in Redis too, so they fail on their own.
+func mfaLockedOut(c *gin.Context, userID string) bool {
+	locked, retryAfter, err := auth.MFALockedOut(c.Request.Context(), userID)
+	if err != nil {
+		logger.Warn().Err(err).Str("user_id", userID).Msg("MFA lockout unavailable - allowing request")
+		return false
+	}
+	if locked {
+		respondMFALocked(c, retryAfter)
+	}
+	return locked
+}
+
+// recordMFAFailure counts a wrong code against the user's limit. If that locks
+// the user out, the lockout is audited, a 429 is written and true returned.
+func (h *Handler) recordMFAFailure(c *gin.Context, user *models.User) bool {
+	locked, err := auth.RecordMFAFailure(c.Request.Context(), strconv.FormatUint(uint64(user.ID), 10))
+	if err != nil {
+		logger.Error().Err(err).Uint("user_id", user.ID).Msg("Failed to record MFA failure")
+		return false
+	}
+	if !locked {
+		return false
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "auth.mfa_locked",
+		ActorID:    &user.ID,
+		ActorEmail: user.Email,
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"failures": auth.MFAFailureLimit, "window_seconds": int(auth.MFAFailureWindow.Seconds())},
+	})
+	logger.Warn().Uint("user_id", user.ID).Msg("MFA locked after too many wrong codes")
+	respondMFALocked(c, auth.MFAFailureWindow)
+	return true
+}
+
+func respondMFALocked(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many wrong codes, try again later"})
+}
+
+// EnrollMFA generates a TOTP secret for the current user to confirm
+func (h *Handler) EnrollMFA(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	if user.MFAEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "MFA already enabled"})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate TOTP secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+		return
+	}
+
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+	if err := auth.StorePendingTOTPSecret(context.Background(), userID, secret); err != nil {
+		logger.Error().Err(err).Msg("Failed to store pending TOTP secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start enrollment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(h.issuer, user.Email, secret),
+		"expires_in":  int(auth.MFAEnrollmentExpiry.Seconds()),
+	})
+}
+
+// ConfirmMFAEnrollment enables MFA once the user proves their authenticator works
+func (h *Handler) ConfirmMFAEnrollment(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	ctx := context.Background()
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+	secret, err := auth.GetPendingTOTPSecret(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no pending enrollment"})
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(secret, req.Code, 0, time.Now())
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate recovery codes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable MFA"})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"mfa_enabled":    true,
+			"totp_secret":    secret,
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return err
+		}
+		return models.ReplaceRecoveryCodes(tx, user.ID, hashes)
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to enable MFA")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable MFA"})
+		return
+	}
+
+	auth.DeletePendingTOTPSecret(ctx, userID)
+
+	logger.Info().Uint("user_id", user.ID).Msg("MFA enabled")
+	audit.Record(c, h.db, audit.Event{
+		Action:     "mfa.enable",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "MFA enabled, log in again to start an MFA session",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableMFA turns off MFA for the current user unless a role requires it
+func (h *Handler) DisableMFA(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA not enabled"})
+		return
+	}
+
+	required, err := models.UserRequiresMFA(h.db, user.ID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to check MFA policy")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable MFA"})
+		return
+	}
+	if required {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA is required for your role"})
+		return
+	}
+
+	if mfaLockedOut(c, strconv.FormatUint(uint64(user.ID), 10)) {
+		return
+	}
+	_, valid, err := h.verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil || !valid {
+		if err == nil && h.recordMFAFailure(c, user) {
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"mfa_enabled":    false,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.MFARecoveryCode{}).Error
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to disable MFA")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable MFA"})
+		return
+	}
+
+	logger.Info().Uint("user_id", user.ID).Msg("MFA disabled")
+	audit.Record(c, h.db, audit.Event{
+		Action:     "mfa.disable",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "MFA disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if !user.MFAEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MFA not enabled"})
+		return
+	}
+
+	if mfaLockedOut(c, strconv.FormatUint(uint64(user.ID), 10)) {
+		return
+	}
+	_, valid, err := h.verifySecondFactor(user, req.Code, "")
+	if err != nil || !valid {
+		if err == nil && h.recordMFAFailure(c, user) {
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate recovery codes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to regenerate recovery codes"})
+		return
+	}
+	if err := models.ReplaceRecoveryCodes(h.db, user.ID, hashes); err != nil {
+		logger.Error().Err(err).Msg("Failed to store recovery codes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to regenerate recovery codes"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "mfa.recovery_codes_regenerate",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// verifySecondFactor checks a TOTP code or, if none is given, a recovery code.
+// It returns the amr value for the method that succeeded.
+func (h *Handler) verifySecondFactor(user *models.User, code, recoveryCode string) (string, bool, error) {
+	if code != "" {
+		step, valid := auth.ValidateTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+		if !valid {
+			return "", false, nil
+		}
+
+		// Only the first request to claim this step wins, so a code cannot be
+		// used twice even by concurrent requests
+		result := h.db.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return "", false, result.Error
+		}
+		return auth.AMROTP, result.RowsAffected > 0, nil
+	}
+
+	if recoveryCode != "" {
+		used, err := models.UseRecoveryCode(h.db, user.ID, auth.HashRecoveryCode(recoveryCode))
+		if err != nil {
+			return "", false, err
+		}
+		if used {
+			logger.Info().Uint("user_id", user.ID).Msg("MFA recovery code used")
+		}
+		return auth.AMRRecoveryCode, used, nil
+	}
+
+	return "", false, nil
+}
+
+// currentUser loads the authenticated user, writing an error response if it fails
+func (h *Handler) currentUser(c *gin.Context) (*models.User, bool) {
+	claims, ok := middleware.GetClaims(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return nil, false
+	}
+
+	var user models.User
+	if err := h.db.Where("id = ?", claims.UserID).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch user"})
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// newRecoveryCodes generates recovery codes and their stored hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
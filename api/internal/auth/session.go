@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// sessionIssuer creates sessions for authenticated users. It is shared by the
+// password, Google and MFA login paths so every method yields the same tokens.
+type sessionIssuer struct {
+	db                     *gorm.DB
+	issuer                 string
+	accessTokenExpiryMins  int
+	refreshTokenExpiryDays int
+}
+
+func newSessionIssuer(db *gorm.DB, issuer string, accessExpiryMins, refreshExpiryDays int) *sessionIssuer {
+	return &sessionIssuer{
+		db:                     db,
+		issuer:                 issuer,
+		accessTokenExpiryMins:  accessExpiryMins,
+		refreshTokenExpiryDays: refreshExpiryDays,
+	}
+}
+
+// errAccountDisabled is returned when a disabled account tries to get a session
+var errAccountDisabled = errors.New("account disabled")
+
+// issuedSession is the result of a successful login
+type issuedSession struct {
+	TokenPair   *auth.TokenPair
+	Permissions []string
+	// MFAEnrollmentRequired is set when a role requires MFA but the user has
+	// not enrolled yet. Such sessions carry no permissions.
+	MFAEnrollmentRequired bool
+}
+
+// loginResponse is the body returned by login endpoints that issue tokens
+type loginResponse struct {
+	*auth.TokenPair
+	MFAEnrollmentRequired bool `json:"mfa_enrollment_required,omitempty"`
+}
+
+// issue generates a token pair for the user and stores the refresh token as
+// the start of a new session. amr lists the authentication methods the user
+// has completed.
+func (s *sessionIssuer) issue(c *gin.Context, user *models.User, amr []string) (*issuedSession, error) {
+	return s.create(c, user, &auth.RefreshTokenData{
+		SessionID: uuid.New().String(),
+		FamilyID:  uuid.New().String(),
+		AMR:       amr,
+		CreatedAt: time.Now(),
+	})
+}
+
+// reissue generates a token pair that replaces a rotated refresh token,
+// keeping its session, token family and authentication methods
+func (s *sessionIssuer) reissue(c *gin.Context, user *models.User, previous *auth.RefreshTokenData) (*issuedSession, error) {
+	session := &auth.RefreshTokenData{
+		SessionID: previous.SessionID,
+		FamilyID:  previous.FamilyID,
+		AMR:       previous.AMR,
+		CreatedAt: previous.CreatedAt,
+	}
+	// Tokens issued before sessions had IDs start a session now
+	if session.SessionID == "" {
+		session.SessionID = uuid.New().String()
+	}
+	if session.FamilyID == "" {
+		session.FamilyID = uuid.New().String()
+	}
+	return s.create(c, user, session)
+}
+
+// create issues tokens for a session. Only the session fields of data are
+// used; the rest is filled in from the user and request.
+func (s *sessionIssuer) create(c *gin.Context, user *models.User, data *auth.RefreshTokenData) (*issuedSession, error) {
+	if user.Disabled() {
+		return nil, errAccountDisabled
+	}
+
+	amr := data.AMR
+
+	// Get user permissions from RBAC tables
+	permissions, err := models.GetUserPermissions(s.db, user.ID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to get user permissions")
+		permissions = []string{} // Continue with empty permissions
+	}
+	if permissions == nil {
+		permissions = []string{}
+	}
+
+	// Enforce the per-role MFA policy: without a second factor the session
+	// can only be used to enroll
+	enrollmentRequired := false
+	if !containsString(amr, auth.AMRMFA) {
+		required, err := models.UserRequiresMFA(s.db, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check MFA policy: %w", err)
+		}
+		if required {
+			enrollmentRequired = true
+			permissions = []string{}
+		}
+	}
+
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+	tokenPair, err := auth.GenerateTokenPair(
+		userID, user.Email, user.Role, data.SessionID,
+		permissions,
+		amr,
+		s.issuer,
+		s.accessTokenExpiryMins,
+		s.refreshTokenExpiryDays,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token pair: %w", err)
+	}
+
+	// Store refresh token in Redis
+	ctx := context.Background()
+	refreshData := &auth.RefreshTokenData{
+		UserID:      userID,
+		SessionID:   data.SessionID,
+		FamilyID:    data.FamilyID,
+		Username:    user.Email,
+		Role:        user.Role,
+		Permissions: permissions,
+		AMR:         amr,
+		CreatedAt:   data.CreatedAt,
+		LastUsedAt:  time.Now(),
+		UserAgent:   c.Request.UserAgent(),
+		IP:          c.ClientIP(),
+	}
+	expiry := time.Duration(s.refreshTokenExpiryDays) * 24 * time.Hour
+	if err := auth.StoreRefreshToken(ctx, tokenPair.RefreshToken, refreshData, expiry); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return &issuedSession{
+		TokenPair:             tokenPair,
+		Permissions:           permissions,
+		MFAEnrollmentRequired: enrollmentRequired,
+	}, nil
+}
+
+// startMFAChallenge records a completed first factor and responds with an MFA
+// challenge token instead of a token pair
+func (s *sessionIssuer) startMFAChallenge(c *gin.Context, user *models.User, amr []string) {
+	if user.Disabled() {
+		respondSessionError(c, errAccountDisabled)
+		return
+	}
+	userID := strconv.FormatUint(uint64(user.ID), 10)
+	if mfaLockedOut(c, userID) {
+		return
+	}
+
+	token, err := auth.GenerateActionToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate MFA challenge token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return
+	}
+
+	challenge := &auth.MFAChallengeData{
+		UserID:    userID,
+		AMR:       amr,
+		CreatedAt: time.Now(),
+		UserAgent: c.Request.UserAgent(),
+		IP:        c.ClientIP(),
+	}
+	if err := auth.StoreMFAChallenge(context.Background(), token, challenge); err != nil {
+		logger.Error().Err(err).Msg("Failed to store MFA challenge")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(auth.MFAChallengeExpiry.Seconds()),
+	})
+}
+
+// respondSessionError writes the response for a failed issue or reissue
+func respondSessionError(c *gin.Context, err error) {
+	if errors.Is(err, errAccountDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "account disabled"})
+		return
+	}
+	logger.Error().Err(err).Msg("Failed to create session")
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
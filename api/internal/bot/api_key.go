@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"gorm.io/gorm"
+)
+
+// lastUsedInterval is how often a key's last use is written, so a busy bot
+// does not cause a write per request
+const lastUsedInterval = time.Minute
+
+// NewResolver returns the API key resolver for the auth middleware. Keys are
+// checked against the database on every request, so revoking a key, disabling
+// its bot or changing the bot's roles takes effect at once.
+func NewResolver(db *gorm.DB) middleware.APIKeyResolver {
+	return func(ctx context.Context, key, clientIP string) (*auth.Claims, error) {
+		prefix, ok := auth.ParseAPIKey(key)
+		if !ok {
+			return nil, auth.ErrInvalidAPIKey
+		}
+		db := db.WithContext(ctx)
+
+		var apiKey models.APIKey
+		if err := db.Where("prefix = ?", prefix).First(&apiKey).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, auth.ErrInvalidAPIKey
+			}
+			return nil, err
+		}
+		now := time.Now()
+		if subtle.ConstantTimeCompare([]byte(auth.HashAPIKey(key)), []byte(apiKey.Hash)) != 1 || apiKey.Expired(now) {
+			return nil, auth.ErrInvalidAPIKey
+		}
+
+		var user models.User
+		if err := db.First(&user, apiKey.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, auth.ErrInvalidAPIKey
+			}
+			return nil, err
+		}
+		if !user.Bot || user.Disabled() {
+			return nil, auth.ErrInvalidAPIKey
+		}
+
+		permissions, err := keyPermissions(db, &user, &apiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= lastUsedInterval {
+			err := db.Model(&apiKey).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP}).Error
+			if err != nil {
+				logger.Warn().Err(err).Uint("api_key_id", apiKey.ID).Msg("Failed to record API key use")
+			}
+		}
+
+		userID := strconv.FormatUint(uint64(user.ID), 10)
+		return auth.NewAPIKeyClaims(userID, user.Email, user.Role, permissions, apiKey.ExpiresAt), nil
+	}
+}
+
+// keyPermissions returns what a key may do: the bot's permissions, narrowed to
+// the key's own list if it has one. A key cannot satisfy a role's MFA
+// requirement, so bots holding such a role get no permissions, as people
+// without a second factor do.
+func keyPermissions(db *gorm.DB, user *models.User, apiKey *models.APIKey) ([]string, error) {
+	required, err := models.UserRequiresMFA(db, user.ID)
+	if err != nil || required {
+		return []string{}, err
+	}
+
+	granted, err := models.GetUserPermissions(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey.Permissions == nil {
+		return granted, nil
+	}
+
+	scoped := make(map[string]bool, len(apiKey.Permissions))
+	for _, p := range apiKey.Permissions {
+		scoped[p] = true
+	}
+	permissions := []string{}
+	for _, p := range granted {
+		if scoped[p] {
+			permissions = append(permissions, p)
+		}
+	}
+	return permissions, nil
+}
@@ -0,0 +1,425 @@
+package bot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxKeysPerBot caps how many API keys a bot can have at once
+	MaxKeysPerBot = 20
+	// defaultBotRole is the role new bots get; more are assigned through the
+	// admin user endpoints like anyone else's
+	defaultBotRole = "user"
+	// botEmailDomain is a reserved domain, so bot addresses can never receive
+	// mail or match a Google account
+	botEmailDomain = "bots.invalid"
+)
+
+// Handler manages bot accounts and their API keys
+type Handler struct {
+	db *gorm.DB
+}
+
+// NewHandler creates a new bot handler
+func NewHandler(db *gorm.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// RegisterRoutes registers bot routes (requires bots:manage and an MFA session)
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	bots := router.Group("/admin/bots")
+	bots.Use(middleware.JWTAuth())
+	bots.Use(middleware.RequireMFA())
+	bots.Use(middleware.RequirePermission("bots:manage"))
+	{
+		bots.GET("", h.ListBots)
+		bots.POST("", h.CreateBot)
+		bots.GET("/:id", h.GetBot)
+		bots.PATCH("/:id", h.UpdateBot)
+
+		// API keys
+		bots.GET("/:id/keys", h.ListKeys)
+		bots.POST("/:id/keys", h.CreateKey)
+		bots.DELETE("/:id/keys/:key_id", h.RevokeKey)
+	}
+}
+
+// BotResponse represents a bot account
+type BotResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	Disabled   bool       `json:"disabled"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// BotDetailResponse represents a bot with its API keys
+type BotDetailResponse struct {
+	BotResponse
+	Keys []models.APIKey `json:"keys"`
+}
+
+// APIKeyResponse represents an API key. The key itself is only included when
+// it is created.
+type APIKeyResponse struct {
+	models.APIKey
+	Key string `json:"key,omitempty"`
+}
+
+func newBotResponse(u *models.User) BotResponse {
+	return BotResponse{
+		ID:         u.ID,
+		Name:       u.Name,
+		Email:      u.Email,
+		Role:       u.Role,
+		Disabled:   u.Disabled(),
+		DisabledAt: u.DisabledAt,
+		CreatedAt:  u.CreatedAt,
+	}
+}
+
+// ListBots returns every bot account
+func (h *Handler) ListBots(c *gin.Context) {
+	var users []models.User
+	if err := h.db.Where("bot").Order("id").Find(&users).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list bots")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bots"})
+		return
+	}
+
+	bots := make([]BotResponse, len(users))
+	for i := range users {
+		bots[i] = newBotResponse(&users[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"bots": bots})
+}
+
+// CreateBotRequest represents a request to create a bot account
+type CreateBotRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+// CreateBot creates a bot account with the default user role. It has no
+// password and cannot sign in; it authenticates with API keys only.
+func (h *Handler) CreateBot(c *gin.Context) {
+	var req CreateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		logger.Error().Err(err).Msg("Failed to generate bot address")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create bot"})
+		return
+	}
+	user := models.User{
+		Email: "bot-" + hex.EncodeToString(suffix) + "@" + botEmailDomain,
+		Name:  name,
+		Role:  defaultBotRole,
+		Bot:   true,
+	}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return models.AssignRoleToUser(tx, user.ID, defaultBotRole)
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to create bot")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create bot"})
+		return
+	}
+
+	logger.Info().
+		Uint("user_id", user.ID).
+		Str("name", user.Name).
+		Msg("Bot created")
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "bot.create",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      gin.H{"name": user.Name, "role": user.Role},
+	})
+
+	c.JSON(http.StatusCreated, newBotResponse(&user))
+}
+
+// GetBot returns a bot with its API keys
+func (h *Handler) GetBot(c *gin.Context) {
+	user, ok := h.loadBot(c)
+	if !ok {
+		return
+	}
+	keys, ok := h.listKeys(c, user.ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, BotDetailResponse{BotResponse: newBotResponse(user), Keys: keys})
+}
+
+// UpdateBotRequest represents a request to rename a bot
+type UpdateBotRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+// UpdateBot renames a bot. Roles, disabling and deletion go through the admin
+// user endpoints.
+func (h *Handler) UpdateBot(c *gin.Context) {
+	user, ok := h.loadBot(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	before := gin.H{"name": user.Name}
+	if err := h.db.Model(user).Update("name", name).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to update bot")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update bot"})
+		return
+	}
+	user.Name = name
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "bot.update",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		Before:     before,
+		After:      gin.H{"name": user.Name},
+	})
+
+	c.JSON(http.StatusOK, newBotResponse(user))
+}
+
+// ListKeys returns a bot's API keys
+func (h *Handler) ListKeys(c *gin.Context) {
+	user, ok := h.loadBot(c)
+	if !ok {
+		return
+	}
+	keys, ok := h.listKeys(c, user.ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// CreateKeyRequest represents a request for a new API key
+type CreateKeyRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+	// Permissions limits the key to some of the bot's permissions; omit it to
+	// grant all of them
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   *time.Time `json:"expires_at"` // never expires when omitted
+}
+
+// CreateKey issues an API key for a bot. The response carries the key, which
+// is not shown again.
+func (h *Handler) CreateKey(c *gin.Context) {
+	user, ok := h.loadBot(c)
+	if !ok {
+		return
+	}
+
+	var req CreateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+	if req.Permissions != nil {
+		if len(req.Permissions) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "permissions must not be empty; omit it to grant all of the bot's permissions"})
+			return
+		}
+		unknown, err := h.unknownPermission(req.Permissions)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to fetch permissions")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+			return
+		}
+		if unknown != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission: " + unknown})
+			return
+		}
+	}
+	createdByID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var count int64
+	if err := h.db.Model(&models.APIKey{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to count API keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+	if count >= MaxKeysPerBot {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bot already has the maximum number of API keys"})
+		return
+	}
+
+	key, prefix, hash, err := auth.GenerateAPIKey()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+	apiKey := models.APIKey{
+		UserID:      user.ID,
+		Name:        name,
+		Prefix:      prefix,
+		Hash:        hash,
+		Permissions: req.Permissions,
+		ExpiresAt:   req.ExpiresAt,
+		CreatedByID: createdByID,
+	}
+	if err := h.db.Create(&apiKey).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to create API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "api_key.create",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		After:      apiKey,
+	})
+
+	c.JSON(http.StatusCreated, APIKeyResponse{APIKey: apiKey, Key: key})
+}
+
+// RevokeKey deletes an API key; requests using it fail immediately
+func (h *Handler) RevokeKey(c *gin.Context) {
+	user, ok := h.loadBot(c)
+	if !ok {
+		return
+	}
+	keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key ID"})
+		return
+	}
+
+	var apiKey models.APIKey
+	if err := h.db.Where("id = ? AND user_id = ?", keyID, user.ID).First(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to get API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		return
+	}
+	if err := h.db.Delete(&apiKey).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to delete API key")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "api_key.revoke",
+		TargetType: "user",
+		TargetID:   audit.IDTarget(user.ID),
+		Before:     apiKey,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// loadBot loads the bot named in the route, writing an error response if it
+// cannot. Users that are not bots are reported as not found.
+func (h *Handler) loadBot(c *gin.Context) (*models.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid bot ID"})
+		return nil, false
+	}
+
+	var user models.User
+	if err := h.db.Where("bot").First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "bot not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get bot")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bot"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// listKeys loads a bot's API keys, writing an error response if it cannot
+func (h *Handler) listKeys(c *gin.Context, userID uint) ([]models.APIKey, bool) {
+	keys := []models.APIKey{}
+	if err := h.db.Where("user_id = ?", userID).Order("id").Find(&keys).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list API keys")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch API keys"})
+		return nil, false
+	}
+	return keys, true
+}
+
+// unknownPermission returns the first name that is not an existing
+// permission, or "" if they all exist
+func (h *Handler) unknownPermission(names []string) (string, error) {
+	var known []string
+	if err := h.db.Model(&models.Permission{}).Where("name IN ?", names).Pluck("name", &known).Error; err != nil {
+		return "", err
+	}
+	exists := make(map[string]bool, len(known))
+	for _, name := range known {
+		exists[name] = true
+	}
+	for _, name := range names {
+		if !exists[name] {
+			return name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/chattycathy/api/pkg/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead allows for the multipart framing around an upload
+const multipartOverhead = 1 << 20
+
+// AttachmentResponse represents an attachment with download links
+type AttachmentResponse struct {
+	models.Attachment
+	AttachmentURLs
+}
+
+// UploadAttachment uploads a file to a conversation, to be sent with a message.
+// Expects a multipart form with the file in the "file" field.
+func (h *Handler) UploadAttachment(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.service.cfg.MaxAttachmentSize+multipartOverhead)
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(c, ErrTooLarge, "")
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid file"})
+		return
+	}
+	defer file.Close()
+
+	attachment, err := h.service.Upload(c.Request.Context(), userID, conversationID, header.Filename, file, header.Size)
+	if err != nil {
+		respondError(c, err, "failed to upload attachment")
+		return
+	}
+	h.respondAttachment(c, http.StatusCreated, attachment)
+}
+
+// GetAttachment returns an attachment's details and time-limited download links
+func (h *Handler) GetAttachment(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	attachmentID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	attachment, err := h.service.GetAttachment(userID, attachmentID)
+	if err != nil {
+		respondError(c, err, "failed to get attachment")
+		return
+	}
+	h.respondAttachment(c, http.StatusOK, attachment)
+}
+
+func (h *Handler) respondAttachment(c *gin.Context, status int, attachment *models.Attachment) {
+	urls, err := h.service.SignAttachment(attachment)
+	if err != nil {
+		respondError(c, err, "failed to sign attachment links")
+		return
+	}
+	c.JSON(status, AttachmentResponse{Attachment: *attachment, AttachmentURLs: *urls})
+}
+
+// serveFile serves files from local storage to holders of a signed link.
+// Only images are shown inline; everything else is sent as a download so
+// uploaded HTML cannot run in the API's origin.
+func (h *Handler) serveFile(local *storage.LocalStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		if !local.Verify(key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid or expired link"})
+			return
+		}
+
+		var attachment models.Attachment
+		if err := h.db.Where("storage_key = ?", strings.TrimSuffix(key, ".thumb.jpg")).First(&attachment).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+			return
+		}
+		contentType, disposition := attachment.ContentType, "attachment"
+		if key == attachment.ThumbnailKey() {
+			contentType = "image/jpeg"
+		}
+		if thumbnailTypes[contentType] {
+			disposition = "inline"
+		}
+
+		file, err := local.Open(c.Request.Context(), key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+				return
+			}
+			logger.Error().Err(err).Str("key", key).Msg("Failed to open file")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open file"})
+			return
+		}
+		defer file.Close()
+
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Cache-Control", "private, max-age=300")
+		if seeker, ok := file.(io.ReadSeeker); ok {
+			http.ServeContent(c.Writer, c.Request, "", attachment.CreatedAt, seeker)
+			return
+		}
+		c.Status(http.StatusOK)
+		io.Copy(c.Writer, file)
+	}
+}
@@ -0,0 +1,275 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxAttachmentsPerMessage caps how many files one message can carry
+	MaxAttachmentsPerMessage = 10
+	// Attachments uploaded but not sent within this time are deleted
+	pendingAttachmentTTL = 24 * time.Hour
+	// How often pending attachments are purged
+	attachmentPurgeInterval = time.Hour
+)
+
+var (
+	// ErrAttachmentNotFound is returned when an attachment does not exist or the user cannot see it
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrTooLarge is returned for uploads over the size limit
+	ErrTooLarge = errors.New("file too large")
+)
+
+// AttachmentURLs are time-limited links to an attachment's content
+type AttachmentURLs struct {
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Upload stores a file for the user to send to a conversation. The content
+// type is detected from the content rather than trusted from the client, and
+// images get a thumbnail. The attachment stays pending until a message is
+// posted with it.
+func (s *Service) Upload(ctx context.Context, userID, conversationID uint, filename string, r io.ReadSeeker, size int64) (*models.Attachment, error) {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, err
+	}
+	if size > s.cfg.MaxAttachmentSize {
+		return nil, fmt.Errorf("%w: the limit is %d MB", ErrTooLarge, s.cfg.MaxAttachmentSize>>20)
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("%w: file is empty", ErrInvalid)
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !s.typeAllowed(contentType) {
+		return nil, fmt.Errorf("%w: files of type %s are not accepted", ErrInvalid, contentType)
+	}
+
+	attachment := &models.Attachment{
+		ConversationID: conversationID,
+		UploaderID:     userID,
+		Filename:       cleanFilename(filename),
+		ContentType:    contentType,
+		Size:           size,
+		StorageKey:     fmt.Sprintf("attachments/%d/%s", conversationID, uuid.NewString()),
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := s.cfg.Storage.Put(ctx, attachment.StorageKey, r, size, contentType); err != nil {
+		return nil, fmt.Errorf("failed to store attachment: %w", err)
+	}
+
+	if thumbnailTypes[contentType] {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		s.storeThumbnail(ctx, attachment, r)
+	}
+
+	if err := s.db.Create(attachment).Error; err != nil {
+		s.deleteBlobs([]models.Attachment{*attachment})
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// storeThumbnail makes and stores a thumbnail for an image, recording its
+// dimensions. Images that cannot be decoded are kept without one.
+func (s *Service) storeThumbnail(ctx context.Context, attachment *models.Attachment, r io.Reader) {
+	thumb, width, height, err := makeThumbnail(r)
+	attachment.Width, attachment.Height = width, height
+	if err != nil {
+		logger.Warn().Err(err).Str("key", attachment.StorageKey).Msg("Failed to make thumbnail")
+		return
+	}
+
+	err = s.cfg.Storage.Put(ctx, attachment.ThumbnailKey(), bytes.NewReader(thumb), int64(len(thumb)), "image/jpeg")
+	if err != nil {
+		logger.Error().Err(err).Str("key", attachment.StorageKey).Msg("Failed to store thumbnail")
+		return
+	}
+	attachment.HasThumbnail = true
+}
+
+// GetAttachment returns an attachment in one of the user's conversations.
+// Pending attachments are only visible to their uploader.
+func (s *Service) GetAttachment(userID, attachmentID uint) (*models.Attachment, error) {
+	var attachment models.Attachment
+	if err := s.db.First(&attachment, attachmentID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	if attachment.MessageID == nil && attachment.UploaderID != userID {
+		return nil, ErrAttachmentNotFound
+	}
+	if _, _, err := s.membership(userID, attachment.ConversationID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// SignAttachment returns download links for an attachment
+func (s *Service) SignAttachment(attachment *models.Attachment) (*AttachmentURLs, error) {
+	urls := &AttachmentURLs{ExpiresAt: time.Now().Add(s.cfg.AttachmentURLTTL).UTC()}
+
+	var err error
+	if urls.URL, err = s.cfg.Storage.SignedURL(attachment.StorageKey, s.cfg.AttachmentURLTTL); err != nil {
+		return nil, err
+	}
+	if attachment.HasThumbnail {
+		if urls.ThumbnailURL, err = s.cfg.Storage.SignedURL(attachment.ThumbnailKey(), s.cfg.AttachmentURLTTL); err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+// PurgeAttachmentsLoop deletes attachments that were never sent, every hour
+// until the context is cancelled
+func (s *Service) PurgeAttachmentsLoop(ctx context.Context) {
+	ticker := time.NewTicker(attachmentPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var stale []models.Attachment
+			err := s.db.Where("message_id IS NULL AND created_at < ?", time.Now().Add(-pendingAttachmentTTL)).
+				Limit(1000).Find(&stale).Error
+			if err == nil && len(stale) > 0 {
+				err = s.db.Delete(&stale).Error
+			}
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to purge pending attachments")
+				continue
+			}
+			if len(stale) > 0 {
+				s.deleteBlobs(stale)
+				logger.Info().Int("count", len(stale)).Msg("Purged pending attachments")
+			}
+		}
+	}
+}
+
+// linkAttachments attaches the user's pending uploads to a new message
+func linkAttachments(tx *gorm.DB, userID, conversationID uint, msg *models.Message, attachmentIDs []uint) error {
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	result := tx.Model(&models.Attachment{}).
+		Where("id IN ? AND uploader_id = ? AND conversation_id = ? AND message_id IS NULL", attachmentIDs, userID, conversationID).
+		Update("message_id", msg.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if int(result.RowsAffected) != len(attachmentIDs) {
+		return fmt.Errorf("%w: unknown or already sent attachment", ErrInvalid)
+	}
+	return tx.Where("message_id = ?", msg.ID).Order("id").Find(&msg.Attachments).Error
+}
+
+// messageAttachments returns the attachments of each message, keyed by message ID
+func (s *Service) messageAttachments(messageIDs []uint) (map[uint][]models.Attachment, error) {
+	result := make(map[uint][]models.Attachment, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	var attachments []models.Attachment
+	if err := s.db.Where("message_id IN ?", messageIDs).Order("id").Find(&attachments).Error; err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		result[*a.MessageID] = append(result[*a.MessageID], a)
+	}
+	return result, nil
+}
+
+// deleteBlobs removes the stored content of deleted attachments. Failures
+// are logged; the files are unreachable either way.
+func (s *Service) deleteBlobs(attachments []models.Attachment) {
+	ctx := context.Background()
+	for _, a := range attachments {
+		keys := []string{a.StorageKey}
+		if a.HasThumbnail {
+			keys = append(keys, a.ThumbnailKey())
+		}
+		for _, key := range keys {
+			if err := s.cfg.Storage.Delete(ctx, key); err != nil {
+				logger.Error().Err(err).Str("key", key).Msg("Failed to delete attachment content")
+			}
+		}
+	}
+}
+
+// typeAllowed reports whether a content type is accepted for upload
+func (s *Service) typeAllowed(contentType string) bool {
+	for _, allowed := range s.cfg.AttachmentTypes {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == contentType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(allowed, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanFilename keeps the base name of an uploaded file without control
+// characters, falling back to "file"
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	// Keep the end, which has the extension, cutting on a rune boundary so
+	// the name stays valid UTF-8
+	if len(name) > 255 {
+		i := len(name) - 255
+		for i < len(name) && !utf8.RuneStart(name[i]) {
+			i++
+		}
+		name = name[i:]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
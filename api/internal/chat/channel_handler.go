@@ -0,0 +1,241 @@
+package chat
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// ChannelListResponse represents a page of the channel directory, newest first
+type ChannelListResponse struct {
+	Channels   []ChannelInfo `json:"channels"`
+	NextCursor *uint         `json:"next_cursor,omitempty"`
+}
+
+// ListChannels returns the public groups anyone can join.
+// Query parameters: q (matched against name and description), before and limit.
+func (h *Handler) ListChannels(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	before, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	page, err := h.service.ListChannels(userID, c.Query("q"), before, limit)
+	if err != nil {
+		respondError(c, err, "failed to list channels")
+		return
+	}
+
+	channels := page.Channels
+	if channels == nil {
+		channels = []ChannelInfo{}
+	}
+	c.JSON(http.StatusOK, ChannelListResponse{Channels: channels, NextCursor: page.NextCursor})
+}
+
+// JoinConversation joins a public group, returning it, or asks to join a
+// private one, answering 202 until the request is approved
+func (h *Handler) JoinConversation(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	joined, err := h.service.JoinConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to join conversation")
+		return
+	}
+	if !joined {
+		c.JSON(http.StatusAccepted, gin.H{"message": "join request sent"})
+		return
+	}
+
+	h.respondConversation(c, userID, conversationID)
+}
+
+// ListJoinRequests returns a group's pending join requests
+func (h *Handler) ListJoinRequests(c *gin.Context) {
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	requests, err := h.service.ListJoinRequests(conversationID)
+	if err != nil {
+		respondError(c, err, "failed to list join requests")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"join_requests": requests})
+}
+
+// ApproveJoinRequest adds the requester to the group
+func (h *Handler) ApproveJoinRequest(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	requesterID, ok := uintParam(c, "user_id")
+	if !ok {
+		return
+	}
+
+	if err := h.service.ApproveJoinRequest(userID, conversationID, requesterID); err != nil {
+		respondError(c, err, "failed to approve join request")
+		return
+	}
+
+	summary, err := h.service.ManagedConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
+
+// RejectJoinRequest discards a join request
+func (h *Handler) RejectJoinRequest(c *gin.Context) {
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	requesterID, ok := uintParam(c, "user_id")
+	if !ok {
+		return
+	}
+
+	if err := h.service.RejectJoinRequest(conversationID, requesterID); err != nil {
+		respondError(c, err, "failed to reject join request")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "join request rejected"})
+}
+
+// CreateInviteRequest represents a new invite link. max_uses of 0 means
+// unlimited; expires_in is in seconds and defaults to 7 days.
+type CreateInviteRequest struct {
+	MaxUses   int `json:"max_uses"`
+	ExpiresIn int `json:"expires_in"`
+}
+
+// CreateInvite makes an invite link to a group
+func (h *Handler) CreateInvite(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	invite, err := h.service.CreateInvite(userID, conversationID, req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		respondError(c, err, "failed to create invite")
+		return
+	}
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// ListInvites returns a group's unexpired invite links
+func (h *Handler) ListInvites(c *gin.Context) {
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	invites, err := h.service.ListInvites(conversationID)
+	if err != nil {
+		respondError(c, err, "failed to list invites")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invites": invites})
+}
+
+// RevokeInvite deletes an invite link
+func (h *Handler) RevokeInvite(c *gin.Context) {
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if err := h.service.RevokeInvite(conversationID, c.Param("code")); err != nil {
+		respondError(c, err, "failed to revoke invite")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "invite revoked"})
+}
+
+// GetInvite shows the group an invite link leads to
+func (h *Handler) GetInvite(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	preview, err := h.service.GetInvite(userID, c.Param("code"))
+	if err != nil {
+		respondError(c, err, "failed to fetch invite")
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+// JoinByInvite joins the group an invite link leads to
+func (h *Handler) JoinByInvite(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	conversationID, err := h.service.JoinByInvite(userID, c.Param("code"))
+	if err != nil {
+		respondError(c, err, "failed to join conversation")
+		return
+	}
+
+	h.respondConversation(c, userID, conversationID)
+}
+
+// respondConversation writes a conversation the user is a member of
+func (h *Handler) respondConversation(c *gin.Context, userID, conversationID uint) {
+	summary, err := h.service.GetConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
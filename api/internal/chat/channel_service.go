@@ -0,0 +1,550 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/webhook"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxDescriptionLength is the longest group description accepted, in bytes
+	MaxDescriptionLength = 500
+	// DefaultInviteTTL is how long invite links last when no expiry is given
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	// MaxInviteTTL is the longest an invite link can last
+	MaxInviteTTL = 30 * 24 * time.Hour
+	// MaxInviteUses caps the uses of a limited invite link
+	MaxInviteUses = 1000
+
+	defaultChannelLimit = 20
+	maxChannelLimit     = 50
+
+	inviteCodeBytes = 16
+)
+
+// ErrInviteNotFound is returned when an invite link does not exist, has
+// expired or has been used up
+var ErrInviteNotFound = errors.New("invite not found or expired")
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// GroupInput describes a new group
+type GroupInput struct {
+	Name        string
+	Description string
+	Visibility  string // private when empty
+	MemberIDs   []uint
+}
+
+// GroupUpdate changes a group's settings; nil fields are left as they are
+type GroupUpdate struct {
+	Name        *string
+	Description *string
+	Visibility  *string
+}
+
+// ChannelInfo is a group as listed in the channel directory
+type ChannelInfo struct {
+	models.Conversation
+	MemberCount int64 `json:"member_count"`
+	Joined      bool  `json:"joined"` // whether the user listing it is a member
+}
+
+// ChannelPage is a page of the channel directory, newest first
+type ChannelPage struct {
+	Channels   []ChannelInfo
+	NextCursor *uint // pass as before to get older channels; nil on the last page
+}
+
+// JoinRequestInfo is a pending join request with the public parts of the
+// requester's profile
+type JoinRequestInfo struct {
+	UserID    uint      `json:"user_id"`
+	Name      string    `json:"name"`
+	Picture   string    `json:"picture"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// InvitePreview is what holders of an invite link see before joining
+type InvitePreview struct {
+	Code         string      `json:"code"`
+	ExpiresAt    time.Time   `json:"expires_at"`
+	Conversation ChannelInfo `json:"conversation"`
+}
+
+// ListChannels returns the public groups whose name or description contains
+// the query, or all of them when it is empty, newest first
+func (s *Service) ListChannels(userID uint, q string, before uint, limit int) (*ChannelPage, error) {
+	if limit < 1 || limit > maxChannelLimit {
+		limit = defaultChannelLimit
+	}
+
+	query := s.channels(userID).Where("conversations.visibility = ?", models.VisibilityPublic)
+	if q = strings.TrimSpace(q); q != "" {
+		if len(q) > MaxSearchLength {
+			return nil, fmt.Errorf("%w: search text is too long (max %d bytes)", ErrInvalid, MaxSearchLength)
+		}
+		pattern := "%" + likeEscaper.Replace(q) + "%"
+		query = query.Where("(conversations.name ILIKE ? OR conversations.description ILIKE ?)", pattern, pattern)
+	}
+	if before > 0 {
+		query = query.Where("conversations.id < ?", before)
+	}
+
+	// Fetch one extra row to know whether there is another page
+	var channels []ChannelInfo
+	if err := query.Order("conversations.id DESC").Limit(limit + 1).Scan(&channels).Error; err != nil {
+		return nil, err
+	}
+
+	page := &ChannelPage{Channels: channels}
+	if len(channels) > limit {
+		page.Channels = channels[:limit]
+		cursor := page.Channels[limit-1].ID
+		page.NextCursor = &cursor
+	}
+	return page, nil
+}
+
+// channels selects groups with their member counts and whether the user is
+// one of the members
+func (s *Service) channels(userID uint) *gorm.DB {
+	return s.db.Table("conversations").
+		Select(`conversations.*,
+			(SELECT COUNT(*) FROM conversation_members cm WHERE cm.conversation_id = conversations.id) AS member_count,
+			EXISTS (SELECT 1 FROM conversation_members cm WHERE cm.conversation_id = conversations.id AND cm.user_id = ?) AS joined`,
+			userID).
+		Where("conversations.type = ?", models.ConversationTypeGroup)
+}
+
+// JoinConversation adds the user to a public group, or asks to join a private
+// one. joined reports whether the user is now a member; otherwise their
+// request waits for someone with the channel:invite permission to approve it.
+func (s *Service) JoinConversation(userID, conversationID uint) (joined bool, err error) {
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return false, err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return false, ErrNotFound
+	}
+	if _, _, err := s.membership(userID, conversationID); err == nil {
+		return true, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	if conv.Visibility != models.VisibilityPublic {
+		return false, s.requestToJoin(userID, conversationID)
+	}
+
+	var added []uint
+	var msg *models.Message
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		added, msg, err = addMembers(tx, conversationID, userID, models.SystemEventMemberJoined, []uint{userID})
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	s.membersAdded(conversationID, added, msg)
+	return true, nil
+}
+
+// requestToJoin records a request to join a private group and tells the
+// group's owner and admins about it
+func (s *Service) requestToJoin(userID, conversationID uint) error {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.JoinRequest{ConversationID: conversationID, UserID: userID})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil
+	}
+
+	var managerIDs []uint
+	if err := s.db.Model(&models.ConversationMember{}).
+		Where("conversation_id = ? AND role IN ?", conversationID, []string{models.MemberRoleOwner, models.MemberRoleAdmin}).
+		Pluck("user_id", &managerIDs).Error; err != nil {
+		return err
+	}
+	if len(managerIDs) > 0 {
+		s.publisher.PublishToUsers(managerIDs, Event{
+			Type: EventJoinRequested,
+			Data: JoinRequestEvent{ConversationID: conversationID, UserID: userID},
+		})
+	}
+	return nil
+}
+
+// ListJoinRequests returns a group's pending join requests, oldest first.
+// Callers check the channel:invite permission.
+func (s *Service) ListJoinRequests(conversationID uint) ([]JoinRequestInfo, error) {
+	if _, err := s.conversation(conversationID); err != nil {
+		return nil, err
+	}
+
+	requests := []JoinRequestInfo{}
+	err := s.db.Raw(`
+		SELECT jr.user_id, u.name, u.picture, jr.created_at
+		FROM join_requests jr
+		JOIN users u ON u.id = jr.user_id
+		WHERE jr.conversation_id = ?
+		ORDER BY jr.created_at, jr.user_id
+	`, conversationID).Scan(&requests).Error
+	return requests, err
+}
+
+// ApproveJoinRequest adds the requester to the group. Callers check the
+// channel:invite permission.
+func (s *Service) ApproveJoinRequest(userID, conversationID, requesterID uint) error {
+	if err := s.checkUsersActive([]uint{requesterID}); err != nil {
+		return err
+	}
+
+	var added []uint
+	var msg *models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := deleteJoinRequest(tx, conversationID, requesterID); err != nil {
+			return err
+		}
+		var err error
+		added, msg, err = addMembers(tx, conversationID, userID, models.SystemEventMemberAdded, []uint{requesterID})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.membersAdded(conversationID, added, msg)
+	return nil
+}
+
+// RejectJoinRequest discards a join request. Callers check the
+// channel:invite permission.
+func (s *Service) RejectJoinRequest(conversationID, requesterID uint) error {
+	return deleteJoinRequest(s.db, conversationID, requesterID)
+}
+
+// CreateInvite makes an invite link to a group. Zero maxUses means unlimited
+// and zero ttl means DefaultInviteTTL. Callers check the channel:invite
+// permission.
+func (s *Service) CreateInvite(userID, conversationID uint, maxUses int, ttl time.Duration) (*models.ChannelInvite, error) {
+	if maxUses < 0 || maxUses > MaxInviteUses {
+		return nil, fmt.Errorf("%w: max uses must be between 0 and %d", ErrInvalid, MaxInviteUses)
+	}
+	if ttl == 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl < 0 || ttl > MaxInviteTTL {
+		return nil, fmt.Errorf("%w: invites can last at most %d days", ErrInvalid, int(MaxInviteTTL.Hours()/24))
+	}
+
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return nil, fmt.Errorf("%w: invites can only be made for groups", ErrInvalid)
+	}
+
+	code := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(code); err != nil {
+		return nil, err
+	}
+	invite := &models.ChannelInvite{
+		ConversationID: conversationID,
+		Code:           base64.RawURLEncoding.EncodeToString(code),
+		CreatedByID:    userID,
+		MaxUses:        maxUses,
+		ExpiresAt:      time.Now().UTC().Add(ttl),
+	}
+	if err := s.db.Create(invite).Error; err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// ListInvites returns a group's unexpired invite links, newest first.
+// Callers check the channel:invite permission.
+func (s *Service) ListInvites(conversationID uint) ([]models.ChannelInvite, error) {
+	if _, err := s.conversation(conversationID); err != nil {
+		return nil, err
+	}
+
+	invites := []models.ChannelInvite{}
+	err := s.db.Where("conversation_id = ? AND expires_at > ?", conversationID, time.Now().UTC()).
+		Order("id DESC").Find(&invites).Error
+	return invites, err
+}
+
+// RevokeInvite deletes an invite link. Callers check the channel:invite
+// permission.
+func (s *Service) RevokeInvite(conversationID uint, code string) error {
+	result := s.db.Where("conversation_id = ? AND code = ?", conversationID, code).Delete(&models.ChannelInvite{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// GetInvite returns the group an invite link leads to, for anyone holding it
+func (s *Service) GetInvite(userID uint, code string) (*InvitePreview, error) {
+	var invite models.ChannelInvite
+	if err := s.db.Where("code = ?", code).First(&invite).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInviteNotFound
+		}
+		return nil, err
+	}
+	if !invite.Usable(time.Now()) {
+		return nil, ErrInviteNotFound
+	}
+
+	var channel ChannelInfo
+	result := s.channels(userID).Where("conversations.id = ?", invite.ConversationID).Scan(&channel)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInviteNotFound
+	}
+	return &InvitePreview{Code: invite.Code, ExpiresAt: invite.ExpiresAt, Conversation: channel}, nil
+}
+
+// JoinByInvite adds the user to the group an invite link leads to, using up
+// one of its uses, and returns the group's ID. Invited users skip join
+// request approval. Members following a link do not use it up.
+func (s *Service) JoinByInvite(userID uint, code string) (uint, error) {
+	var invite models.ChannelInvite
+	var added []uint
+	var msg *models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code = ?", code).First(&invite).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !invite.Usable(time.Now()) {
+			return ErrInviteNotFound
+		}
+
+		added, msg, err = addMembers(tx, invite.ConversationID, userID, models.SystemEventMemberJoined, []uint{userID})
+		if err != nil || len(added) == 0 {
+			return err
+		}
+		return tx.Model(&invite).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.membersAdded(invite.ConversationID, added, msg)
+	return invite.ConversationID, nil
+}
+
+// UpdateGroup changes a group's name, description or visibility. Callers
+// check the channel:rename permission, and channel:manage_roles for
+// visibility.
+func (s *Service) UpdateGroup(conversationID uint, update GroupUpdate) (*models.Conversation, error) {
+	if update.Name != nil {
+		name, err := validateGroupName(*update.Name)
+		if err != nil {
+			return nil, err
+		}
+		update.Name = &name
+	}
+	if update.Description != nil {
+		description, err := validateDescription(*update.Description)
+		if err != nil {
+			return nil, err
+		}
+		update.Description = &description
+	}
+	if update.Visibility != nil {
+		if err := validateVisibility(*update.Visibility); err != nil {
+			return nil, err
+		}
+	}
+
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return nil, fmt.Errorf("%w: only groups can be changed", ErrInvalid)
+	}
+
+	changes := map[string]interface{}{}
+	if update.Name != nil && *update.Name != conv.Name {
+		changes["name"] = *update.Name
+	}
+	if update.Description != nil && *update.Description != conv.Description {
+		changes["description"] = *update.Description
+	}
+	if update.Visibility != nil && *update.Visibility != conv.Visibility {
+		changes["visibility"] = *update.Visibility
+	}
+	if len(changes) == 0 {
+		return conv, nil
+	}
+
+	if err := s.db.Model(conv).Updates(changes).Error; err != nil {
+		return nil, err
+	}
+
+	s.publisher.PublishToConversation(conversationID, Event{Type: EventConversationUpdated, Data: conv})
+	return conv, nil
+}
+
+// addMembers adds users to a group and records it in the timeline as event,
+// sent by actorID. The group is locked so concurrent joins cannot pass
+// MaxGroupMembers, and the first member of an empty group becomes its owner.
+// It returns the users who were not already members and the system message,
+// which is nil when there were none.
+func addMembers(tx *gorm.DB, conversationID, actorID uint, event string, userIDs []uint) ([]uint, *models.Message, error) {
+	var conv models.Conversation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&conv, conversationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return nil, nil, fmt.Errorf("%w: members can only be added to groups", ErrInvalid)
+	}
+
+	var existing []uint
+	if err := tx.Model(&models.ConversationMember{}).Where("conversation_id = ?", conversationID).
+		Pluck("user_id", &existing).Error; err != nil {
+		return nil, nil, err
+	}
+	isMember := make(map[uint]bool, len(existing))
+	for _, id := range existing {
+		isMember[id] = true
+	}
+	var added []uint
+	for _, id := range uniqueIDs(userIDs, 0) {
+		if !isMember[id] {
+			added = append(added, id)
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil, nil
+	}
+	if len(existing)+len(added) > MaxGroupMembers {
+		return nil, nil, fmt.Errorf("%w: groups are limited to %d members", ErrInvalid, MaxGroupMembers)
+	}
+
+	members := make([]models.ConversationMember, len(added))
+	for i, id := range added {
+		members[i] = models.ConversationMember{ConversationID: conversationID, UserID: id, Role: models.MemberRoleMember}
+	}
+	if len(existing) == 0 {
+		members[0].Role = models.MemberRoleOwner
+	}
+	if err := tx.Create(&members).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, m := range members {
+		if err := bindMemberRole(tx, conversationID, m.Role, m.UserID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Where("conversation_id = ? AND user_id IN ?", conversationID, added).
+		Delete(&models.JoinRequest{}).Error; err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := postSystemMessage(tx, conversationID, actorID, event, added...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return added, msg, nil
+}
+
+// membersAdded tells users they were added to a conversation, and its
+// members about the system message recording it
+func (s *Service) membersAdded(conversationID uint, added []uint, msg *models.Message) {
+	if len(added) == 0 {
+		return
+	}
+	s.publisher.PublishToUsers(added, membershipEvent(EventConversationJoined, conversationID))
+	s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageCreated, Data: msg})
+}
+
+// postSystemMessage records a membership change in a conversation's timeline
+func postSystemMessage(tx *gorm.DB, conversationID, actorID uint, event string, userIDs ...uint) (*models.Message, error) {
+	msg := &models.Message{
+		ConversationID: conversationID,
+		SenderID:       actorID,
+		Kind:           models.MessageKindSystem,
+		System:         &models.SystemMessage{Event: event, UserIDs: userIDs},
+	}
+	if err := tx.Create(msg).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&models.Conversation{}).Where("id = ?", conversationID).
+		Update("last_message_at", msg.CreatedAt).Error; err != nil {
+		return nil, err
+	}
+	if err := webhook.Enqueue(tx, webhook.EventMessageCreated, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// deleteJoinRequest removes a pending join request
+func deleteJoinRequest(tx *gorm.DB, conversationID, userID uint) error {
+	result := tx.Where("conversation_id = ? AND user_id = ?", conversationID, userID).Delete(&models.JoinRequest{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: no pending join request from this user", ErrInvalid)
+	}
+	return nil
+}
+
+// validateGroupName trims a group name and checks its length
+func validateGroupName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: group name is required", ErrInvalid)
+	}
+	if len(name) > MaxNameLength {
+		return "", fmt.Errorf("%w: group name is longer than %d bytes", ErrInvalid, MaxNameLength)
+	}
+	return name, nil
+}
+
+// validateDescription trims a group description and checks its length
+func validateDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if len(description) > MaxDescriptionLength {
+		return "", fmt.Errorf("%w: description is longer than %d bytes", ErrInvalid, MaxDescriptionLength)
+	}
+	return description, nil
+}
+
+func validateVisibility(visibility string) error {
+	if visibility != models.VisibilityPrivate && visibility != models.VisibilityPublic {
+		return fmt.Errorf("%w: visibility must be private or public", ErrInvalid)
+	}
+	return nil
+}
@@ -0,0 +1,943 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/chattycathy/api/pkg/storage"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Handler handles chat endpoints
+type Handler struct {
+	db       *gorm.DB // for the audit log and channel roles
+	service  *Service
+	commands CommandRunner // nil disables slash commands
+	channel  middleware.Scope
+}
+
+// NewHandler creates a new chat handler
+func NewHandler(db *gorm.DB, service *Service, commands CommandRunner) *Handler {
+	h := &Handler{db: db, service: service, commands: commands}
+	h.channel = middleware.Scope{
+		Resource: models.ResourceTypeConversation,
+		Param:    "id",
+		Lookup: func(ctx context.Context, userID, conversationID uint) ([]string, bool, error) {
+			return models.GetScopedPermissions(db.WithContext(ctx), userID, models.ResourceTypeConversation, conversationID)
+		},
+	}
+	return h
+}
+
+// RegisterRoutes registers chat routes (requires chat:* permissions, and
+// channel:* permissions on the conversation for managing it)
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	chat := router.Group("/conversations")
+	chat.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		chat.GET("", middleware.RequirePermission("chat:read"), h.ListConversations)
+		chat.POST("", middleware.RequirePermission("chat:create"), h.CreateConversation)
+		chat.GET("/:id", middleware.RequirePermission("chat:read"), h.GetConversation)
+		chat.PATCH("/:id", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:rename"), h.UpdateConversation)
+		chat.POST("/:id/join", middleware.RequirePermission("chat:read"), h.JoinConversation)
+
+		// Members
+		chat.POST("/:id/members", middleware.RequirePermission("chat:create"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.AddMembers)
+		chat.DELETE("/:id/members/:user_id", middleware.RequirePermission("chat:read"), h.RemoveMember)
+		chat.PUT("/:id/members/:user_id/role", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:manage_roles"), h.SetMemberRole)
+
+		// Join requests and invite links
+		chat.GET("/:id/join-requests", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.ListJoinRequests)
+		chat.POST("/:id/join-requests/:user_id/approve", middleware.RequirePermission("chat:create"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.ApproveJoinRequest)
+		chat.DELETE("/:id/join-requests/:user_id", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.RejectJoinRequest)
+		chat.GET("/:id/invites", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.ListInvites)
+		chat.POST("/:id/invites", middleware.RequirePermission("chat:create"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.CreateInvite)
+		chat.DELETE("/:id/invites/:code", middleware.RequirePermission("chat:read"), middleware.RequireScopedPermission(h.channel, "channel:invite"), h.RevokeInvite)
+
+		// Messages
+		chat.GET("/:id/messages", middleware.RequirePermission("chat:read"), h.ListMessages)
+		chat.POST("/:id/messages", middleware.RequirePermission("chat:write"), h.PostMessage)
+		chat.PATCH("/:id/messages/:message_id", middleware.RequirePermission("chat:write"), h.EditMessage)
+		chat.DELETE("/:id/messages/:message_id", middleware.RequirePermission("chat:write", "chat:moderate"), h.DeleteMessage)
+		chat.GET("/:id/messages/:message_id/revisions", middleware.RequirePermission("chat:moderate"), h.ListRevisions)
+
+		// Pins
+		chat.GET("/:id/pins", middleware.RequirePermission("chat:read"), h.ListPins)
+		chat.PUT("/:id/messages/:message_id/pin", middleware.RequirePermission("chat:write"), middleware.RequireScopedPermission(h.channel, "channel:pin"), h.PinMessage)
+		chat.DELETE("/:id/messages/:message_id/pin", middleware.RequirePermission("chat:write"), middleware.RequireScopedPermission(h.channel, "channel:pin"), h.UnpinMessage)
+
+		// Threads
+		chat.GET("/:id/messages/:message_id/replies", middleware.RequirePermission("chat:read"), h.ListReplies)
+		chat.PUT("/:id/messages/:message_id/follow", middleware.RequirePermission("chat:read"), h.FollowThread)
+		chat.DELETE("/:id/messages/:message_id/follow", middleware.RequirePermission("chat:read"), h.UnfollowThread)
+
+		chat.POST("/:id/read", middleware.RequirePermission("chat:read"), h.MarkRead)
+
+		// Attachments
+		chat.POST("/:id/attachments", middleware.RequirePermission("chat:write"), h.UploadAttachment)
+	}
+
+	channels := router.Group("/channels")
+	channels.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		channels.GET("", middleware.RequirePermission("chat:read"), h.ListChannels)
+	}
+
+	invites := router.Group("/invites")
+	invites.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		invites.GET("/:code", middleware.RequirePermission("chat:read"), h.GetInvite)
+		invites.POST("/:code/join", middleware.RequirePermission("chat:read"), h.JoinByInvite)
+	}
+
+	attachments := router.Group("/attachments")
+	attachments.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		attachments.GET("/:id", middleware.RequirePermission("chat:read"), h.GetAttachment)
+	}
+
+	// Signed download links of local storage point here; the signature is the authorization
+	if local, ok := h.service.cfg.Storage.(*storage.LocalStorage); ok {
+		router.GET("/files/*key", h.serveFile(local))
+	}
+
+	messages := router.Group("/messages")
+	messages.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		messages.PUT("/:id/reactions/:emoji", middleware.RequirePermission("chat:write"), h.AddReaction)
+		messages.DELETE("/:id/reactions/:emoji", middleware.RequirePermission("chat:write"), h.RemoveReaction)
+	}
+
+	search := router.Group("/search")
+	search.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		search.GET("/messages", middleware.RequirePermission("chat:read"), h.SearchMessages)
+	}
+
+	presence := router.Group("/presence")
+	presence.Use(middleware.JWTOrAPIKeyAuth())
+	{
+		presence.GET("", middleware.RequirePermission("chat:read"), h.GetPresence)
+	}
+}
+
+// maxPresenceUsers is the most users one presence request may ask about
+const maxPresenceUsers = 100
+
+// ConversationResponse represents a conversation in the API response
+type ConversationResponse struct {
+	ID            uint            `json:"id"`
+	Type          string          `json:"type"`
+	Name          string          `json:"name,omitempty"`
+	Description   string          `json:"description,omitempty"`
+	Visibility    string          `json:"visibility,omitempty"` // groups only
+	CreatedByID   uint            `json:"created_by_id"`
+	LastMessageAt *time.Time      `json:"last_message_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Members       []MemberInfo    `json:"members"`
+	LastMessage   *models.Message `json:"last_message"`
+	UnreadCount   int64           `json:"unread_count"`
+}
+
+func newConversationResponse(s *ConversationSummary) ConversationResponse {
+	members := s.Members
+	if members == nil {
+		members = []MemberInfo{}
+	}
+	response := ConversationResponse{
+		ID:            s.Conversation.ID,
+		Type:          s.Conversation.Type,
+		Name:          s.Conversation.Name,
+		Description:   s.Conversation.Description,
+		CreatedByID:   s.Conversation.CreatedByID,
+		LastMessageAt: s.Conversation.LastMessageAt,
+		CreatedAt:     s.Conversation.CreatedAt,
+		Members:       members,
+		LastMessage:   s.LastMessage,
+		UnreadCount:   s.UnreadCount,
+	}
+	if s.Conversation.Type == models.ConversationTypeGroup {
+		response.Visibility = s.Conversation.Visibility
+	}
+	return response
+}
+
+// ListConversations returns the current user's conversations with unread counts
+func (h *Handler) ListConversations(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	summaries, err := h.service.ListConversations(userID)
+	if err != nil {
+		respondError(c, err, "failed to list conversations")
+		return
+	}
+
+	response := make([]ConversationResponse, len(summaries))
+	for i := range summaries {
+		response[i] = newConversationResponse(&summaries[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversations": response})
+}
+
+// CreateConversationRequest represents a request to start a conversation.
+// Direct conversations need user_id; groups need name and member_ids, and
+// may have a description and visibility (private by default).
+type CreateConversationRequest struct {
+	Type        string `json:"type" binding:"required,oneof=direct group"`
+	UserID      uint   `json:"user_id"`
+	Name        string `json:"name" binding:"max=255"`
+	Description string `json:"description" binding:"max=500"`
+	Visibility  string `json:"visibility" binding:"omitempty,oneof=private public"`
+	MemberIDs   []uint `json:"member_ids"`
+}
+
+// CreateConversation starts a direct or group conversation. Starting a direct
+// conversation that already exists returns it with 200.
+func (h *Handler) CreateConversation(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var req CreateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	var conv *models.Conversation
+	status := http.StatusCreated
+	var err error
+	switch req.Type {
+	case models.ConversationTypeDirect:
+		if req.UserID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required for direct conversations"})
+			return
+		}
+		var created bool
+		conv, created, err = h.service.CreateDirect(userID, req.UserID)
+		if !created {
+			status = http.StatusOK
+		}
+	case models.ConversationTypeGroup:
+		conv, err = h.service.CreateGroup(userID, GroupInput{
+			Name:        req.Name,
+			Description: req.Description,
+			Visibility:  req.Visibility,
+			MemberIDs:   req.MemberIDs,
+		})
+	}
+	if err != nil {
+		respondError(c, err, "failed to create conversation")
+		return
+	}
+
+	summary, err := h.service.GetConversation(userID, conv.ID)
+	if err != nil {
+		respondError(c, err, "failed to create conversation")
+		return
+	}
+
+	c.JSON(status, newConversationResponse(summary))
+}
+
+// GetConversation returns a conversation the current user is a member of
+func (h *Handler) GetConversation(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	summary, err := h.service.GetConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
+
+// AddMembersRequest represents a request to add users to a group
+type AddMembersRequest struct {
+	UserIDs []uint `json:"user_ids" binding:"required,min=1"`
+}
+
+// AddMembers adds users to a group conversation (owner only)
+func (h *Handler) AddMembers(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req AddMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if err := h.service.AddMembers(userID, conversationID, req.UserIDs); err != nil {
+		respondError(c, err, "failed to add members")
+		return
+	}
+
+	summary, err := h.service.ManagedConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
+
+// UpdateConversationRequest represents changes to a group's settings;
+// omitted fields are left as they are
+type UpdateConversationRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Visibility  *string `json:"visibility"`
+}
+
+// UpdateConversation renames a group or changes its description. Changing
+// its visibility also takes the channel:manage_roles permission.
+func (h *Handler) UpdateConversation(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req UpdateConversationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if req.Visibility != nil {
+		allowed, _, err := h.channel.Check(c, conversationID, "channel:manage_roles")
+		if err != nil {
+			respondError(c, err, "failed to update conversation")
+			return
+		}
+		if !allowed {
+			respondError(c, ErrForbidden, "")
+			return
+		}
+	}
+
+	update := GroupUpdate{Name: req.Name, Description: req.Description, Visibility: req.Visibility}
+	if _, err := h.service.UpdateGroup(conversationID, update); err != nil {
+		respondError(c, err, "failed to update conversation")
+		return
+	}
+
+	summary, err := h.service.ManagedConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
+
+// SetMemberRoleRequest represents a member's new channel role
+type SetMemberRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// SetMemberRole makes a group member an admin or a plain member, or hands
+// them ownership
+func (h *Handler) SetMemberRole(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	memberID, ok := uintParam(c, "user_id")
+	if !ok {
+		return
+	}
+
+	var req SetMemberRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if err := h.service.SetMemberRole(conversationID, memberID, req.Role); err != nil {
+		respondError(c, err, "failed to change member role")
+		return
+	}
+
+	summary, err := h.service.ManagedConversation(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to fetch conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, newConversationResponse(summary))
+}
+
+// RemoveMember removes a member from a group. Members may remove themselves
+// to leave; removing others takes the channel:kick permission.
+func (h *Handler) RemoveMember(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	memberID, ok := uintParam(c, "user_id")
+	if !ok {
+		return
+	}
+
+	if memberID != userID {
+		allowed, bound, err := h.channel.Check(c, conversationID, "channel:kick")
+		if err != nil {
+			respondError(c, err, "failed to remove member")
+			return
+		}
+		if !bound {
+			respondError(c, ErrNotFound, "")
+			return
+		}
+		if !allowed {
+			respondError(c, ErrForbidden, "")
+			return
+		}
+	}
+
+	if err := h.service.RemoveMember(userID, conversationID, memberID); err != nil {
+		respondError(c, err, "failed to remove member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "member removed"})
+}
+
+// PostMessageRequest represents a new message. Set parent_id to reply in the
+// thread of a message. The body may be empty when attachments are sent.
+type PostMessageRequest struct {
+	Body          string `json:"body"`
+	ParentID      uint   `json:"parent_id"`
+	AttachmentIDs []uint `json:"attachment_ids"`
+}
+
+// PostMessage posts a message to a conversation
+func (h *Handler) PostMessage(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req PostMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	// A message starting with a registered slash command runs it instead.
+	// The response is then a CommandResult with a 200.
+	if name, args, ok := ParseCommand(req.Body); ok && h.commands != nil && len(req.AttachmentIDs) == 0 {
+		if err := h.service.CheckMember(userID, conversationID); err != nil {
+			respondError(c, err, "failed to run command")
+			return
+		}
+		result, handled, err := h.commands.RunCommand(c, CommandInvocation{
+			UserID:         userID,
+			ConversationID: conversationID,
+			ParentID:       req.ParentID,
+			Name:           name,
+			Args:           args,
+			Language:       requestLocale(c),
+		})
+		if err != nil {
+			respondError(c, err, "failed to run command")
+			return
+		}
+		if handled {
+			c.JSON(http.StatusOK, result)
+			return
+		}
+	}
+
+	msg, err := h.service.PostMessage(userID, conversationID, MessageInput{
+		Body:          req.Body,
+		ParentID:      req.ParentID,
+		AttachmentIDs: req.AttachmentIDs,
+		Language:      requestLocale(c),
+	})
+	if err != nil {
+		respondError(c, err, "failed to post message")
+		return
+	}
+
+	c.JSON(http.StatusCreated, msg)
+}
+
+// MessageListResponse represents a page of messages, newest first
+type MessageListResponse struct {
+	Messages   []models.Message `json:"messages"`
+	NextCursor *uint            `json:"next_cursor,omitempty"`
+}
+
+// ListMessages returns message history, newest first.
+// Query parameters: before (a message ID, or next_cursor of the previous page) and limit.
+func (h *Handler) ListMessages(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	before, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	page, err := h.service.ListMessages(userID, conversationID, before, limit)
+	if err != nil {
+		respondError(c, err, "failed to fetch messages")
+		return
+	}
+
+	messages := page.Messages
+	if messages == nil {
+		messages = []models.Message{}
+	}
+	c.JSON(http.StatusOK, MessageListResponse{Messages: messages, NextCursor: page.NextCursor})
+}
+
+// ThreadResponse represents a page of a thread, newest reply first
+type ThreadResponse struct {
+	Parent     *models.Message  `json:"parent"`
+	Messages   []models.Message `json:"messages"`
+	NextCursor *uint            `json:"next_cursor,omitempty"`
+}
+
+// ListReplies returns the replies to a message, newest first. It takes the
+// same before and limit parameters as ListMessages.
+func (h *Handler) ListReplies(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+	before, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	parent, page, err := h.service.ListReplies(userID, conversationID, messageID, before, limit)
+	if err != nil {
+		respondError(c, err, "failed to fetch replies")
+		return
+	}
+
+	replies := page.Messages
+	if replies == nil {
+		replies = []models.Message{}
+	}
+	c.JSON(http.StatusOK, ThreadResponse{Parent: parent, Messages: replies, NextCursor: page.NextCursor})
+}
+
+// FollowThread subscribes the current user to replies to a message
+func (h *Handler) FollowThread(c *gin.Context) {
+	h.setFollowing(c, true)
+}
+
+// UnfollowThread stops notifying the current user of replies to a message
+func (h *Handler) UnfollowThread(c *gin.Context) {
+	h.setFollowing(c, false)
+}
+
+func (h *Handler) setFollowing(c *gin.Context, follow bool) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+
+	if err := h.service.FollowThread(userID, conversationID, messageID, follow); err != nil {
+		respondError(c, err, "failed to update thread subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message_id": messageID, "following": follow})
+}
+
+// EditMessageRequest represents a new body for a message
+type EditMessageRequest struct {
+	Body string `json:"body" binding:"required"`
+}
+
+// EditMessage changes the body of the current user's message
+func (h *Handler) EditMessage(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	msg, err := h.service.EditMessage(userID, conversationID, messageID, req.Body)
+	if err != nil {
+		respondError(c, err, "failed to edit message")
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// DeleteMessage deletes a message, leaving a tombstone. Moderators may delete
+// anyone's message; doing so is recorded in the audit log.
+func (h *Handler) DeleteMessage(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+
+	claims, _ := middleware.GetClaims(c)
+	msg, err := h.service.DeleteMessage(userID, conversationID, messageID, claims.HasPermission("chat:moderate"))
+	if err != nil {
+		respondError(c, err, "failed to delete message")
+		return
+	}
+
+	if msg.SenderID != userID {
+		audit.Record(c, h.db, audit.Event{
+			Action:     "chat.message_delete",
+			TargetType: "message",
+			TargetID:   strconv.FormatUint(uint64(msg.ID), 10),
+			Before:     gin.H{"conversation_id": msg.ConversationID, "sender_id": msg.SenderID},
+		})
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// PinMessage pins a message to its conversation
+func (h *Handler) PinMessage(c *gin.Context) {
+	h.setPinned(c, true)
+}
+
+// UnpinMessage unpins a message
+func (h *Handler) UnpinMessage(c *gin.Context) {
+	h.setPinned(c, false)
+}
+
+func (h *Handler) setPinned(c *gin.Context, pin bool) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+
+	msg, err := h.service.PinMessage(userID, conversationID, messageID, pin)
+	if err != nil {
+		respondError(c, err, "failed to pin message")
+		return
+	}
+
+	c.JSON(http.StatusOK, msg)
+}
+
+// ListPins returns a conversation's pinned messages, most recently pinned first
+func (h *Handler) ListPins(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	messages, err := h.service.ListPins(userID, conversationID)
+	if err != nil {
+		respondError(c, err, "failed to list pinned messages")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+// ListRevisions returns the previous versions of a message (moderators only)
+func (h *Handler) ListRevisions(c *gin.Context) {
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := uintParam(c, "message_id")
+	if !ok {
+		return
+	}
+
+	revisions, err := h.service.ListRevisions(conversationID, messageID)
+	if err != nil {
+		respondError(c, err, "failed to fetch revisions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+// ReactionsResponse represents a message's reactions after a change
+type ReactionsResponse struct {
+	MessageID uint                   `json:"message_id"`
+	Reactions []models.ReactionCount `json:"reactions"`
+}
+
+// AddReaction reacts to a message with the emoji in the path
+func (h *Handler) AddReaction(c *gin.Context) {
+	h.changeReaction(c, h.service.AddReaction)
+}
+
+// RemoveReaction withdraws the current user's reaction with the emoji in the path
+func (h *Handler) RemoveReaction(c *gin.Context) {
+	h.changeReaction(c, h.service.RemoveReaction)
+}
+
+func (h *Handler) changeReaction(c *gin.Context, change func(userID, messageID uint, emoji string) ([]models.ReactionCount, error)) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	messageID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	reactions, err := change(userID, messageID, c.Param("emoji"))
+	if err != nil {
+		respondError(c, err, "failed to update reaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, ReactionsResponse{MessageID: messageID, Reactions: reactions})
+}
+
+// MarkReadRequest represents a read receipt. Without message_id the whole
+// conversation is marked read.
+type MarkReadRequest struct {
+	MessageID uint `json:"message_id"`
+}
+
+// MarkRead records how far the current user has read a conversation
+func (h *Handler) MarkRead(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	conversationID, ok := uintParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var req MarkReadRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+	}
+
+	state, err := h.service.MarkRead(userID, conversationID, req.MessageID)
+	if err != nil {
+		respondError(c, err, "failed to mark conversation read")
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// GetPresence returns the presence of the users in the comma-separated
+// user_ids query parameter. Users who share no conversation with the caller
+// are left out.
+func (h *Handler) GetPresence(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	parts := strings.Split(c.Query("user_ids"), ",")
+	if len(parts) > maxPresenceUsers {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d user_ids allowed", maxPresenceUsers)})
+		return
+	}
+	var userIDs []uint
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_ids"})
+			return
+		}
+		userIDs = append(userIDs, uint(id))
+	}
+	if len(userIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ids is required"})
+		return
+	}
+
+	presence, err := h.service.GetPresence(c.Request.Context(), userID, userIDs)
+	if err != nil {
+		respondError(c, err, "failed to fetch presence")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presence": presence})
+}
+
+// respondError maps service errors to responses
+func respondError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "conversation not found"})
+	case errors.Is(err, ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+	case errors.Is(err, ErrInviteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "invite not found or expired"})
+	case errors.Is(err, ErrAttachmentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "attachment not found"})
+	case errors.Is(err, ErrTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrForbidden):
+		msg := "insufficient permissions"
+		if err != ErrForbidden {
+			msg = strings.TrimPrefix(err.Error(), ErrForbidden.Error()+": ")
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+	case errors.Is(err, ErrInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": strings.TrimPrefix(err.Error(), ErrInvalid.Error()+": ")})
+	case errors.Is(err, ErrRateLimited):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		logger.Error().Err(err).Msg("Chat request failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
+
+// pageParams parses the before cursor and limit of a message listing, writing
+// a 400 if the cursor is invalid
+func pageParams(c *gin.Context) (before uint, limit int, ok bool) {
+	if v := c.Query("before"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before cursor"})
+			return 0, 0, false
+		}
+		before = uint(id)
+	}
+	limit, _ = strconv.Atoi(c.Query("limit"))
+	return before, limit, true
+}
+
+// uintParam parses a numeric path parameter, writing a 400 if it is invalid
+func uintParam(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + strings.ReplaceAll(name, "_", " ")})
+		return 0, false
+	}
+	return uint(id), true
+}
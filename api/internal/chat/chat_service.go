@@ -0,0 +1,1320 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/webhook"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxMessageLength is the longest message body accepted, in bytes
+	MaxMessageLength = 4000
+	// MaxGroupMembers caps the size of group conversations
+	MaxGroupMembers = 256
+	// MaxNameLength is the longest group name accepted, in bytes
+	MaxNameLength = 255
+	// MaxPinnedMessages caps how many messages a conversation can pin
+	MaxPinnedMessages = 50
+	// MaxEmojiLength is the longest reaction accepted, in bytes, leaving room
+	// for multi-codepoint emoji and :shortcodes:
+	MaxEmojiLength = 64
+
+	defaultMessageLimit = 50
+	maxMessageLimit     = 100
+)
+
+var (
+	// ErrNotFound is returned when a conversation does not exist or the user is not a member
+	ErrNotFound = errors.New("conversation not found")
+	// ErrMessageNotFound is returned when a message is not in the conversation
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrForbidden is returned when a member may not perform an action
+	ErrForbidden = errors.New("not allowed")
+	// ErrInvalid is returned for requests that cannot be satisfied, e.g. unknown users
+	ErrInvalid = errors.New("invalid request")
+)
+
+// Config holds chat settings
+type Config struct {
+	EditWindow        time.Duration // how long authors can edit a message; zero means no limit
+	Storage           storage.Storage
+	MaxAttachmentSize int64         // in bytes
+	AttachmentTypes   []string      // accepted content types; "image/*" accepts every image type
+	AttachmentURLTTL  time.Duration // validity of attachment download links
+}
+
+// Service implements conversations and messages
+type Service struct {
+	db        *gorm.DB
+	publisher Publisher
+	cfg       Config
+}
+
+// NewService creates a new chat service. Events are sent to publisher; pass
+// nil to run without real-time delivery.
+func NewService(db *gorm.DB, publisher Publisher, cfg Config) *Service {
+	if publisher == nil {
+		publisher = nopPublisher{}
+	}
+	return &Service{db: db, publisher: publisher, cfg: cfg}
+}
+
+// ConversationSummary is a conversation as seen by one of its members
+type ConversationSummary struct {
+	Conversation models.Conversation
+	Members      []MemberInfo
+	LastMessage  *models.Message
+	UnreadCount  int64
+}
+
+// MemberInfo is a conversation member with the public parts of their profile
+// and how far they have read
+type MemberInfo struct {
+	UserID            uint       `json:"user_id"`
+	Name              string     `json:"name"`
+	Picture           string     `json:"picture"`
+	Role              string     `json:"role"`
+	LastReadMessageID uint       `json:"last_read_message_id"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+	JoinedAt          time.Time  `json:"joined_at"`
+}
+
+// ReadState is how far a member has read a conversation
+type ReadState struct {
+	ConversationID    uint       `json:"conversation_id"`
+	LastReadMessageID uint       `json:"last_read_message_id"`
+	LastReadAt        *time.Time `json:"last_read_at"`
+	UnreadCount       int64      `json:"unread_count"`
+}
+
+// MessagePage is a page of messages, newest first
+type MessagePage struct {
+	Messages   []models.Message
+	NextCursor *uint // pass as before to get older messages; nil on the last page
+}
+
+// CreateDirect returns the direct conversation between two users, creating it
+// if needed. created reports whether a new conversation was made.
+func (s *Service) CreateDirect(userID, otherID uint) (conv *models.Conversation, created bool, err error) {
+	if userID == otherID {
+		return nil, false, fmt.Errorf("%w: cannot start a conversation with yourself", ErrInvalid)
+	}
+	if err := s.checkUsersActive([]uint{otherID}); err != nil {
+		return nil, false, err
+	}
+
+	key := directKey(userID, otherID)
+	var existing models.Conversation
+	err = s.db.Where("direct_key = ?", key).First(&existing).Error
+	if err == nil {
+		return &existing, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	conv = &models.Conversation{
+		Type:        models.ConversationTypeDirect,
+		DirectKey:   &key,
+		CreatedByID: userID,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(conv).Error; err != nil {
+			return err
+		}
+		members := []models.ConversationMember{
+			{ConversationID: conv.ID, UserID: userID, Role: models.MemberRoleMember},
+			{ConversationID: conv.ID, UserID: otherID, Role: models.MemberRoleMember},
+		}
+		if err := tx.Create(&members).Error; err != nil {
+			return err
+		}
+		return bindMemberRole(tx, conv.ID, models.MemberRoleMember, userID, otherID)
+	})
+	if err != nil {
+		// Lost a race with the other user creating the same conversation
+		if s.db.Where("direct_key = ?", key).First(&existing).Error == nil {
+			return &existing, false, nil
+		}
+		return nil, false, err
+	}
+
+	s.publisher.PublishToUsers([]uint{userID, otherID}, membershipEvent(EventConversationJoined, conv.ID))
+	return conv, true, nil
+}
+
+// CreateGroup creates a group conversation owned by userID
+func (s *Service) CreateGroup(userID uint, input GroupInput) (*models.Conversation, error) {
+	name, err := validateGroupName(input.Name)
+	if err != nil {
+		return nil, err
+	}
+	description, err := validateDescription(input.Description)
+	if err != nil {
+		return nil, err
+	}
+	visibility := input.Visibility
+	if visibility == "" {
+		visibility = models.VisibilityPrivate
+	}
+	if err := validateVisibility(visibility); err != nil {
+		return nil, err
+	}
+
+	others := uniqueIDs(input.MemberIDs, userID)
+	if len(others)+1 > MaxGroupMembers {
+		return nil, fmt.Errorf("%w: groups are limited to %d members", ErrInvalid, MaxGroupMembers)
+	}
+	if err := s.checkUsersActive(others); err != nil {
+		return nil, err
+	}
+
+	conv := &models.Conversation{
+		Type:        models.ConversationTypeGroup,
+		Name:        name,
+		Description: description,
+		Visibility:  visibility,
+		CreatedByID: userID,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(conv).Error; err != nil {
+			return err
+		}
+		members := []models.ConversationMember{{ConversationID: conv.ID, UserID: userID, Role: models.MemberRoleOwner}}
+		for _, id := range others {
+			members = append(members, models.ConversationMember{ConversationID: conv.ID, UserID: id, Role: models.MemberRoleMember})
+		}
+		if err := tx.Create(&members).Error; err != nil {
+			return err
+		}
+		if err := bindMemberRole(tx, conv.ID, models.MemberRoleOwner, userID); err != nil {
+			return err
+		}
+		return bindMemberRole(tx, conv.ID, models.MemberRoleMember, others...)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publisher.PublishToUsers(append([]uint{userID}, others...), membershipEvent(EventConversationJoined, conv.ID))
+	return conv, nil
+}
+
+// ListConversations returns the user's conversations, most recently active first
+func (s *Service) ListConversations(userID uint) ([]ConversationSummary, error) {
+	var convs []models.Conversation
+	err := s.db.
+		Joins("JOIN conversation_members cm ON cm.conversation_id = conversations.id AND cm.user_id = ?", userID).
+		Order("COALESCE(conversations.last_message_at, conversations.created_at) DESC").
+		Find(&convs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(convs))
+	for i, c := range convs {
+		ids[i] = c.ID
+	}
+
+	members, err := s.members(ids)
+	if err != nil {
+		return nil, err
+	}
+	lastMessages, err := models.GetLastMessages(s.db, ids)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := models.GetUnreadCounts(s.db, userID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]ConversationSummary, len(convs))
+	for i, c := range convs {
+		summaries[i] = ConversationSummary{
+			Conversation: c,
+			Members:      members[c.ID],
+			UnreadCount:  unread[c.ID],
+		}
+		if m, ok := lastMessages[c.ID]; ok {
+			summaries[i].LastMessage = &m
+		}
+	}
+	return summaries, nil
+}
+
+// GetConversation returns a conversation the user is a member of
+func (s *Service) GetConversation(userID, conversationID uint) (*ConversationSummary, error) {
+	conv, _, err := s.membership(userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return s.summarize(userID, conv)
+}
+
+// CheckMember returns ErrNotFound unless the user is a member of the conversation
+func (s *Service) CheckMember(userID, conversationID uint) error {
+	_, _, err := s.membership(userID, conversationID)
+	return err
+}
+
+// ManagedConversation returns a conversation as seen by userID without
+// checking membership, for callers that have checked permissions on it
+func (s *Service) ManagedConversation(userID, conversationID uint) (*ConversationSummary, error) {
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return s.summarize(userID, conv)
+}
+
+// summarize gathers a conversation's members, latest message and the user's
+// unread count
+func (s *Service) summarize(userID uint, conv *models.Conversation) (*ConversationSummary, error) {
+	members, err := s.members([]uint{conv.ID})
+	if err != nil {
+		return nil, err
+	}
+	lastMessages, err := models.GetLastMessages(s.db, []uint{conv.ID})
+	if err != nil {
+		return nil, err
+	}
+	unread, err := models.GetUnreadCounts(s.db, userID, []uint{conv.ID})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ConversationSummary{
+		Conversation: *conv,
+		Members:      members[conv.ID],
+		UnreadCount:  unread[conv.ID],
+	}
+	if m, ok := lastMessages[conv.ID]; ok {
+		summary.LastMessage = &m
+	}
+	return summary, nil
+}
+
+// MessageInput is the content of a new message
+type MessageInput struct {
+	Body          string
+	ParentID      uint   // reply in the thread of this message when not zero
+	AttachmentIDs []uint // pending attachments the sender uploaded to the conversation
+	Language      string // the sender's locale, which the message is indexed for search in
+}
+
+// PostMessage adds a message to a conversation, or a reply to a thread. The
+// sender's own message counts as read. Replies stay out of the conversation's
+// unread count and preview; the thread's followers are told about them
+// separately.
+func (s *Service) PostMessage(userID, conversationID uint, input MessageInput) (*models.Message, error) {
+	attachmentIDs := uniqueIDs(input.AttachmentIDs, 0)
+	if len(attachmentIDs) > MaxAttachmentsPerMessage {
+		return nil, fmt.Errorf("%w: at most %d attachments per message", ErrInvalid, MaxAttachmentsPerMessage)
+	}
+	body := strings.TrimSpace(input.Body)
+	if body != "" || len(attachmentIDs) == 0 {
+		var err error
+		if body, err = validateBody(body); err != nil {
+			return nil, err
+		}
+	}
+	parentID := input.ParentID
+
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, err
+	}
+
+	msg := &models.Message{
+		ConversationID: conversationID,
+		SenderID:       userID,
+		Body:           body,
+		Kind:           models.MessageKindUser,
+		Language:       searchLocale(input.Language),
+	}
+	if parentID != 0 {
+		msg.ParentID = &parentID
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var parent models.Message
+		if parentID != 0 {
+			if err := lockMessage(tx, conversationID, parentID, &parent); err != nil {
+				return err
+			}
+			if parent.ParentID != nil {
+				return fmt.Errorf("%w: replies cannot have replies", ErrInvalid)
+			}
+			if parent.IsSystem() {
+				return fmt.Errorf("%w: system messages cannot have replies", ErrInvalid)
+			}
+			if parent.Deleted() {
+				return fmt.Errorf("%w: message has been deleted", ErrInvalid)
+			}
+		}
+
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		if err := linkAttachments(tx, userID, conversationID, msg, attachmentIDs); err != nil {
+			return err
+		}
+		if err := webhook.Enqueue(tx, webhook.EventMessageCreated, msg); err != nil {
+			return err
+		}
+
+		if parentID != 0 {
+			if err := tx.Model(&models.Message{}).Where("id = ?", parentID).Updates(map[string]interface{}{
+				"reply_count":   gorm.Expr("reply_count + 1"),
+				"last_reply_at": msg.CreatedAt,
+			}).Error; err != nil {
+				return err
+			}
+			// The parent's author follows from the first reply, and every
+			// replier from their own
+			followers := []models.ThreadFollower{{MessageID: parentID, UserID: userID}}
+			if parent.ReplyCount == 0 && parent.SenderID != userID {
+				followers = append(followers, models.ThreadFollower{MessageID: parentID, UserID: parent.SenderID})
+			}
+			return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&followers).Error
+		}
+
+		if err := tx.Model(&models.Conversation{}).Where("id = ?", conversationID).
+			Update("last_message_at", msg.CreatedAt).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.ConversationMember{}).
+			Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+			Updates(map[string]interface{}{"last_read_message_id": msg.ID, "last_read_at": msg.CreatedAt}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageCreated, Data: msg})
+	if parentID != 0 {
+		s.notifyFollowers(userID, msg)
+	}
+	return msg, nil
+}
+
+// notifyFollowers sends a reply to the followers of its thread who are still
+// members of the conversation, other than its sender
+func (s *Service) notifyFollowers(senderID uint, reply *models.Message) {
+	var followerIDs []uint
+	err := s.db.Table("thread_followers AS tf").
+		Joins("JOIN conversation_members cm ON cm.user_id = tf.user_id AND cm.conversation_id = ?", reply.ConversationID).
+		Where("tf.message_id = ? AND tf.user_id <> ?", *reply.ParentID, senderID).
+		Pluck("tf.user_id", &followerIDs).Error
+	if err != nil {
+		logger.Error().Err(err).Uint("message_id", *reply.ParentID).Msg("Failed to load thread followers")
+		return
+	}
+
+	if len(followerIDs) > 0 {
+		s.publisher.PublishToUsers(followerIDs, Event{
+			Type: EventThreadReply,
+			Data: ThreadReplyEvent{ConversationID: reply.ConversationID, ParentID: *reply.ParentID, Message: reply},
+		})
+	}
+}
+
+// ListReplies returns the replies to a message older than before (or the
+// latest when before is zero), newest first, along with the parent
+func (s *Service) ListReplies(userID, conversationID, parentID, before uint, limit int) (*models.Message, *MessagePage, error) {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, nil, err
+	}
+	if limit < 1 || limit > maxMessageLimit {
+		limit = defaultMessageLimit
+	}
+
+	var parent models.Message
+	err := s.db.Where("id = ? AND conversation_id = ? AND parent_id IS NULL", parentID, conversationID).First(&parent).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := s.db.Where("parent_id = ?", parentID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var replies []models.Message
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&replies).Error; err != nil {
+		return nil, nil, err
+	}
+
+	page := &MessagePage{Messages: replies}
+	if len(replies) > limit {
+		page.Messages = replies[:limit]
+		cursor := replies[limit-1].ID
+		page.NextCursor = &cursor
+	}
+
+	parents := []models.Message{parent}
+	if err := s.decorate(userID, parents); err != nil {
+		return nil, nil, err
+	}
+	if err := s.decorate(userID, page.Messages); err != nil {
+		return nil, nil, err
+	}
+	return &parents[0], page, nil
+}
+
+// FollowThread starts or stops notifying the user of replies to a message
+func (s *Service) FollowThread(userID, conversationID, messageID uint, follow bool) error {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return err
+	}
+
+	var msg models.Message
+	err := s.db.Select("id").Where("id = ? AND conversation_id = ? AND parent_id IS NULL", messageID, conversationID).First(&msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if !follow {
+		return s.db.Where("message_id = ? AND user_id = ?", messageID, userID).Delete(&models.ThreadFollower{}).Error
+	}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.ThreadFollower{MessageID: messageID, UserID: userID}).Error
+}
+
+// EditMessage replaces the body of the user's own message, keeping the previous
+// version as a revision
+func (s *Service) EditMessage(userID, conversationID, messageID uint, body string) (*models.Message, error) {
+	body, err := validateBody(body)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, err
+	}
+
+	var msg models.Message
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockMessage(tx, conversationID, messageID, &msg); err != nil {
+			return err
+		}
+		if msg.SenderID != userID || msg.IsSystem() {
+			return fmt.Errorf("%w: only the author can edit a message", ErrForbidden)
+		}
+		if msg.Deleted() {
+			return fmt.Errorf("%w: message has been deleted", ErrInvalid)
+		}
+		if s.cfg.EditWindow > 0 && time.Since(msg.CreatedAt) > s.cfg.EditWindow {
+			return fmt.Errorf("%w: messages can only be edited for %d minutes", ErrForbidden, int(s.cfg.EditWindow.Minutes()))
+		}
+		if msg.Body == body {
+			return nil
+		}
+
+		revision := models.MessageRevision{
+			MessageID: msg.ID,
+			Body:      msg.Body,
+			Action:    models.RevisionActionEdit,
+			EditorID:  userID,
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		msg.Body = body
+		msg.EditedAt = &now
+		return tx.Model(&msg).Updates(map[string]interface{}{"body": body, "edited_at": now}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageUpdated, Data: &msg})
+	return &msg, nil
+}
+
+// DeleteMessage turns a message into a tombstone, keeping its body as a
+// revision. Authors can delete their own messages; moderators can delete any
+// message, including in conversations they are not a member of.
+func (s *Service) DeleteMessage(userID, conversationID, messageID uint, moderator bool) (*models.Message, error) {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		if !moderator || !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		if _, err := s.conversation(conversationID); err != nil {
+			return nil, err
+		}
+	}
+
+	var msg models.Message
+	var attachments []models.Attachment
+	changed := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockMessage(tx, conversationID, messageID, &msg); err != nil {
+			return err
+		}
+		// System messages have no author to delete them
+		if (msg.SenderID != userID || msg.IsSystem()) && !moderator {
+			return fmt.Errorf("%w: only the author or a moderator can delete a message", ErrForbidden)
+		}
+		if msg.Deleted() {
+			return nil
+		}
+
+		revision := models.MessageRevision{
+			MessageID: msg.ID,
+			Body:      msg.Body,
+			Action:    models.RevisionActionDelete,
+			EditorID:  userID,
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+
+		// Reactions and attachments go with the content
+		if err := tx.Where("message_id = ?", msg.ID).Delete(&models.MessageReaction{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Clauses(clause.Returning{}).Where("message_id = ?", msg.ID).Delete(&attachments).Error; err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		msg.Body = ""
+		msg.DeletedAt = &now
+		msg.DeletedByID = &userID
+		msg.PinnedAt, msg.PinnedByID = nil, nil
+		changed = true
+		return tx.Model(&msg).Updates(map[string]interface{}{
+			"body": "", "deleted_at": now, "deleted_by_id": userID, "pinned_at": nil, "pinned_by_id": nil,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.deleteBlobs(attachments)
+		s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageUpdated, Data: &msg})
+	}
+	return &msg, nil
+}
+
+// ListRevisions returns the previous versions of a message, oldest first. It
+// is meant for moderators, so does not check membership.
+func (s *Service) ListRevisions(conversationID, messageID uint) ([]models.MessageRevision, error) {
+	var msg models.Message
+	err := s.db.Select("id").Where("id = ? AND conversation_id = ?", messageID, conversationID).First(&msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []models.MessageRevision{}
+	err = s.db.Where("message_id = ?", messageID).Order("id").Find(&revisions).Error
+	return revisions, err
+}
+
+// MarkRead records that the user has read a conversation up to messageID, or
+// to its latest message when messageID is zero. The read position never moves
+// back; when it advances the other members are told.
+func (s *Service) MarkRead(userID, conversationID, messageID uint) (*ReadState, error) {
+	_, member, err := s.membership(userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var target models.Message
+	query := s.db.Select("id").Where("conversation_id = ?", conversationID)
+	if messageID != 0 {
+		query = query.Where("id = ?", messageID)
+	}
+	err = query.Order("id DESC").First(&target).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if messageID != 0 {
+			return nil, fmt.Errorf("%w: message not found", ErrInvalid)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	result := s.db.Model(&models.ConversationMember{}).
+		Where("conversation_id = ? AND user_id = ? AND last_read_message_id < ?", conversationID, userID, target.ID).
+		Updates(map[string]interface{}{"last_read_message_id": target.ID, "last_read_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	state := &ReadState{
+		ConversationID:    conversationID,
+		LastReadMessageID: member.LastReadMessageID,
+		LastReadAt:        member.LastReadAt,
+	}
+	if result.RowsAffected > 0 {
+		state.LastReadMessageID = target.ID
+		state.LastReadAt = &now
+		s.publisher.PublishToConversation(conversationID, Event{
+			Type: EventConversationRead,
+			Data: ReadEvent{
+				ConversationID:    conversationID,
+				UserID:            userID,
+				LastReadMessageID: target.ID,
+				LastReadAt:        now,
+			},
+		})
+	}
+
+	unread, err := models.GetUnreadCounts(s.db, userID, []uint{conversationID})
+	if err != nil {
+		return nil, err
+	}
+	state.UnreadCount = unread[conversationID]
+	return state, nil
+}
+
+// Typing tells the members of a conversation that the user is typing. Events
+// closer together than TypingInterval are dropped.
+func (s *Service) Typing(ctx context.Context, userID, conversationID uint) error {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return err
+	}
+
+	allowed, err := allowTyping(ctx, userID, conversationID)
+	if err != nil || !allowed {
+		return err
+	}
+
+	s.publisher.PublishToConversation(conversationID, Event{
+		Type: EventTyping,
+		Data: TypingEvent{ConversationID: conversationID, UserID: userID},
+	})
+	return nil
+}
+
+// SetPresence records the state of one of the user's connections
+// (PresenceOffline when it closes) and tells everyone who shares a
+// conversation with the user when their overall presence changes
+func (s *Service) SetPresence(ctx context.Context, userID uint, connID, state string) error {
+	before, after, err := updatePresence(ctx, userID, connID, state)
+	if err != nil || before == after {
+		return err
+	}
+
+	now := time.Now().UTC()
+	return s.publishPresence(PresenceInfo{UserID: userID, State: after, LastSeenAt: &now})
+}
+
+// publishPresence tells everyone who shares a conversation with the user
+// about their new presence
+func (s *Service) publishPresence(info PresenceInfo) error {
+	contactIDs, err := s.contactIDs(info.UserID, nil)
+	if err != nil {
+		return err
+	}
+	if len(contactIDs) > 0 {
+		s.publisher.PublishToUsers(contactIDs, Event{Type: EventPresence, Data: info})
+	}
+	return nil
+}
+
+// PresenceSweepLoop ends connections whose heartbeat has lapsed, such as
+// those of a crashed replica or a killed client, and publishes the
+// resulting presence changes. Running it on every replica is safe: each
+// change is reported to exactly one of them.
+func (s *Service) PresenceSweepLoop(ctx context.Context) {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := sweepPresence(ctx, presenceSweepBatch)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to sweep presence")
+				continue
+			}
+			for _, info := range changed {
+				if err := s.publishPresence(info); err != nil {
+					logger.Error().Err(err).Uint("user_id", info.UserID).Msg("Failed to publish presence")
+				}
+			}
+		}
+	}
+}
+
+// GetPresence returns the presence of those of userIDs who share a
+// conversation with the user; others are left out
+func (s *Service) GetPresence(ctx context.Context, userID uint, userIDs []uint) ([]PresenceInfo, error) {
+	candidates := uniqueIDs(userIDs, 0)
+	if len(candidates) == 0 {
+		return []PresenceInfo{}, nil
+	}
+
+	visible, err := s.contactIDs(userID, candidates)
+	if err != nil {
+		return nil, err
+	}
+	if len(visible) == 0 {
+		return []PresenceInfo{}, nil
+	}
+	return getPresence(ctx, visible)
+}
+
+// ConversationIDs returns the IDs of every conversation the user is a member of
+func (s *Service) ConversationIDs(userID uint) ([]uint, error) {
+	var ids []uint
+	err := s.db.Model(&models.ConversationMember{}).Where("user_id = ?", userID).Pluck("conversation_id", &ids).Error
+	return ids, err
+}
+
+// ListMessages returns messages outside threads older than before (or the
+// latest when before is zero), newest first
+func (s *Service) ListMessages(userID, conversationID, before uint, limit int) (*MessagePage, error) {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, err
+	}
+	if limit < 1 || limit > maxMessageLimit {
+		limit = defaultMessageLimit
+	}
+
+	query := s.db.Where("conversation_id = ? AND parent_id IS NULL", conversationID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	// Fetch one extra row to know whether there is another page
+	var messages []models.Message
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+
+	page := &MessagePage{Messages: messages}
+	if len(messages) > limit {
+		page.Messages = messages[:limit]
+		cursor := messages[limit-1].ID
+		page.NextCursor = &cursor
+	}
+	if err := s.decorate(userID, page.Messages); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// AddReaction reacts to a message with an emoji. Reacting twice with the same
+// emoji has no further effect.
+func (s *Service) AddReaction(userID, messageID uint, emoji string) ([]models.ReactionCount, error) {
+	msg, err := s.reactableMessage(userID, messageID, emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	reaction := models.MessageReaction{MessageID: msg.ID, UserID: userID, Emoji: emoji}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return s.reactionChanged(userID, msg, emoji, EventReactionAdded, result.RowsAffected > 0)
+}
+
+// RemoveReaction withdraws the user's reaction to a message
+func (s *Service) RemoveReaction(userID, messageID uint, emoji string) ([]models.ReactionCount, error) {
+	msg, err := s.reactableMessage(userID, messageID, emoji)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.db.Where("message_id = ? AND user_id = ? AND emoji = ?", msg.ID, userID, emoji).
+		Delete(&models.MessageReaction{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return s.reactionChanged(userID, msg, emoji, EventReactionRemoved, result.RowsAffected > 0)
+}
+
+// reactableMessage validates a reaction and loads the message, which must be
+// in one of the user's conversations and not deleted
+func (s *Service) reactableMessage(userID, messageID uint, emoji string) (*models.Message, error) {
+	if emoji == "" || len(emoji) > MaxEmojiLength || !utf8.ValidString(emoji) || strings.ContainsFunc(emoji, unicode.IsSpace) {
+		return nil, fmt.Errorf("%w: invalid emoji", ErrInvalid)
+	}
+
+	var msg models.Message
+	if err := s.db.First(&msg, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if _, _, err := s.membership(userID, msg.ConversationID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	if msg.Deleted() {
+		return nil, fmt.Errorf("%w: message has been deleted", ErrInvalid)
+	}
+	return &msg, nil
+}
+
+// reactionChanged returns the message's reactions after a change and, if the
+// change took effect, tells the conversation
+func (s *Service) reactionChanged(userID uint, msg *models.Message, emoji, eventType string, changed bool) ([]models.ReactionCount, error) {
+	counts, err := models.GetReactionCounts(s.db, []uint{msg.ID}, userID)
+	if err != nil {
+		return nil, err
+	}
+	reactions := counts[msg.ID]
+	if reactions == nil {
+		reactions = []models.ReactionCount{}
+	}
+
+	if changed {
+		event := ReactionEvent{ConversationID: msg.ConversationID, MessageID: msg.ID, UserID: userID, Emoji: emoji}
+		for _, r := range reactions {
+			if r.Emoji == emoji {
+				event.Count = r.Count
+			}
+		}
+		s.publisher.PublishToConversation(msg.ConversationID, Event{Type: eventType, Data: event})
+	}
+	return reactions, nil
+}
+
+// decorate fills in the reactions of messages as seen by the user, and their
+// attachments
+func (s *Service) decorate(userID uint, messages []models.Message) error {
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	counts, err := models.GetReactionCounts(s.db, ids, userID)
+	if err != nil {
+		return err
+	}
+	attachments, err := s.messageAttachments(ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+		messages[i].Attachments = attachments[messages[i].ID]
+	}
+	return nil
+}
+
+// AddMembers adds users to a group conversation as members. Callers check
+// the channel:invite permission.
+func (s *Service) AddMembers(userID, conversationID uint, memberIDs []uint) error {
+	ids := uniqueIDs(memberIDs, 0)
+	if err := s.checkUsersActive(ids); err != nil {
+		return err
+	}
+
+	var added []uint
+	var msg *models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		added, msg, err = addMembers(tx, conversationID, userID, models.SystemEventMemberAdded, ids)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.membersAdded(conversationID, added, msg)
+	return nil
+}
+
+// RemoveMember removes a user from a group conversation. Members can remove
+// themselves; removing others needs the channel:kick permission, which
+// callers check. The owner cannot be removed by others.
+func (s *Service) RemoveMember(userID, conversationID, memberID uint) error {
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return fmt.Errorf("%w: members can only be removed from groups", ErrInvalid)
+	}
+
+	var msg *models.Message
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var removed models.ConversationMember
+		err := tx.Where("conversation_id = ? AND user_id = ?", conversationID, memberID).First(&removed).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if memberID == userID {
+				return ErrNotFound
+			}
+			return fmt.Errorf("%w: user is not a member", ErrInvalid)
+		}
+		if err != nil {
+			return err
+		}
+		if memberID != userID && removed.Role == models.MemberRoleOwner {
+			return fmt.Errorf("%w: the owner cannot be removed", ErrForbidden)
+		}
+		if err := tx.Delete(&removed).Error; err != nil {
+			return err
+		}
+		if err := models.UnbindRoles(tx, models.ResourceTypeConversation, conversationID, memberID); err != nil {
+			return err
+		}
+		event := models.SystemEventMemberRemoved
+		if memberID == userID {
+			event = models.SystemEventMemberLeft
+		}
+		if msg, err = postSystemMessage(tx, conversationID, userID, event, memberID); err != nil {
+			return err
+		}
+
+		// A group whose owner leaves passes to its longest-standing admin,
+		// or member when there are no admins
+		if removed.Role != models.MemberRoleOwner {
+			return nil
+		}
+		var next models.ConversationMember
+		err = tx.Where("conversation_id = ?", conversationID).
+			Order(clause.OrderBy{Expression: clause.Expr{
+				SQL:                "role = ? DESC, joined_at, user_id",
+				Vars:               []interface{}{models.MemberRoleAdmin},
+				WithoutParentheses: true,
+			}}).
+			First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return setMemberRole(tx, &next, models.MemberRoleOwner)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.publisher.PublishToUsers([]uint{memberID}, membershipEvent(EventConversationLeft, conversationID))
+	s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageCreated, Data: msg})
+	return nil
+}
+
+// SetMemberRole changes a group member's role to admin or member. Making a
+// member the owner transfers ownership, and the previous owner becomes an
+// admin. Callers check the channel:manage_roles permission.
+func (s *Service) SetMemberRole(conversationID, memberID uint, role string) error {
+	switch role {
+	case models.MemberRoleOwner, models.MemberRoleAdmin, models.MemberRoleMember:
+	default:
+		return fmt.Errorf("%w: role must be owner, admin or member", ErrInvalid)
+	}
+
+	conv, err := s.conversation(conversationID)
+	if err != nil {
+		return err
+	}
+	if conv.Type != models.ConversationTypeGroup {
+		return fmt.Errorf("%w: roles can only be changed in groups", ErrInvalid)
+	}
+
+	var changed []models.ConversationMember
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var members []models.ConversationMember
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("conversation_id = ? AND (user_id = ? OR role = ?)", conversationID, memberID, models.MemberRoleOwner).
+			Find(&members).Error
+		if err != nil {
+			return err
+		}
+
+		var target *models.ConversationMember
+		for i := range members {
+			if members[i].UserID == memberID {
+				target = &members[i]
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("%w: user is not a member", ErrInvalid)
+		}
+		if target.Role == role {
+			return nil
+		}
+		if target.Role == models.MemberRoleOwner {
+			return fmt.Errorf("%w: make another member the owner instead", ErrInvalid)
+		}
+
+		if role == models.MemberRoleOwner {
+			for i := range members {
+				if members[i].UserID != memberID {
+					if err := setMemberRole(tx, &members[i], models.MemberRoleAdmin); err != nil {
+						return err
+					}
+					changed = append(changed, members[i])
+				}
+			}
+		}
+		if err := setMemberRole(tx, target, role); err != nil {
+			return err
+		}
+		changed = append(changed, *target)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range changed {
+		s.publisher.PublishToConversation(conversationID, Event{
+			Type: EventMemberUpdated,
+			Data: MemberEvent{ConversationID: conversationID, UserID: m.UserID, Role: m.Role},
+		})
+	}
+	return nil
+}
+
+// PinMessage pins or unpins a message in a conversation. Callers check the
+// channel:pin permission.
+func (s *Service) PinMessage(userID, conversationID, messageID uint, pin bool) (*models.Message, error) {
+	if _, err := s.conversation(conversationID); err != nil {
+		return nil, err
+	}
+
+	var msg models.Message
+	changed := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := lockMessage(tx, conversationID, messageID, &msg); err != nil {
+			return err
+		}
+		if (msg.PinnedAt != nil) == pin {
+			return nil
+		}
+		if !pin {
+			msg.PinnedAt, msg.PinnedByID = nil, nil
+			changed = true
+			return tx.Model(&msg).Updates(map[string]interface{}{"pinned_at": nil, "pinned_by_id": nil}).Error
+		}
+
+		if msg.Deleted() {
+			return fmt.Errorf("%w: message has been deleted", ErrInvalid)
+		}
+		if msg.IsSystem() {
+			return fmt.Errorf("%w: system messages cannot be pinned", ErrInvalid)
+		}
+		var count int64
+		if err := tx.Model(&models.Message{}).
+			Where("conversation_id = ? AND pinned_at IS NOT NULL", conversationID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= MaxPinnedMessages {
+			return fmt.Errorf("%w: at most %d messages can be pinned", ErrInvalid, MaxPinnedMessages)
+		}
+
+		now := time.Now().UTC()
+		msg.PinnedAt, msg.PinnedByID = &now, &userID
+		changed = true
+		return tx.Model(&msg).Updates(map[string]interface{}{"pinned_at": now, "pinned_by_id": userID}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if changed {
+		s.publisher.PublishToConversation(conversationID, Event{Type: EventMessageUpdated, Data: &msg})
+	}
+	return &msg, nil
+}
+
+// ListPins returns a conversation's pinned messages, most recently pinned first
+func (s *Service) ListPins(userID, conversationID uint) ([]models.Message, error) {
+	if _, _, err := s.membership(userID, conversationID); err != nil {
+		return nil, err
+	}
+
+	var messages []models.Message
+	if err := s.db.Where("conversation_id = ? AND pinned_at IS NOT NULL", conversationID).
+		Order("pinned_at DESC").Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	if err := s.decorate(userID, messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// bindMemberRole grants users the channel role backing a member role
+func bindMemberRole(tx *gorm.DB, conversationID uint, role string, userIDs ...uint) error {
+	return models.BindRole(tx, models.ChannelRoleName(role), models.ResourceTypeConversation, conversationID, userIDs...)
+}
+
+// setMemberRole changes a member's role along with their channel role binding
+func setMemberRole(tx *gorm.DB, member *models.ConversationMember, role string) error {
+	member.Role = role
+	if err := tx.Model(member).Update("role", role).Error; err != nil {
+		return err
+	}
+	return bindMemberRole(tx, member.ConversationID, role, member.UserID)
+}
+
+// validateBody trims a message body and checks its length
+func validateBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", fmt.Errorf("%w: message body is required", ErrInvalid)
+	}
+	if len(body) > MaxMessageLength {
+		return "", fmt.Errorf("%w: message is longer than %d bytes", ErrInvalid, MaxMessageLength)
+	}
+	return body, nil
+}
+
+// lockMessage loads a message of the conversation for update
+func lockMessage(tx *gorm.DB, conversationID, messageID uint, msg *models.Message) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND conversation_id = ?", messageID, conversationID).
+		First(msg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrMessageNotFound
+	}
+	return err
+}
+
+// conversation loads a conversation regardless of membership, for callers
+// that have checked permissions on it
+func (s *Service) conversation(conversationID uint) (*models.Conversation, error) {
+	var conv models.Conversation
+	if err := s.db.First(&conv, conversationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &conv, nil
+}
+
+// membership loads a conversation and the user's membership in it
+func (s *Service) membership(userID, conversationID uint) (*models.Conversation, *models.ConversationMember, error) {
+	var member models.ConversationMember
+	err := s.db.Where("conversation_id = ? AND user_id = ?", conversationID, userID).First(&member).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conv models.Conversation
+	if err := s.db.First(&conv, conversationID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	return &conv, &member, nil
+}
+
+// contactIDs returns the users other than userID who share a conversation
+// with them, limited to candidates when it is not nil
+func (s *Service) contactIDs(userID uint, candidates []uint) ([]uint, error) {
+	query := s.db.Table("conversation_members AS cm").
+		Distinct("other.user_id").
+		Joins("JOIN conversation_members other ON other.conversation_id = cm.conversation_id").
+		Where("cm.user_id = ? AND other.user_id <> ?", userID, userID)
+	if candidates != nil {
+		query = query.Where("other.user_id IN ?", candidates)
+	}
+
+	var ids []uint
+	err := query.Order("other.user_id").Pluck("other.user_id", &ids).Error
+	return ids, err
+}
+
+// members returns the members of each conversation with their profiles
+func (s *Service) members(conversationIDs []uint) (map[uint][]MemberInfo, error) {
+	result := make(map[uint][]MemberInfo, len(conversationIDs))
+	if len(conversationIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		ConversationID uint
+		MemberInfo
+	}
+	err := s.db.Raw(`
+		SELECT cm.conversation_id, cm.user_id, u.name, u.picture, cm.role,
+			cm.last_read_message_id, cm.last_read_at, cm.joined_at
+		FROM conversation_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.conversation_id IN ?
+		ORDER BY cm.joined_at, cm.user_id
+	`, conversationIDs).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		result[r.ConversationID] = append(result[r.ConversationID], r.MemberInfo)
+	}
+	return result, nil
+}
+
+// checkUsersActive makes sure every user exists and is not disabled
+func (s *Service) checkUsersActive(userIDs []uint) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	var count int64
+	err := s.db.Model(&models.User{}).Where("id IN ? AND disabled_at IS NULL", userIDs).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if int(count) != len(userIDs) {
+		return fmt.Errorf("%w: unknown or disabled user", ErrInvalid)
+	}
+	return nil
+}
+
+func directKey(a, b uint) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+// uniqueIDs removes duplicates and the excluded ID, keeping IDs sorted
+func uniqueIDs(ids []uint, exclude uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	var result []uint
+	for _, id := range ids {
+		if id == exclude || id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/gin-gonic/gin"
+)
+
+// MaxCommandNameLength is the longest slash command name, without the slash
+const MaxCommandNameLength = 32
+
+// ErrRateLimited is returned when a caller has made too many requests
+var ErrRateLimited = errors.New("too many requests")
+
+// CommandInvocation is a slash command typed into a conversation
+type CommandInvocation struct {
+	UserID         uint
+	ConversationID uint
+	ParentID       uint   // set when typed in a thread
+	Name           string // lower case, without the slash
+	Args           string // the rest of the message
+	Language       string
+}
+
+// CommandResult is what running a slash command produced
+type CommandResult struct {
+	Command string          `json:"command"`
+	Text    string          `json:"text,omitempty"`    // reply shown only to the invoker
+	Message *models.Message `json:"message,omitempty"` // message posted to the conversation, if any
+}
+
+// CommandRunner runs slash commands. Messages that start with a command it
+// knows are handed to it instead of being posted.
+type CommandRunner interface {
+	// RunCommand runs an invoked command. handled is false when no such
+	// command is registered, and the message is posted as typed.
+	RunCommand(c *gin.Context, inv CommandInvocation) (result *CommandResult, handled bool, err error)
+}
+
+// ParseCommand splits a message of the form "/name args". ok is false when
+// the message does not start with a well-formed command name, such as "/" or
+// a path like "/usr/bin".
+func ParseCommand(body string) (name, args string, ok bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(body), "/")
+	if !ok {
+		return "", "", false
+	}
+	name = rest
+	if i := strings.IndexFunc(rest, unicode.IsSpace); i >= 0 {
+		name, args = rest[:i], rest[i+1:]
+	}
+	name = strings.ToLower(name)
+	if !ValidCommandName(name) {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(args), true
+}
+
+// ValidCommandName reports whether name can name a slash command: a letter
+// followed by letters, digits, '-' or '_'
+func ValidCommandName(name string) bool {
+	if name == "" || len(name) > MaxCommandNameLength {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+)
+
+// Real-time event types pushed to connected clients
+const (
+	EventMessageCreated  = "message.created"
+	EventMessageUpdated  = "message.updated"
+	EventTyping          = "typing"
+	EventPresence        = "presence"
+	EventReactionAdded   = "reaction.added"
+	EventReactionRemoved = "reaction.removed"
+	// Sent to the followers of a thread when someone replies
+	EventThreadReply = "thread.reply"
+	// Sent to a conversation when a member reads up to a message
+	EventConversationRead = "conversation.read"
+	// Sent to a user added to or removed from a conversation
+	EventConversationJoined = "conversation.joined"
+	EventConversationLeft   = "conversation.left"
+	// Sent to a conversation when its name, description or visibility changes
+	EventConversationUpdated = "conversation.updated"
+	// Sent to a conversation when a member's role changes
+	EventMemberUpdated = "conversation.member_updated"
+	// Sent to a group's owner and admins when someone asks to join it
+	EventJoinRequested = "conversation.join_requested"
+	// Sent to a user when a reminder they set with /remind comes due
+	EventReminderDue = "reminder.due"
+)
+
+// Event is the envelope for every real-time event: {"id": "...", "type": "...", "data": {...}}.
+// ID is assigned on publish to events kept for replay.
+type Event struct {
+	ID   string      `json:"id,omitempty"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Transient reports whether the event is only useful live, so is not kept
+// for clients resuming a stream
+func (e Event) Transient() bool {
+	return e.Type == EventTyping || e.Type == EventPresence
+}
+
+// Publisher delivers events to connected clients, on whichever replica they
+// are connected to
+type Publisher interface {
+	// PublishToConversation sends an event to every member of a conversation
+	PublishToConversation(conversationID uint, event Event)
+	// PublishToUsers sends an event to every connection of the given users
+	PublishToUsers(userIDs []uint, event Event)
+}
+
+// TypingEvent is the data of a typing event
+type TypingEvent struct {
+	ConversationID uint `json:"conversation_id"`
+	UserID         uint `json:"user_id"`
+}
+
+// ReadEvent is the data of a conversation.read event
+type ReadEvent struct {
+	ConversationID    uint      `json:"conversation_id"`
+	UserID            uint      `json:"user_id"`
+	LastReadMessageID uint      `json:"last_read_message_id"`
+	LastReadAt        time.Time `json:"last_read_at"`
+}
+
+// ReactionEvent is the data of reaction.added and reaction.removed events.
+// Count is the number of users left with that reaction.
+type ReactionEvent struct {
+	ConversationID uint   `json:"conversation_id"`
+	MessageID      uint   `json:"message_id"`
+	UserID         uint   `json:"user_id"`
+	Emoji          string `json:"emoji"`
+	Count          int64  `json:"count"`
+}
+
+// ThreadReplyEvent is the data of a thread.reply event
+type ThreadReplyEvent struct {
+	ConversationID uint            `json:"conversation_id"`
+	ParentID       uint            `json:"parent_id"`
+	Message        *models.Message `json:"message"`
+}
+
+// MembershipEvent is the data of conversation.joined and conversation.left events
+type MembershipEvent struct {
+	ConversationID uint `json:"conversation_id"`
+}
+
+// MemberEvent is the data of a conversation.member_updated event
+type MemberEvent struct {
+	ConversationID uint   `json:"conversation_id"`
+	UserID         uint   `json:"user_id"`
+	Role           string `json:"role"`
+}
+
+// JoinRequestEvent is the data of a conversation.join_requested event
+type JoinRequestEvent struct {
+	ConversationID uint `json:"conversation_id"`
+	UserID         uint `json:"user_id"`
+}
+
+func membershipEvent(eventType string, conversationID uint) Event {
+	return Event{Type: eventType, Data: MembershipEvent{ConversationID: conversationID}}
+}
+
+// nopPublisher drops events, for services running without a gateway
+type nopPublisher struct{}
+
+func (nopPublisher) PublishToConversation(uint, Event) {}
+func (nopPublisher) PublishToUsers([]uint, Event)      {}
@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/pkg/redis"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Presence states
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+const (
+	presenceOnlinePrefix   = "presence_online:"
+	presenceAwayPrefix     = "presence_away:"
+	presenceLastSeenPrefix = "presence_last_seen:"
+	typingPrefix           = "typing:"
+
+	// presenceExpiryKey scores each user with a connection by the time the
+	// first of their heartbeats expires; presenceStateKey holds the presence
+	// last reported for each user who is not offline
+	presenceExpiryKey = "presence_expiry"
+	presenceStateKey  = "presence_state"
+
+	// PresenceTTL is how long a connection counts as present without a
+	// heartbeat. Connections refresh well within it.
+	PresenceTTL = 2 * time.Minute
+	// presenceSweepInterval is how often lapsed connections are looked for,
+	// and presenceSweepBatch how many users are handled at a time
+	presenceSweepInterval = 15 * time.Second
+	presenceSweepBatch    = 500
+	// TypingInterval is the shortest gap between typing events from one user
+	// in one conversation; clients should show the indicator for about twice
+	// as long after the last event
+	TypingInterval = 3 * time.Second
+)
+
+// presenceScriptLib is shared by the presence scripts. settle drops a user's
+// lapsed connections, records their presence and when it next needs
+// checking, and returns the presence last reported and the new one.
+const presenceScriptLib = `
+local function state(online, away)
+	if redis.call('ZCARD', online) > 0 then return 'online' end
+	if redis.call('ZCARD', away) > 0 then return 'away' end
+	return 'offline'
+end
+
+local function settle(online, away, id, now, expiryKey, stateKey)
+	redis.call('ZREMRANGEBYSCORE', online, '-inf', '(' .. now)
+	redis.call('ZREMRANGEBYSCORE', away, '-inf', '(' .. now)
+	local before = redis.call('HGET', stateKey, id) or 'offline'
+	local after = state(online, away)
+
+	local first = redis.call('ZRANGE', online, 0, 0, 'WITHSCORES')
+	local firstAway = redis.call('ZRANGE', away, 0, 0, 'WITHSCORES')
+	if #first == 0 or (#firstAway > 0 and tonumber(firstAway[2]) < tonumber(first[2])) then
+		first = firstAway
+	end
+	if #first > 0 then
+		redis.call('ZADD', expiryKey, first[2], id)
+		redis.call('HSET', stateKey, id, after)
+	else
+		redis.call('ZREM', expiryKey, id)
+		redis.call('HDEL', stateKey, id)
+	end
+	return before, after
+end
+`
+
+// updatePresenceScript moves a connection between the online and away sets
+// (or removes it), drops connections whose heartbeat has lapsed, and returns
+// the user's presence before and after. Each set scores connections by the
+// time their heartbeat expires.
+var updatePresenceScript = goredis.NewScript(presenceScriptLib + `
+local now = ARGV[1]
+redis.call('ZREM', KEYS[1], ARGV[3])
+redis.call('ZREM', KEYS[2], ARGV[3])
+if ARGV[4] == 'online' then
+	redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+elseif ARGV[4] == 'away' then
+	redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+end
+local before, after = settle(KEYS[1], KEYS[2], ARGV[6], now, KEYS[4], KEYS[5])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+redis.call('SET', KEYS[3], now)
+return {before, after}
+`)
+
+// sweepPresenceScript settles users whose first heartbeat has lapsed, so a
+// connection that vanished without closing, e.g. with a crashed replica,
+// still ends. It returns the user ID, new presence and last seen time of
+// each user whose presence changed. The key prefixes are passed in ARGV.
+var sweepPresenceScript = goredis.NewScript(presenceScriptLib + `
+local now = ARGV[1]
+local changed = {}
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. now, 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	local before, after = settle(ARGV[3] .. id, ARGV[4] .. id, id, now, KEYS[1], KEYS[2])
+	if before ~= after then
+		table.insert(changed, id)
+		table.insert(changed, after)
+		table.insert(changed, redis.call('GET', ARGV[5] .. id) or now)
+	end
+end
+return changed
+`)
+
+// PresenceInfo is a user's presence
+type PresenceInfo struct {
+	UserID     uint       `json:"user_id"`
+	State      string     `json:"state"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+}
+
+// updatePresence records a connection's state (PresenceOffline removes it) and
+// returns the user's overall presence before and after
+func updatePresence(ctx context.Context, userID uint, connID, state string) (before, after string, err error) {
+	if redis.Client == nil {
+		return "", "", fmt.Errorf("redis client not initialized")
+	}
+
+	id := strconv.FormatUint(uint64(userID), 10)
+	now := time.Now()
+	result, err := updatePresenceScript.Run(ctx, redis.Client,
+		[]string{presenceOnlinePrefix + id, presenceAwayPrefix + id, presenceLastSeenPrefix + id, presenceExpiryKey, presenceStateKey},
+		now.UnixMilli(), now.Add(PresenceTTL).UnixMilli(), connID, state, PresenceTTL.Milliseconds(), id,
+	).StringSlice()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to update presence: %w", err)
+	}
+	return result[0], result[1], nil
+}
+
+// sweepPresence settles up to limit users with lapsed connections and returns
+// those whose presence changed
+func sweepPresence(ctx context.Context, limit int) ([]PresenceInfo, error) {
+	if redis.Client == nil {
+		return nil, fmt.Errorf("redis client not initialized")
+	}
+
+	result, err := sweepPresenceScript.Run(ctx, redis.Client,
+		[]string{presenceExpiryKey, presenceStateKey},
+		time.Now().UnixMilli(), limit, presenceOnlinePrefix, presenceAwayPrefix, presenceLastSeenPrefix,
+	).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep presence: %w", err)
+	}
+
+	changed := make([]PresenceInfo, 0, len(result)/3)
+	for i := 0; i+2 < len(result); i += 3 {
+		userID, err := strconv.ParseUint(result[i], 10, 32)
+		if err != nil {
+			continue
+		}
+		info := PresenceInfo{UserID: uint(userID), State: result[i+1]}
+		if ms, err := strconv.ParseInt(result[i+2], 10, 64); err == nil {
+			t := time.UnixMilli(ms).UTC()
+			info.LastSeenAt = &t
+		}
+		changed = append(changed, info)
+	}
+	return changed, nil
+}
+
+// getPresence returns the presence of each user
+func getPresence(ctx context.Context, userIDs []uint) ([]PresenceInfo, error) {
+	if redis.Client == nil {
+		return nil, fmt.Errorf("redis client not initialized")
+	}
+
+	type reads struct {
+		online, away *goredis.IntCmd
+		lastSeen     *goredis.StringCmd
+	}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	cmds := make([]reads, len(userIDs))
+	_, err := redis.Client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		for i, userID := range userIDs {
+			id := strconv.FormatUint(uint64(userID), 10)
+			cmds[i] = reads{
+				online:   pipe.ZCount(ctx, presenceOnlinePrefix+id, now, "+inf"),
+				away:     pipe.ZCount(ctx, presenceAwayPrefix+id, now, "+inf"),
+				lastSeen: pipe.Get(ctx, presenceLastSeenPrefix+id),
+			}
+		}
+		return nil
+	})
+	if err != nil && err != goredis.Nil {
+		return nil, fmt.Errorf("failed to read presence: %w", err)
+	}
+
+	result := make([]PresenceInfo, len(userIDs))
+	for i, userID := range userIDs {
+		info := PresenceInfo{UserID: userID, State: PresenceOffline}
+		switch {
+		case cmds[i].online.Val() > 0:
+			info.State = PresenceOnline
+		case cmds[i].away.Val() > 0:
+			info.State = PresenceAway
+		}
+		if ms, err := cmds[i].lastSeen.Int64(); err == nil {
+			t := time.UnixMilli(ms).UTC()
+			info.LastSeenAt = &t
+		}
+		result[i] = info
+	}
+	return result, nil
+}
+
+// allowTyping reports whether a typing event may be sent now, reserving the
+// next TypingInterval for the user in that conversation
+func allowTyping(ctx context.Context, userID, conversationID uint) (bool, error) {
+	if redis.Client == nil {
+		return false, fmt.Errorf("redis client not initialized")
+	}
+
+	key := fmt.Sprintf("%s%d:%d", typingPrefix, conversationID, userID)
+	return redis.Client.SetNX(ctx, key, 1, TypingInterval).Result()
+}
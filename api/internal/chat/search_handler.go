@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// SearchResponse represents a page of search results, newest first
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *uint          `json:"next_cursor,omitempty"`
+}
+
+// SearchMessages searches the messages of the caller's conversations.
+// Query parameters: q, conversation_id, author_id, since, until (RFC 3339),
+// before, limit, and lang to override the caller's locale.
+func (h *Handler) SearchMessages(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+	before, limit, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	query := SearchQuery{Text: c.Query("q"), Locale: requestLocale(c)}
+	for param, dest := range map[string]*uint{"conversation_id": &query.ConversationID, "author_id": &query.AuthorID} {
+		if v := c.Query(param); v != "" {
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param})
+				return
+			}
+			*dest = uint(id)
+		}
+	}
+	for param, dest := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + param + ", expected RFC 3339"})
+				return
+			}
+			*dest = t
+		}
+	}
+
+	page, err := h.service.SearchMessages(userID, query, before, limit)
+	if err != nil {
+		respondError(c, err, "failed to search messages")
+		return
+	}
+
+	c.JSON(http.StatusOK, SearchResponse{Results: page.Results, NextCursor: page.NextCursor})
+}
+
+// requestLocale returns the caller's locale: the lang query parameter, then
+// the locale cookie the web app sets, then the first supported language in
+// Accept-Language, falling back to the default
+func requestLocale(c *gin.Context) string {
+	if v := c.Query("lang"); v != "" {
+		return searchLocale(v)
+	}
+	if v, err := c.Cookie("locale"); err == nil && v != "" {
+		return searchLocale(v)
+	}
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(tag, "-")
+		if locale := strings.ToLower(base); searchLocale(locale) == locale {
+			return locale
+		}
+	}
+	return DefaultLocale
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"gorm.io/gorm"
+)
+
+const (
+	// MaxSearchLength is the longest search query accepted, in bytes
+	MaxSearchLength = 256
+	// DefaultLocale is used when a request does not name a supported locale
+	DefaultLocale = "en"
+
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+
+	// ts_headline marks matches with these, then the snippet is HTML-escaped
+	// and they become <mark> tags. Control characters keep message text from
+	// producing markup.
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+var (
+	headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`,
+		highlightStart, highlightStop)
+	highlighter = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+)
+
+// SearchQuery is a full-text search of the messages in the caller's conversations
+type SearchQuery struct {
+	// Text uses web search syntax: "quoted phrases", or, and -excluded words
+	Text string
+	// Locale is the searcher's, which query words are stemmed for
+	Locale string
+
+	// Optional filters
+	ConversationID uint
+	AuthorID       uint
+	Since          time.Time // inclusive
+	Until          time.Time // exclusive
+}
+
+// SearchResult is a matching message with an excerpt of it. The snippet is
+// HTML with matched words in <mark> tags.
+type SearchResult struct {
+	Message models.Message `json:"message"`
+	Snippet string         `json:"snippet"`
+}
+
+// SearchPage is a page of search results, newest first
+type SearchPage struct {
+	Results    []SearchResult
+	NextCursor *uint // pass as before to get older results; nil on the last page
+}
+
+// searchRow is a message as selected by a search
+type searchRow struct {
+	models.Message
+	Snippet string
+}
+
+// SearchMessages finds messages, including thread replies, in the
+// conversations the user belongs to, newest first. Query words are stemmed
+// in the searcher's language and also matched exactly, so messages written in
+// other languages are found by their exact words.
+func (s *Service) SearchMessages(userID uint, q SearchQuery, before uint, limit int) (*SearchPage, error) {
+	text := strings.TrimSpace(q.Text)
+	if text == "" {
+		return nil, fmt.Errorf("%w: search text is required", ErrInvalid)
+	}
+	if len(text) > MaxSearchLength {
+		return nil, fmt.Errorf("%w: search text is too long (max %d bytes)", ErrInvalid, MaxSearchLength)
+	}
+	if limit < 1 || limit > maxSearchLimit {
+		limit = defaultSearchLimit
+	}
+
+	stemmed := gorm.Expr("websearch_to_tsquery(?::regconfig, ?)", models.SearchLanguages[searchLocale(q.Locale)], text)
+	exact := gorm.Expr("websearch_to_tsquery('simple', ?)", text)
+
+	query := s.db.Table("messages").
+		Select("messages.*, ts_headline("+models.SearchConfigSQL("messages.language")+", messages.body, ? || ?, ?) AS snippet",
+			stemmed, exact, headlineOptions).
+		Where("(messages.search_vector @@ ? OR messages.search_vector @@ ?)", stemmed, exact).
+		Where("messages.deleted_at IS NULL").
+		Where("messages.conversation_id IN (?)",
+			s.db.Model(&models.ConversationMember{}).Select("conversation_id").Where("user_id = ?", userID))
+	if q.ConversationID != 0 {
+		query = query.Where("messages.conversation_id = ?", q.ConversationID)
+	}
+	if q.AuthorID != 0 {
+		query = query.Where("messages.sender_id = ?", q.AuthorID)
+	}
+	if !q.Since.IsZero() {
+		query = query.Where("messages.created_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		query = query.Where("messages.created_at < ?", q.Until)
+	}
+	if before > 0 {
+		query = query.Where("messages.id < ?", before)
+	}
+
+	// Fetch one extra row to know whether there is another page
+	var rows []searchRow
+	if err := query.Order("messages.id DESC").Limit(limit + 1).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	page := &SearchPage{}
+	if len(rows) > limit {
+		rows = rows[:limit]
+		cursor := rows[limit-1].ID
+		page.NextCursor = &cursor
+	}
+
+	messages := make([]models.Message, len(rows))
+	for i, row := range rows {
+		messages[i] = row.Message
+	}
+	if err := s.decorate(userID, messages); err != nil {
+		return nil, err
+	}
+
+	page.Results = make([]SearchResult, len(rows))
+	for i, row := range rows {
+		page.Results[i] = SearchResult{
+			Message: messages[i],
+			Snippet: highlighter.Replace(html.EscapeString(row.Snippet)),
+		}
+	}
+	return page, nil
+}
+
+// searchLocale returns the locale if messages can be indexed in it, or the default
+func searchLocale(locale string) string {
+	if _, ok := models.SearchLanguages[locale]; ok {
+		return locale
+	}
+	return DefaultLocale
+}
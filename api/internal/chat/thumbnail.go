@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	// Formats thumbnails can be made from
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// ThumbnailSize bounds both sides of a thumbnail, in pixels
+	ThumbnailSize = 320
+	// maxThumbnailPixels refuses to decode larger images, which would take a
+	// lot of memory for a thumbnail
+	maxThumbnailPixels = 40_000_000
+)
+
+// thumbnailTypes are the content types thumbnails are made for
+var thumbnailTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// makeThumbnail decodes an image and returns a JPEG scaled to fit within
+// ThumbnailSize, along with the original dimensions. Transparent areas are
+// drawn on white.
+func makeThumbnail(r io.Reader) (thumb []byte, width, height int, err error) {
+	var buf bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &buf))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, cfg.Width, cfg.Height, fmt.Errorf("image too large for a thumbnail: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&buf, r))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bounds := src.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return nil, width, height, fmt.Errorf("empty image")
+	}
+
+	tw, th := width, height
+	if tw > ThumbnailSize || th > ThumbnailSize {
+		if tw >= th {
+			tw, th = ThumbnailSize, max(1, height*ThumbnailSize/width)
+		} else {
+			tw, th = max(1, width*ThumbnailSize/height), ThumbnailSize
+		}
+	}
+
+	// Scale first so only the thumbnail-sized image is copied
+	scaled := scaleDown(src, tw, th)
+	flat := image.NewRGBA(scaled.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), scaled, image.Point{}, draw.Over)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, flat, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return out.Bytes(), width, height, nil
+}
+
+// scaleDown resizes src to w x h by averaging the source pixels that fall in
+// each destination pixel. Transparency is kept, so the result can be drawn
+// over a background.
+func scaleDown(src image.Image, w, h int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	// The decoders' image types implement RGBA64At, which unlike At does not
+	// allocate per pixel
+	at := func(x, y int) color.RGBA64 {
+		r, g, b, a := src.At(x, y).RGBA()
+		return color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: uint16(a)}
+	}
+	if s, ok := src.(image.RGBA64Image); ok {
+		at = s.RGBA64At
+	}
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+
+			// Premultiplied values, so transparent pixels add no color
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					p := at(sb.Min.X+sx, sb.Min.Y+sy)
+					r += uint64(p.R)
+					g += uint64(p.G)
+					b += uint64(p.B)
+					a += uint64(p.A)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the client
+	writeWait = 10 * time.Second
+	// Time allowed between frames (pongs included) from the client
+	pongWait = 60 * time.Second
+	// Pings are sent often enough for a pong to arrive within pongWait
+	pingPeriod = pongWait * 9 / 10
+	// Largest frame accepted from the client
+	maxFrameSize = 8 << 10
+	// Events buffered per connection before it is treated as a slow consumer
+	sendBufferSize = 64
+)
+
+// client is one WebSocket connection or SSE stream. For WebSockets readPump
+// runs on the request goroutine and writePump on its own; only writePump
+// writes to the connection. SSE streams have no conn and drain send themselves.
+type client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	id     string
+	userID uint
+	claims *auth.Claims
+	send   chan []byte
+
+	// heartbeat, when set, is called periodically while the connection is open
+	heartbeat func()
+
+	stateMu sync.Mutex
+	state   string
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, userID uint, claims *auth.Claims) *client {
+	return &client{
+		hub:    hub,
+		conn:   conn,
+		id:     uuid.NewString(),
+		userID: userID,
+		claims: claims,
+		send:   make(chan []byte, sendBufferSize),
+		state:  chat.PresenceOnline,
+		done:   make(chan struct{}),
+	}
+}
+
+// presence returns the presence state the client last reported
+func (c *client) presence() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+func (c *client) setPresence(state string) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.state = state
+}
+
+// enqueue queues a frame without blocking. A client that has fallen a full
+// buffer behind is disconnected so it cannot hold up publishers.
+func (c *client) enqueue(msg []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+	default:
+		logger.Warn().Uint("user_id", c.userID).Msg("Disconnecting slow WebSocket client")
+		c.close(websocket.CloseTryAgainLater, "send buffer full")
+	}
+}
+
+// sendEvent queues a control event for this connection only
+func (c *client) sendEvent(eventType string, data interface{}) {
+	c.enqueue(encodeEvent(eventType, data))
+}
+
+// encodeEvent encodes a control event. Their data is always encodable.
+func encodeEvent(eventType string, data interface{}) []byte {
+	payload, _ := json.Marshal(chat.Event{Type: eventType, Data: data})
+	return payload
+}
+
+// close asks writePump to send a close frame and drop the connection
+func (c *client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// readPump reads frames until the connection fails or is closed, passing
+// each event to handle
+func (c *client) readPump(handle func(*client, inboundEvent)) {
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(maxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logger.Debug().Err(err).Uint("user_id", c.userID).Msg("WebSocket read failed")
+			}
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		var event inboundEvent
+		if err := json.Unmarshal(data, &event); err != nil || event.Type == "" {
+			c.sendEvent(eventError, errorEvent{Error: "invalid event"})
+			continue
+		}
+		handle(c, event)
+	}
+}
+
+// writePump delivers queued frames and heartbeats. It also ends the
+// connection when the access token expires or is revoked, so clients
+// reconnect with a fresh token.
+func (c *client) writePump() {
+	lifetime := time.Duration(1<<63 - 1)
+	if c.claims.ExpiresAt != nil {
+		lifetime = time.Until(c.claims.ExpiresAt.Time)
+	}
+	ping := time.NewTicker(pingPeriod)
+	expiry := time.NewTimer(lifetime)
+	defer func() {
+		ping.Stop()
+		expiry.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+
+		case <-ping.C:
+			revoked, err := auth.IsAccessTokenRevoked(context.Background(), c.claims)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to check access token revocation")
+			} else if revoked {
+				c.close(websocket.ClosePolicyViolation, "token has been revoked")
+				c.writeClose()
+				return
+			}
+			if c.heartbeat != nil {
+				c.heartbeat()
+			}
+
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+
+		case <-expiry.C:
+			c.close(websocket.ClosePolicyViolation, "token expired")
+			c.writeClose()
+			return
+
+		case <-c.done:
+			c.writeClose()
+			return
+		}
+	}
+}
+
+// writeClose sends the close frame chosen by close, if the connection is still usable
+func (c *client) writeClose() {
+	if c.closeCode == websocket.CloseAbnormalClosure {
+		return
+	}
+	msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
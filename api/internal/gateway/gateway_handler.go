@@ -0,0 +1,255 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Subprotocol is the protocol name negotiated with clients
+	Subprotocol = "chattycathy.v1"
+	// bearerProtocolPrefix marks a subprotocol entry carrying the access token
+	bearerProtocolPrefix = "bearer."
+	// Time a client has to send its auth frame when no token came with the upgrade
+	authTimeout = 10 * time.Second
+)
+
+// Control events exchanged with the client. Chat events use the types in the chat package.
+const (
+	eventAuth  = "auth"
+	eventReady = "ready"
+	eventError = "error"
+	eventPing  = "ping"
+	eventPong  = "pong"
+	eventReset = "reset"
+)
+
+var (
+	errInvalidToken = errors.New("invalid or expired token")
+	errForbidden    = errors.New("insufficient permissions")
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{Subprotocol},
+	// Connections authenticate with an explicit token rather than cookies,
+	// so a cross-origin page cannot open one on the user's behalf
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// inboundEvent is an event received from a client
+type inboundEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type errorEvent struct {
+	Error string `json:"error"`
+}
+
+type authEvent struct {
+	Token string `json:"token"`
+}
+
+type typingRequest struct {
+	ConversationID uint `json:"conversation_id"`
+}
+
+type presenceRequest struct {
+	State string `json:"state"`
+}
+
+// Handler serves live events over WebSocket connections and SSE streams
+type Handler struct {
+	hub  *Hub
+	chat *chat.Service
+}
+
+// NewHandler creates a new gateway handler
+func NewHandler(hub *Hub, chatService *chat.Service) *Handler {
+	return &Handler{hub: hub, chat: chatService}
+}
+
+// RegisterRoutes registers the WebSocket endpoint and the SSE fallback
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/ws", h.Connect)
+	router.GET("/events", middleware.JWTAuth(), middleware.RequirePermission("chat:read"), h.Stream)
+}
+
+// Connect upgrades the request to a WebSocket connection. The access token is
+// taken from the access_token query parameter, a "bearer.<token>" subprotocol
+// or, failing both, an auth event sent as the first frame.
+func (h *Handler) Connect(c *gin.Context) {
+	var claims *auth.Claims
+	if token := requestToken(c.Request); token != "" {
+		var err error
+		if claims, err = authenticate(c.Request.Context(), token); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, errForbidden) {
+				status = http.StatusForbidden
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		logger.Debug().Err(err).Msg("WebSocket upgrade failed")
+		return
+	}
+
+	if claims == nil {
+		if claims, err = authenticateFirstFrame(conn); err != nil {
+			msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			conn.Close()
+			return
+		}
+	}
+	c.Set(middleware.ClaimsKey, claims)
+
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	conversationIDs, err := h.chat.ConversationIDs(userID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load conversations for WebSocket client")
+		msg := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "")
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
+
+	client := newClient(h.hub, conn, userID, claims)
+	defer h.attach(client, conversationIDs)()
+
+	client.sendEvent(eventReady, gin.H{"user_id": client.userID, "session_id": claims.SessionID})
+	go client.writePump()
+	client.readPump(h.handleEvent)
+}
+
+// attach registers a client with the hub and records it as present, keeping
+// its presence fresh on every heartbeat. The returned func detaches it again.
+func (h *Handler) attach(c *client, conversationIDs []uint) func() {
+	h.hub.register(c, conversationIDs)
+	h.setPresence(c, c.presence())
+	c.heartbeat = func() { h.setPresence(c, c.presence()) }
+
+	return func() {
+		h.hub.unregister(c)
+		h.setPresence(c, chat.PresenceOffline)
+	}
+}
+
+func (h *Handler) setPresence(c *client, state string) {
+	if err := h.chat.SetPresence(context.Background(), c.userID, c.id, state); err != nil {
+		logger.Error().Err(err).Uint("user_id", c.userID).Msg("Failed to update presence")
+	}
+}
+
+// handleEvent dispatches an event sent by a client
+func (h *Handler) handleEvent(c *client, event inboundEvent) {
+	switch event.Type {
+	case eventPing:
+		c.sendEvent(eventPong, nil)
+
+	case chat.EventTyping:
+		var req typingRequest
+		if err := json.Unmarshal(event.Data, &req); err != nil || req.ConversationID == 0 {
+			c.sendEvent(eventError, errorEvent{Error: "conversation_id is required"})
+			return
+		}
+		if !c.claims.HasPermission("chat:write") {
+			c.sendEvent(eventError, errorEvent{Error: errForbidden.Error()})
+			return
+		}
+		if err := h.chat.Typing(context.Background(), c.userID, req.ConversationID); err != nil {
+			if errors.Is(err, chat.ErrNotFound) {
+				c.sendEvent(eventError, errorEvent{Error: "conversation not found"})
+				return
+			}
+			logger.Error().Err(err).Msg("Failed to publish typing event")
+		}
+
+	case chat.EventPresence:
+		var req presenceRequest
+		_ = json.Unmarshal(event.Data, &req)
+		if req.State != chat.PresenceOnline && req.State != chat.PresenceAway {
+			c.sendEvent(eventError, errorEvent{Error: "state must be online or away"})
+			return
+		}
+		c.setPresence(req.State)
+		h.setPresence(c, req.State)
+
+	default:
+		c.sendEvent(eventError, errorEvent{Error: "unknown event type"})
+	}
+}
+
+// requestToken returns the access token sent with the upgrade request, if any
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, bearerProtocolPrefix) {
+			return strings.TrimPrefix(protocol, bearerProtocolPrefix)
+		}
+	}
+	return ""
+}
+
+// authenticateFirstFrame waits for the client's auth event
+func authenticateFirstFrame(conn *websocket.Conn) (*auth.Claims, error) {
+	conn.SetReadLimit(maxFrameSize)
+	_ = conn.SetReadDeadline(time.Now().Add(authTimeout))
+
+	var event inboundEvent
+	if err := conn.ReadJSON(&event); err != nil || event.Type != eventAuth {
+		return nil, errors.New("authentication required")
+	}
+	var data authEvent
+	if err := json.Unmarshal(event.Data, &data); err != nil || data.Token == "" {
+		return nil, errors.New("authentication required")
+	}
+	return authenticate(context.Background(), data.Token)
+}
+
+// authenticate validates an access token the same way middleware.JWTAuth does
+// and requires chat:read, since chat events are all a connection receives
+func authenticate(ctx context.Context, token string) (*auth.Claims, error) {
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	// If Redis is unavailable the signature and expiry checks still apply
+	revoked, err := auth.IsAccessTokenRevoked(ctx, claims)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to check access token revocation")
+	} else if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+
+	if !claims.HasPermission("chat:read") {
+		return nil, errForbidden
+	}
+	return claims, nil
+}
@@ -0,0 +1,353 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/redis"
+	"github.com/gorilla/websocket"
+)
+
+// Broker channel prefixes. Events for a conversation go to one channel that
+// every replica with a connected member subscribes to; events for a user go
+// to that user's channel.
+const (
+	conversationChannelPrefix = "events:conversation:"
+	userChannelPrefix         = "events:user:"
+)
+
+func conversationChannel(id uint) string {
+	return conversationChannelPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+func userChannel(id uint) string {
+	return userChannelPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+// Hub tracks the WebSocket connections and event streams on this server. Events are published
+// through the broker and relayed by every replica to its own connections.
+type Hub struct {
+	broker  redis.Broker
+	backlog redis.Backlog
+
+	mu            sync.RWMutex
+	clients       map[uint]map[*client]struct{} // user -> connections
+	memberships   map[uint]map[uint]struct{}    // connected user -> conversations
+	conversations map[uint]map[uint]struct{}    // conversation -> connected users
+
+	// subMu serialises changes to broker subscriptions so a quick disconnect
+	// and reconnect cannot leave a channel unsubscribed
+	subMu sync.Mutex
+}
+
+// NewHub creates an empty hub publishing through broker and keeping events
+// for replay in backlog
+func NewHub(broker redis.Broker, backlog redis.Backlog) *Hub {
+	return &Hub{
+		broker:        broker,
+		backlog:       backlog,
+		clients:       make(map[uint]map[*client]struct{}),
+		memberships:   make(map[uint]map[uint]struct{}),
+		conversations: make(map[uint]map[uint]struct{}),
+	}
+}
+
+// PublishToConversation sends an event to every member of a conversation
+func (h *Hub) PublishToConversation(conversationID uint, event chat.Event) {
+	h.publish(event, conversationChannel(conversationID))
+}
+
+// PublishToUsers sends an event to every connection of the given users
+func (h *Hub) PublishToUsers(userIDs []uint, event chat.Event) {
+	channels := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		channels[i] = userChannel(id)
+	}
+	h.publish(event, channels...)
+}
+
+// publish sends an event to channels. Events other than transient ones are
+// first added to each channel's backlog, which assigns their ID.
+func (h *Hub) publish(event chat.Event, channels ...string) {
+	ctx := context.Background()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error().Err(err).Str("type", event.Type).Msg("Failed to encode event")
+		return
+	}
+
+	for _, ch := range channels {
+		msg := payload
+		if !event.Transient() {
+			id, err := h.backlog.Append(ctx, ch, payload)
+			if err != nil {
+				logger.Error().Err(err).Str("channel", ch).Msg("Failed to add event to backlog")
+			} else if msg, err = withID(payload, id); err != nil {
+				logger.Error().Err(err).Str("type", event.Type).Msg("Failed to encode event")
+				continue
+			}
+		}
+		if err := h.broker.Publish(ctx, ch, msg); err != nil {
+			logger.Error().Err(err).Str("channel", ch).Msg("Failed to publish event")
+		}
+	}
+}
+
+// replay returns the events a user missed after lastEventID, oldest first.
+// complete is false when some are no longer in the backlog.
+func (h *Hub) replay(ctx context.Context, userID uint, conversationIDs []uint, lastEventID string) ([][]byte, bool, error) {
+	channels := []string{userChannel(userID)}
+	for _, id := range conversationIDs {
+		channels = append(channels, conversationChannel(id))
+	}
+
+	entries, complete, err := h.backlog.Since(ctx, channels, lastEventID)
+	if err != nil || !complete {
+		return nil, complete, err
+	}
+
+	payloads := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		msg, err := withID(e.Payload, e.ID)
+		if err != nil {
+			return nil, false, err
+		}
+		payloads = append(payloads, msg)
+	}
+	return payloads, true, nil
+}
+
+// withID sets the ID of an encoded event
+func withID(payload []byte, id string) ([]byte, error) {
+	var event struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data,omitempty"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return json.Marshal(chat.Event{ID: id, Type: event.Type, Data: event.Data})
+}
+
+// Run relays broker messages to local connections until the broker is closed
+func (h *Hub) Run() {
+	for msg := range h.broker.Messages() {
+		switch {
+		case strings.HasPrefix(msg.Channel, conversationChannelPrefix):
+			id, err := strconv.ParseUint(strings.TrimPrefix(msg.Channel, conversationChannelPrefix), 10, 32)
+			if err == nil {
+				h.deliver(h.conversationClients(uint(id)), msg.Payload)
+			}
+
+		case strings.HasPrefix(msg.Channel, userChannelPrefix):
+			id, err := strconv.ParseUint(strings.TrimPrefix(msg.Channel, userChannelPrefix), 10, 32)
+			if err == nil {
+				h.trackMembership(uint(id), msg.Payload)
+				h.deliver(h.userClients(uint(id)), msg.Payload)
+			}
+		}
+	}
+}
+
+// Shutdown disconnects every client, telling them to reconnect elsewhere
+func (h *Hub) Shutdown() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, conns := range h.clients {
+		for c := range conns {
+			c.close(websocket.CloseGoingAway, "server shutting down")
+		}
+	}
+}
+
+func (h *Hub) deliver(targets []*client, payload []byte) {
+	for _, c := range targets {
+		c.enqueue(payload)
+	}
+}
+
+func (h *Hub) userClients(userID uint) []*client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var targets []*client
+	for c := range h.clients[userID] {
+		targets = append(targets, c)
+	}
+	return targets
+}
+
+func (h *Hub) conversationClients(conversationID uint) []*client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var targets []*client
+	for userID := range h.conversations[conversationID] {
+		for c := range h.clients[userID] {
+			targets = append(targets, c)
+		}
+	}
+	return targets
+}
+
+// trackMembership follows a connected user into or out of a conversation
+// when their user channel announces the change
+func (h *Hub) trackMembership(userID uint, payload []byte) {
+	var event struct {
+		Type string               `json:"type"`
+		Data chat.MembershipEvent `json:"data"`
+	}
+	if json.Unmarshal(payload, &event) != nil {
+		return
+	}
+
+	switch event.Type {
+	case chat.EventConversationJoined:
+		h.subscribe(userID, event.Data.ConversationID)
+	case chat.EventConversationLeft:
+		h.unsubscribe(userID, event.Data.ConversationID)
+	}
+}
+
+// register adds a connection. The user's first connection on this server
+// subscribes their channels.
+func (h *Hub) register(c *client, conversationIDs []uint) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	conns, ok := h.clients[c.userID]
+	if !ok {
+		conns = make(map[*client]struct{})
+		h.clients[c.userID] = conns
+	}
+	conns[c] = struct{}{}
+
+	var channels []string
+	if len(conns) == 1 {
+		channels = append(channels, userChannel(c.userID))
+		h.memberships[c.userID] = make(map[uint]struct{}, len(conversationIDs))
+		for _, id := range conversationIDs {
+			if h.addMember(c.userID, id) {
+				channels = append(channels, conversationChannel(id))
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	h.brokerSubscribe(channels)
+}
+
+// unregister removes a connection. When it was the user's last on this
+// server, channels no other local user needs are unsubscribed.
+func (h *Hub) unregister(c *client) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	conns, ok := h.clients[c.userID]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	delete(conns, c)
+	if len(conns) > 0 {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.clients, c.userID)
+
+	channels := []string{userChannel(c.userID)}
+	for id := range h.memberships[c.userID] {
+		if h.removeMember(c.userID, id) {
+			channels = append(channels, conversationChannel(id))
+		}
+	}
+	delete(h.memberships, c.userID)
+	h.mu.Unlock()
+
+	h.brokerUnsubscribe(channels)
+}
+
+// subscribe adds a conversation for a connected user
+func (h *Hub) subscribe(userID, conversationID uint) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	subscribe := false
+	if _, ok := h.memberships[userID]; ok {
+		subscribe = h.addMember(userID, conversationID)
+	}
+	h.mu.Unlock()
+
+	if subscribe {
+		h.brokerSubscribe([]string{conversationChannel(conversationID)})
+	}
+}
+
+// unsubscribe removes a conversation for a connected user
+func (h *Hub) unsubscribe(userID, conversationID uint) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	h.mu.Lock()
+	unsubscribe := false
+	if _, ok := h.memberships[userID][conversationID]; ok {
+		unsubscribe = h.removeMember(userID, conversationID)
+	}
+	h.mu.Unlock()
+
+	if unsubscribe {
+		h.brokerUnsubscribe([]string{conversationChannel(conversationID)})
+	}
+}
+
+// addMember records a local member of a conversation and reports whether the
+// conversation had none before. Callers hold mu.
+func (h *Hub) addMember(userID, conversationID uint) bool {
+	h.memberships[userID][conversationID] = struct{}{}
+	users, ok := h.conversations[conversationID]
+	if !ok {
+		users = make(map[uint]struct{})
+		h.conversations[conversationID] = users
+	}
+	users[userID] = struct{}{}
+	return len(users) == 1
+}
+
+// removeMember forgets a local member of a conversation and reports whether
+// the conversation has none left. Callers hold mu.
+func (h *Hub) removeMember(userID, conversationID uint) bool {
+	delete(h.memberships[userID], conversationID)
+	users := h.conversations[conversationID]
+	delete(users, userID)
+	if len(users) > 0 {
+		return false
+	}
+	delete(h.conversations, conversationID)
+	return true
+}
+
+func (h *Hub) brokerSubscribe(channels []string) {
+	if len(channels) == 0 {
+		return
+	}
+	if err := h.broker.Subscribe(context.Background(), channels...); err != nil {
+		logger.Error().Err(err).Strs("channels", channels).Msg("Failed to subscribe to event channels")
+	}
+}
+
+func (h *Hub) brokerUnsubscribe(channels []string) {
+	if len(channels) == 0 {
+		return
+	}
+	if err := h.broker.Unsubscribe(context.Background(), channels...); err != nil {
+		logger.Error().Err(err).Strs("channels", channels).Msg("Failed to unsubscribe from event channels")
+	}
+}
@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/chattycathy/api/pkg/redis"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Comment lines sent this often keep proxies from closing idle streams
+	keepAlivePeriod = 30 * time.Second
+	// Reconnect delay suggested to EventSource clients, in milliseconds
+	retryMillis = 3000
+)
+
+// Stream sends the same events as the WebSocket as Server-Sent Events, for
+// clients behind proxies that strip WebSocket upgrades. A client resuming with
+// Last-Event-ID receives the events it missed, or a reset event when they are
+// no longer in the backlog and it should reload over the REST API.
+func (h *Handler) Stream(c *gin.Context) {
+	claims, _ := middleware.GetClaims(c)
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	conversationIDs, err := h.chat.ConversationIDs(userID)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load conversations for event stream")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open event stream"})
+		return
+	}
+
+	// The server's ReadTimeout and WriteTimeout would end the stream after a
+	// few seconds; each write sets its own deadline instead
+	rc := http.NewResponseController(c.Writer)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		logger.Warn().Err(err).Msg("Failed to clear read deadline for event stream")
+	}
+
+	client := newClient(h.hub, nil, userID, claims)
+	defer h.attach(client, conversationIDs)()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(format string, args ...interface{}) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeWait))
+		if _, err := fmt.Fprintf(c.Writer, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !write("retry: %d\n\n", retryMillis) {
+		return
+	}
+	if !writeSSE(write, encodeEvent(eventReady, gin.H{"user_id": client.userID, "session_id": claims.SessionID})) {
+		return
+	}
+
+	// Replay what the client missed. Live events queued meanwhile that were
+	// also replayed are skipped.
+	var replayedID string
+	if lastEventID := lastEventID(c); lastEventID != "" {
+		payloads, complete, err := h.hub.replay(c.Request.Context(), client.userID, conversationIDs, lastEventID)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to replay events")
+		}
+		if err != nil || !complete {
+			if !writeSSE(write, encodeEvent(eventReset, nil)) {
+				return
+			}
+		}
+		for _, payload := range payloads {
+			if !writeSSE(write, payload) {
+				return
+			}
+		}
+		replayedID = lastEventID
+		if len(payloads) > 0 {
+			replayedID = eventID(payloads[len(payloads)-1])
+		}
+	}
+
+	keepAlive := time.NewTicker(keepAlivePeriod)
+	defer keepAlive.Stop()
+	lifetime := time.Duration(1<<63 - 1)
+	if claims.ExpiresAt != nil {
+		lifetime = time.Until(claims.ExpiresAt.Time)
+	}
+	expiry := time.NewTimer(lifetime)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case payload := <-client.send:
+			if replayedID != "" {
+				if id := eventID(payload); id != "" && redis.CompareIDs(id, replayedID) <= 0 {
+					continue
+				}
+			}
+			if !writeSSE(write, payload) {
+				return
+			}
+
+		case <-keepAlive.C:
+			revoked, err := auth.IsAccessTokenRevoked(c.Request.Context(), claims)
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to check access token revocation")
+			} else if revoked {
+				return
+			}
+			if client.heartbeat != nil {
+				client.heartbeat()
+			}
+			if !write(": keep-alive\n\n") {
+				return
+			}
+
+		case <-expiry.C:
+			// The client reconnects with a fresh token and Last-Event-ID
+			return
+
+		case <-client.done:
+			return
+
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes an encoded event as an SSE message, using its ID as the
+// message ID so the browser sends it back as Last-Event-ID
+func writeSSE(write func(string, ...interface{}) bool, payload []byte) bool {
+	if id := eventID(payload); id != "" {
+		return write("id: %s\ndata: %s\n\n", id, payload)
+	}
+	return write("data: %s\n\n", payload)
+}
+
+// lastEventID returns the ID to resume from, from the Last-Event-ID header or,
+// for clients that cannot set headers, the last_event_id query parameter
+func lastEventID(c *gin.Context) string {
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.Query("last_event_id")
+}
+
+// eventID returns the ID of an encoded event, if it has one
+func eventID(payload []byte) string {
+	var event struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(payload, &event)
+	return event.ID
+}
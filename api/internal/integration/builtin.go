@@ -0,0 +1,315 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/pkg/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxPendingReminders caps how many reminders a user can have waiting
+	MaxPendingReminders = 50
+	// MinReminderDelay and MaxReminderDelay bound how far ahead a reminder can be set
+	MinReminderDelay = time.Minute
+	MaxReminderDelay = 365 * 24 * time.Hour
+	// MaxPollOptions caps the options of a poll, one per number emoji
+	MaxPollOptions = 10
+
+	reminderInterval  = 15 * time.Second
+	reminderBatchSize = 100
+
+	remindUsage = "<when> <text> | list | cancel <id>"
+	pollUsage   = `"question" "option" "option" ...`
+)
+
+// builtin is a slash command implemented by the server
+type builtin struct {
+	description string
+	usage       string
+	run         func(s *Service, inv chat.CommandInvocation) (*chat.CommandResult, error)
+}
+
+var builtins = map[string]builtin{
+	"remind": {
+		description: "Set a reminder, or list and cancel your reminders",
+		usage:       remindUsage,
+		run:         (*Service).remind,
+	},
+	"poll": {
+		description: "Post a poll members vote on with reactions",
+		usage:       pollUsage,
+		run:         (*Service).poll,
+	},
+}
+
+// builtinNames lists the built-in commands in the order they are shown
+var builtinNames = []string{"poll", "remind"}
+
+// IsBuiltin reports whether name is a built-in command, which external
+// commands cannot replace
+func IsBuiltin(name string) bool {
+	_, ok := builtins[name]
+	return ok
+}
+
+// remind sets a reminder: "/remind 2h30m stand-up notes", "/remind list" or
+// "/remind cancel 12". Replies are shown only to the user.
+func (s *Service) remind(inv chat.CommandInvocation) (*chat.CommandResult, error) {
+	first, rest, _ := strings.Cut(inv.Args, " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(first) {
+	case "", "help":
+		return ephemeral("Usage: /remind " + remindUsage + `, e.g. "/remind 1h30m check the build". Use d, h and m for days, hours and minutes.`), nil
+	case "list":
+		return s.listReminders(inv.UserID)
+	case "cancel":
+		return s.cancelReminder(inv.UserID, rest)
+	}
+
+	delay, ok := parseDelay(first)
+	if !ok {
+		return ephemeral(`Could not read "` + first + `" as a time; use d, h and m, e.g. 1d, 2h or 1h30m.`), nil
+	}
+	if delay < MinReminderDelay || delay > MaxReminderDelay {
+		return ephemeral("Reminders can be set from a minute to a year ahead."), nil
+	}
+	if rest == "" {
+		return ephemeral("What should I remind you about? e.g. /remind " + first + " check the build"), nil
+	}
+	if len(rest) > chat.MaxMessageLength {
+		return nil, fmt.Errorf("%w: reminder must be at most %d bytes", chat.ErrInvalid, chat.MaxMessageLength)
+	}
+
+	reminder := models.Reminder{
+		UserID:         inv.UserID,
+		ConversationID: inv.ConversationID,
+		Text:           rest,
+		DueAt:          time.Now().Add(delay).UTC(),
+	}
+	full := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the user's row so concurrent commands cannot pass the cap together
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&models.User{}, inv.UserID).Error; err != nil {
+			return err
+		}
+		var pending int64
+		if err := tx.Model(&models.Reminder{}).Where("user_id = ? AND sent_at IS NULL", inv.UserID).Count(&pending).Error; err != nil {
+			return err
+		}
+		if pending >= MaxPendingReminders {
+			full = true
+			return nil
+		}
+		return tx.Create(&reminder).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if full {
+		return ephemeral(fmt.Sprintf("You already have %d reminders waiting; cancel one first.", MaxPendingReminders)), nil
+	}
+
+	return ephemeral(fmt.Sprintf("Reminder #%d set for %s: %s", reminder.ID, formatTime(reminder.DueAt), reminder.Text)), nil
+}
+
+// listReminders describes a user's pending reminders, soonest first
+func (s *Service) listReminders(userID uint) (*chat.CommandResult, error) {
+	var reminders []models.Reminder
+	if err := s.db.Where("user_id = ? AND sent_at IS NULL", userID).Order("due_at").Find(&reminders).Error; err != nil {
+		return nil, err
+	}
+	if len(reminders) == 0 {
+		return ephemeral("You have no reminders waiting."), nil
+	}
+
+	var b strings.Builder
+	b.WriteString("Your reminders:")
+	for _, r := range reminders {
+		fmt.Fprintf(&b, "\n#%d %s: %s", r.ID, formatTime(r.DueAt), r.Text)
+	}
+	return ephemeral(b.String()), nil
+}
+
+// cancelReminder deletes one of a user's pending reminders
+func (s *Service) cancelReminder(userID uint, arg string) (*chat.CommandResult, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(arg, "#"), 10, 32)
+	if err != nil {
+		return ephemeral("Usage: /remind cancel <id>; see /remind list for the IDs."), nil
+	}
+
+	result := s.db.Where("id = ? AND user_id = ? AND sent_at IS NULL", id, userID).Delete(&models.Reminder{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ephemeral(fmt.Sprintf("You have no reminder #%d waiting.", id)), nil
+	}
+	return ephemeral(fmt.Sprintf("Reminder #%d cancelled.", id)), nil
+}
+
+// RemindersLoop sends reminders as they come due until the context is
+// cancelled. Reminders are claimed with SKIP LOCKED, so every replica can run it.
+func (s *Service) RemindersLoop(ctx context.Context) {
+	ticker := time.NewTicker(reminderInterval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while there is a backlog
+		for s.sendReminders() == reminderBatchSize && ctx.Err() == nil {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendReminders marks a batch of due reminders sent and tells their users,
+// returning how many there were
+func (s *Service) sendReminders() int {
+	var reminders []models.Reminder
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("sent_at IS NULL AND due_at <= ?", now).
+			Order("due_at").
+			Limit(reminderBatchSize).
+			Find(&reminders).Error
+		if err != nil || len(reminders) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(reminders))
+		for i := range reminders {
+			ids[i] = reminders[i].ID
+			reminders[i].SentAt = &now
+		}
+		return tx.Model(&models.Reminder{}).Where("id IN ?", ids).Update("sent_at", now).Error
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to send reminders")
+		return 0
+	}
+
+	for i := range reminders {
+		s.publisher.PublishToUsers([]uint{reminders[i].UserID}, chat.Event{Type: chat.EventReminderDue, Data: reminders[i]})
+	}
+	return len(reminders)
+}
+
+// poll posts a poll as the user: the question, then the options numbered with
+// emoji that members react with to vote
+func (s *Service) poll(inv chat.CommandInvocation) (*chat.CommandResult, error) {
+	args, ok := splitArgs(inv.Args)
+	usage := "Usage: /poll " + pollUsage + `, e.g. /poll "Lunch?" "Pizza" "Sushi"`
+	if !ok || len(args) < 3 {
+		return ephemeral(usage), nil
+	}
+	if len(args) > MaxPollOptions+1 {
+		return ephemeral(fmt.Sprintf("A poll can have at most %d options.", MaxPollOptions)), nil
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return ephemeral(usage), nil
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("📊 " + args[0])
+	for i, option := range args[1:] {
+		b.WriteString("\n" + pollEmoji[i] + " " + option)
+	}
+	b.WriteString("\nReact with an option's number to vote.")
+
+	msg, err := s.chat.PostMessage(inv.UserID, inv.ConversationID, chat.MessageInput{
+		Body:     b.String(),
+		ParentID: inv.ParentID,
+		Language: inv.Language,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &chat.CommandResult{Message: msg}, nil
+}
+
+var pollEmoji = [MaxPollOptions]string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+// parseDelay reads a delay made of days, hours and minutes, such as "2d",
+// "90m" or "1h30m"
+func parseDelay(s string) (time.Duration, bool) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return 0, false
+	}
+	var total time.Duration
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+		if i <= 0 || i > 6 {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(s[:i])
+		var unit time.Duration
+		switch s[i] {
+		case 'd':
+			unit = 24 * time.Hour
+		case 'h':
+			unit = time.Hour
+		case 'm':
+			unit = time.Minute
+		default:
+			return 0, false
+		}
+		total += time.Duration(n) * unit
+		s = s[i+1:]
+	}
+	return total, true
+}
+
+// splitArgs splits a command's arguments on spaces, keeping text in straight
+// or curly double quotes together. ok is false when a quote is not closed.
+func splitArgs(s string) (args []string, ok bool) {
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		switch {
+		case unicode.IsSpace(rs[i]):
+			i++
+		case rs[i] == '"' || rs[i] == '“':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' && rs[j] != '”' {
+				j++
+			}
+			if j == len(rs) {
+				return nil, false
+			}
+			args = append(args, strings.TrimSpace(string(rs[i+1:j])))
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) {
+				j++
+			}
+			args = append(args, string(rs[i:j]))
+			i = j
+		}
+	}
+	return args, true
+}
+
+func ephemeral(text string) *chat.CommandResult {
+	return &chat.CommandResult{Text: text}
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("Mon 2 Jan 2006 15:04 MST")
+}
@@ -0,0 +1,131 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/internal/webhook"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxResponseSize caps how much of an external command's answer is read
+	maxResponseSize = 64 << 10
+
+	// ResponseEphemeral shows a command's answer only to the invoker;
+	// ResponseInChannel posts it to the conversation as the command's bot
+	ResponseEphemeral = "ephemeral"
+	ResponseInChannel = "in_channel"
+)
+
+// CommandRequest is the JSON body posted to an external command's URL. It is
+// signed like an outbound webhook, with the command's secret.
+type CommandRequest struct {
+	ID             string `json:"id"`
+	Command        string `json:"command"`
+	Text           string `json:"text"`
+	UserID         uint   `json:"user_id"`
+	ConversationID uint   `json:"conversation_id"`
+	ParentID       uint   `json:"parent_id,omitempty"`
+}
+
+// CommandResponse is what an external command answers with. An empty body is
+// taken as an empty ephemeral reply.
+type CommandResponse struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"` // ephemeral (the default) or in_channel
+}
+
+// runExternal posts an invocation to a command's endpoint and acts on the
+// answer. A command that fails or cannot be reached gets an ephemeral error
+// reply rather than failing the request.
+func (s *Service) runExternal(ctx context.Context, cmd *models.SlashCommand, inv chat.CommandInvocation) (*chat.CommandResult, error) {
+	resp, err := s.callCommand(ctx, cmd, inv)
+	if err != nil {
+		logger.Warn().Err(err).Str("command", cmd.Name).Msg("Slash command failed")
+		return ephemeral(fmt.Sprintf("/%s did not respond. Try again later.", cmd.Name)), nil
+	}
+	if resp.ResponseType != ResponseInChannel || resp.Text == "" {
+		return ephemeral(resp.Text), nil
+	}
+
+	if _, err := s.activeBot(cmd.BotID); err != nil {
+		if errors.Is(err, chat.ErrInvalid) {
+			return ephemeral(fmt.Sprintf("/%s cannot post: its bot is not available.", cmd.Name)), nil
+		}
+		return nil, err
+	}
+	msg, err := s.chat.PostMessage(cmd.BotID, inv.ConversationID, chat.MessageInput{
+		Body:     resp.Text,
+		ParentID: inv.ParentID,
+		Language: inv.Language,
+	})
+	switch {
+	case errors.Is(err, chat.ErrNotFound):
+		return ephemeral(fmt.Sprintf("/%s cannot post here until its bot is added to the conversation.", cmd.Name)), nil
+	case errors.Is(err, chat.ErrInvalid), errors.Is(err, chat.ErrMessageNotFound):
+		logger.Warn().Err(err).Str("command", cmd.Name).Msg("Slash command reply rejected")
+		return ephemeral(fmt.Sprintf("/%s replied with a message that could not be posted.", cmd.Name)), nil
+	case err != nil:
+		return nil, err
+	}
+	return &chat.CommandResult{Message: msg}, nil
+}
+
+// callCommand sends a signed invocation to a command's URL and decodes the answer
+func (s *Service) callCommand(ctx context.Context, cmd *models.SlashCommand, inv chat.CommandInvocation) (*CommandResponse, error) {
+	body, err := json.Marshal(CommandRequest{
+		ID:             uuid.NewString(),
+		Command:        cmd.Name,
+		Text:           inv.Args,
+		UserID:         inv.UserID,
+		ConversationID: inv.ConversationID,
+		ParentID:       inv.ParentID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cmd.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChattyCathy-Commands/1.0")
+	req.Header.Set(webhook.SignatureHeader, webhook.Sign(cmd.Secret, time.Now(), body))
+
+	httpResp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		return nil, fmt.Errorf("endpoint answered %d", httpResp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseSize {
+		return nil, errors.New("response too large")
+	}
+
+	var resp CommandResponse
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &resp, nil
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/redis"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// rateWindow is the window the per-minute rate limits are counted over
+const rateWindow = time.Minute
+
+// Config holds integration settings. Zero values take the defaults.
+type Config struct {
+	CommandTimeout   time.Duration // how long an external command may take to answer; default 5s
+	CommandRateLimit int           // commands a user may run per minute; default 20
+	WebhookRateLimit int           // messages an incoming webhook may post per minute; default 60
+}
+
+// Service runs slash commands, built-in and external, and posts the messages
+// of incoming webhooks
+type Service struct {
+	db        *gorm.DB
+	chat      *chat.Service
+	publisher chat.Publisher
+	client    *http.Client
+	cfg       Config
+}
+
+// NewService creates an integration service. Messages are posted through the
+// chat service; reminders are sent to publisher.
+func NewService(db *gorm.DB, chatService *chat.Service, publisher chat.Publisher, cfg Config) *Service {
+	if cfg.CommandTimeout <= 0 {
+		cfg.CommandTimeout = 5 * time.Second
+	}
+	if cfg.CommandRateLimit <= 0 {
+		cfg.CommandRateLimit = 20
+	}
+	if cfg.WebhookRateLimit <= 0 {
+		cfg.WebhookRateLimit = 60
+	}
+
+	client := &http.Client{
+		Timeout: cfg.CommandTimeout,
+		// A redirect is a failed command, not a new endpoint
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Service{db: db, chat: chatService, publisher: publisher, client: client, cfg: cfg}
+}
+
+// CommandInfo describes a slash command to the people who can run it
+type CommandInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Usage       string `json:"usage"`
+	Builtin     bool   `json:"builtin"`
+}
+
+// ListCommands returns the built-in commands followed by the active external ones
+func (s *Service) ListCommands() ([]CommandInfo, error) {
+	var external []models.SlashCommand
+	if err := s.db.Where("active").Order("name").Find(&external).Error; err != nil {
+		return nil, err
+	}
+
+	commands := make([]CommandInfo, 0, len(builtinNames)+len(external))
+	for _, name := range builtinNames {
+		b := builtins[name]
+		commands = append(commands, CommandInfo{Name: name, Description: b.description, Usage: b.usage, Builtin: true})
+	}
+	for _, cmd := range external {
+		commands = append(commands, CommandInfo{Name: cmd.Name, Description: cmd.Description, Usage: cmd.Usage})
+	}
+	return commands, nil
+}
+
+// RunCommand runs a built-in command, or an active external one of that name.
+// Each run counts against the user's rate limit and is audited.
+func (s *Service) RunCommand(c *gin.Context, inv chat.CommandInvocation) (*chat.CommandResult, bool, error) {
+	b, isBuiltin := builtins[inv.Name]
+	var cmd models.SlashCommand
+	if !isBuiltin {
+		err := s.db.Where("name = ? AND active", inv.Name).First(&cmd).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := s.allow(c, "command:"+strconv.FormatUint(uint64(inv.UserID), 10), s.cfg.CommandRateLimit); err != nil {
+		return nil, true, err
+	}
+
+	var result *chat.CommandResult
+	var err error
+	if isBuiltin {
+		result, err = b.run(s, inv)
+	} else {
+		result, err = s.runExternal(c.Request.Context(), &cmd, inv)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	result.Command = inv.Name
+
+	after := gin.H{"command": inv.Name, "args": inv.Args}
+	if result.Message != nil {
+		after["message_id"] = result.Message.ID
+	}
+	audit.Record(c, s.db, audit.Event{
+		Action:     "command.run",
+		TargetType: "conversation",
+		TargetID:   audit.IDTarget(inv.ConversationID),
+		After:      after,
+	})
+	return result, true, nil
+}
+
+// allow counts a request against a per-minute rate limit, setting
+// Retry-After and returning chat.ErrRateLimited once it is used up. Requests
+// are let through when Redis is unavailable.
+func (s *Service) allow(c *gin.Context, key string, limit int) error {
+	allowed, retryAfter, err := redis.Allow(c.Request.Context(), key, limit, rateWindow)
+	if err != nil {
+		logger.Warn().Err(err).Str("key", key).Msg("Rate limit unavailable - allowing request")
+		return nil
+	}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+		return chat.ErrRateLimited
+	}
+	return nil
+}
+
+// activeBot loads a bot account, returning chat.ErrInvalid if the user is not
+// a bot or has been disabled
+func (s *Service) activeBot(id uint) (*models.User, error) {
+	var user models.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: bot not found", chat.ErrInvalid)
+		}
+		return nil, err
+	}
+	if !user.Bot {
+		return nil, fmt.Errorf("%w: user is not a bot", chat.ErrInvalid)
+	}
+	if user.Disabled() {
+		return nil, fmt.Errorf("%w: bot is disabled", chat.ErrInvalid)
+	}
+	return &user, nil
+}
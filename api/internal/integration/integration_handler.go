@@ -0,0 +1,612 @@
+package integration
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/internal/chat"
+	"github.com/chattycathy/api/internal/webhook"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	tokenBytes = 32
+
+	// hookPathPrefix is where incoming webhooks post, relative to the host
+	hookPathPrefix = "/api/v1/hooks/"
+)
+
+// Handler serves the command list, the admin endpoints for slash commands
+// and incoming webhooks, and the endpoint incoming webhooks post to
+type Handler struct {
+	db      *gorm.DB
+	service *Service
+}
+
+// NewHandler creates a new integration handler
+func NewHandler(db *gorm.DB, service *Service) *Handler {
+	return &Handler{db: db, service: service}
+}
+
+// RegisterRoutes registers integration routes. Managing commands and
+// incoming webhooks requires integrations:manage and an MFA session; posting
+// to an incoming webhook is authenticated by the token in its URL.
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	commands := router.Group("/commands")
+	commands.Use(middleware.JWTOrAPIKeyAuth())
+	commands.Use(middleware.RequirePermission("chat:read"))
+	{
+		commands.GET("", h.ListCommands)
+	}
+
+	admin := router.Group("/admin")
+	admin.Use(middleware.JWTAuth())
+	admin.Use(middleware.RequireMFA())
+	admin.Use(middleware.RequirePermission("integrations:manage"))
+	{
+		admin.GET("/commands", h.ListSlashCommands)
+		admin.POST("/commands", h.CreateSlashCommand)
+		admin.GET("/commands/:id", h.GetSlashCommand)
+		admin.PATCH("/commands/:id", h.UpdateSlashCommand)
+		admin.DELETE("/commands/:id", h.DeleteSlashCommand)
+		admin.POST("/commands/:id/secret", h.RotateCommandSecret)
+
+		admin.GET("/incoming-webhooks", h.ListIncomingWebhooks)
+		admin.POST("/incoming-webhooks", h.CreateIncomingWebhook)
+		admin.DELETE("/incoming-webhooks/:id", h.DeleteIncomingWebhook)
+		admin.POST("/incoming-webhooks/:id/token", h.RotateIncomingWebhookToken)
+	}
+
+	router.POST("/hooks/:token", h.PostIncoming)
+}
+
+// SlashCommandResponse represents an external command. The secret is only
+// included when it is created or rotated.
+type SlashCommandResponse struct {
+	models.SlashCommand
+	Secret string `json:"secret,omitempty"`
+}
+
+// IncomingWebhookResponse represents an incoming webhook. The token, and the
+// path it is posted to, are only included when it is created or rotated.
+type IncomingWebhookResponse struct {
+	models.IncomingWebhook
+	Token string `json:"token,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+// ListCommands returns the commands that can be typed in a conversation
+func (h *Handler) ListCommands(c *gin.Context) {
+	commands, err := h.service.ListCommands()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to list commands")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch commands"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// ListSlashCommands returns every external command, active or not
+func (h *Handler) ListSlashCommands(c *gin.Context) {
+	commands := []models.SlashCommand{}
+	if err := h.db.Order("name").Find(&commands).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list slash commands")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch commands"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": commands})
+}
+
+// CreateSlashCommandRequest represents a new external command
+type CreateSlashCommandRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description" binding:"max=255"`
+	Usage       string `json:"usage" binding:"max=255"`
+	URL         string `json:"url" binding:"required,max=2048"`
+	BotID       uint   `json:"bot_id" binding:"required"`
+	Active      *bool  `json:"active"` // true when omitted
+}
+
+// CreateSlashCommand registers a command answered by an external endpoint.
+// The response carries the signing secret, which is not shown again.
+func (h *Handler) CreateSlashCommand(c *gin.Context) {
+	var req CreateSlashCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Name), "/"))
+	if msg := validateCommand(name, req.URL); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	if !h.checkBot(c, req.BotID, "failed to create command") {
+		return
+	}
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	var count int64
+	if err := h.db.Model(&models.SlashCommand{}).Where("name = ?", name).Count(&count).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to check slash command name")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create command"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a command with this name already exists"})
+		return
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate command secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create command"})
+		return
+	}
+	cmd := models.SlashCommand{
+		Name:        name,
+		Description: req.Description,
+		Usage:       req.Usage,
+		URL:         req.URL,
+		Secret:      secret,
+		BotID:       req.BotID,
+		Active:      req.Active == nil || *req.Active,
+		CreatedByID: userID,
+	}
+	// Active defaults to true in the database, so false must be written explicitly
+	if err := h.db.Select("*").Omit("id").Create(&cmd).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to create slash command")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create command"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "slash_command.create",
+		TargetType: "slash_command",
+		TargetID:   audit.IDTarget(cmd.ID),
+		After:      cmd,
+	})
+
+	c.JSON(http.StatusCreated, SlashCommandResponse{SlashCommand: cmd, Secret: secret})
+}
+
+// GetSlashCommand returns an external command
+func (h *Handler) GetSlashCommand(c *gin.Context) {
+	cmd, ok := h.loadCommand(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, cmd)
+}
+
+// UpdateSlashCommandRequest represents changes to an external command;
+// omitted fields are left as they are. Commands cannot be renamed.
+type UpdateSlashCommandRequest struct {
+	Description *string `json:"description" binding:"omitempty,max=255"`
+	Usage       *string `json:"usage" binding:"omitempty,max=255"`
+	URL         *string `json:"url" binding:"omitempty,max=2048"`
+	BotID       *uint   `json:"bot_id"`
+	Active      *bool   `json:"active"`
+}
+
+// UpdateSlashCommand changes an external command's description, usage, URL,
+// bot or whether it is active. Inactive commands are posted as typed.
+func (h *Handler) UpdateSlashCommand(c *gin.Context) {
+	cmd, ok := h.loadCommand(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateSlashCommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	before := *cmd
+	if req.Description != nil {
+		cmd.Description = *req.Description
+	}
+	if req.Usage != nil {
+		cmd.Usage = *req.Usage
+	}
+	if req.URL != nil {
+		cmd.URL = *req.URL
+	}
+	if req.Active != nil {
+		cmd.Active = *req.Active
+	}
+	if msg := validateCommand(cmd.Name, cmd.URL); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	if req.BotID != nil && *req.BotID != cmd.BotID {
+		if !h.checkBot(c, *req.BotID, "failed to update command") {
+			return
+		}
+		cmd.BotID = *req.BotID
+	}
+
+	if err := h.db.Save(cmd).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to update slash command")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update command"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "slash_command.update",
+		TargetType: "slash_command",
+		TargetID:   audit.IDTarget(cmd.ID),
+		Before:     before,
+		After:      cmd,
+	})
+
+	c.JSON(http.StatusOK, cmd)
+}
+
+// DeleteSlashCommand deletes an external command
+func (h *Handler) DeleteSlashCommand(c *gin.Context) {
+	cmd, ok := h.loadCommand(c)
+	if !ok {
+		return
+	}
+	if err := h.db.Delete(cmd).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to delete slash command")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete command"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "slash_command.delete",
+		TargetType: "slash_command",
+		TargetID:   audit.IDTarget(cmd.ID),
+		Before:     cmd,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "command deleted"})
+}
+
+// RotateCommandSecret replaces a command's signing secret and returns the new
+// one. Invocations are signed with it at once.
+func (h *Handler) RotateCommandSecret(c *gin.Context) {
+	cmd, ok := h.loadCommand(c)
+	if !ok {
+		return
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate command secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+		return
+	}
+	if err := h.db.Model(cmd).Update("secret", secret).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to rotate command secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "slash_command.rotate_secret",
+		TargetType: "slash_command",
+		TargetID:   audit.IDTarget(cmd.ID),
+	})
+
+	c.JSON(http.StatusOK, SlashCommandResponse{SlashCommand: *cmd, Secret: secret})
+}
+
+// ListIncomingWebhooks returns every incoming webhook
+func (h *Handler) ListIncomingWebhooks(c *gin.Context) {
+	hooks := []models.IncomingWebhook{}
+	if err := h.db.Order("id").Find(&hooks).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list incoming webhooks")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch incoming webhooks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"incoming_webhooks": hooks})
+}
+
+// CreateIncomingWebhookRequest represents a new incoming webhook
+type CreateIncomingWebhookRequest struct {
+	Name           string `json:"name" binding:"required,max=100"`
+	BotID          uint   `json:"bot_id" binding:"required"`
+	ConversationID uint   `json:"conversation_id" binding:"required"`
+}
+
+// CreateIncomingWebhook creates a URL that posts into a conversation as a
+// bot, which must be a member of it. The response carries the token, which
+// is not shown again.
+func (h *Handler) CreateIncomingWebhook(c *gin.Context) {
+	var req CreateIncomingWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if !h.checkBot(c, req.BotID, "failed to create incoming webhook") {
+		return
+	}
+	if err := h.service.chat.CheckMember(req.BotID, req.ConversationID); err != nil {
+		if errors.Is(err, chat.ErrNotFound) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "bot is not a member of the conversation"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to check bot membership")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create incoming webhook"})
+		return
+	}
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate incoming webhook token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create incoming webhook"})
+		return
+	}
+	hook := models.IncomingWebhook{
+		Name:           name,
+		ConversationID: req.ConversationID,
+		BotID:          req.BotID,
+		TokenHash:      hash,
+		CreatedByID:    userID,
+	}
+	if err := h.db.Create(&hook).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to create incoming webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create incoming webhook"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "incoming_webhook.create",
+		TargetType: "incoming_webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		After:      hook,
+	})
+
+	c.JSON(http.StatusCreated, IncomingWebhookResponse{IncomingWebhook: hook, Token: token, Path: hookPathPrefix + token})
+}
+
+// DeleteIncomingWebhook deletes an incoming webhook; posts to its URL fail
+// immediately
+func (h *Handler) DeleteIncomingWebhook(c *gin.Context) {
+	hook, ok := h.loadIncomingWebhook(c)
+	if !ok {
+		return
+	}
+	if err := h.db.Delete(hook).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to delete incoming webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete incoming webhook"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "incoming_webhook.delete",
+		TargetType: "incoming_webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		Before:     hook,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "incoming webhook deleted"})
+}
+
+// RotateIncomingWebhookToken replaces an incoming webhook's token, so its old
+// URL stops working, and returns the new one
+func (h *Handler) RotateIncomingWebhookToken(c *gin.Context) {
+	hook, ok := h.loadIncomingWebhook(c)
+	if !ok {
+		return
+	}
+
+	token, hash, err := newToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate incoming webhook token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate token"})
+		return
+	}
+	if err := h.db.Model(hook).Update("token_hash", hash).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to rotate incoming webhook token")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate token"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "incoming_webhook.rotate_token",
+		TargetType: "incoming_webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+	})
+
+	c.JSON(http.StatusOK, IncomingWebhookResponse{IncomingWebhook: *hook, Token: token, Path: hookPathPrefix + token})
+}
+
+// IncomingMessageRequest represents a message posted to an incoming webhook
+type IncomingMessageRequest struct {
+	Text     string `json:"text" binding:"required"`
+	ParentID uint   `json:"parent_id"` // reply in the thread of this message when set
+}
+
+// PostIncoming posts a message to an incoming webhook's conversation as its
+// bot. Each webhook is rate limited on its own.
+func (h *Handler) PostIncoming(c *gin.Context) {
+	var hook models.IncomingWebhook
+	if err := h.db.Where("token_hash = ?", hashToken(c.Param("token"))).First(&hook).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to get incoming webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to post message"})
+		return
+	}
+	if err := h.service.allow(c, "incoming_webhook:"+strconv.FormatUint(uint64(hook.ID), 10), h.service.cfg.WebhookRateLimit); err != nil {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+
+	var req IncomingMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	bot, err := h.service.activeBot(hook.BotID)
+	if err != nil {
+		if errors.Is(err, chat.ErrInvalid) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "webhook's bot is not available"})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to get incoming webhook bot")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to post message"})
+		return
+	}
+
+	msg, err := h.service.chat.PostMessage(bot.ID, hook.ConversationID, chat.MessageInput{
+		Body:     req.Text,
+		ParentID: req.ParentID,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, chat.ErrNotFound):
+			c.JSON(http.StatusForbidden, gin.H{"error": "webhook's bot is no longer a member of the conversation"})
+		case errors.Is(err, chat.ErrMessageNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "message not found"})
+		case errors.Is(err, chat.ErrInvalid):
+			c.JSON(http.StatusBadRequest, gin.H{"error": strings.TrimPrefix(err.Error(), chat.ErrInvalid.Error()+": ")})
+		default:
+			logger.Error().Err(err).Uint("incoming_webhook_id", hook.ID).Msg("Failed to post incoming webhook message")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to post message"})
+		}
+		return
+	}
+
+	if err := h.db.Model(&hook).Update("last_used_at", time.Now()).Error; err != nil {
+		logger.Warn().Err(err).Uint("incoming_webhook_id", hook.ID).Msg("Failed to record incoming webhook use")
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "incoming_webhook.post",
+		TargetType: "incoming_webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		After:      gin.H{"conversation_id": hook.ConversationID, "message_id": msg.ID},
+		ActorID:    &bot.ID,
+		ActorEmail: bot.Email,
+	})
+
+	c.JSON(http.StatusCreated, msg)
+}
+
+// checkBot checks that a user is an enabled bot, writing an error response if
+// it is not
+func (h *Handler) checkBot(c *gin.Context, id uint, fallback string) bool {
+	if _, err := h.service.activeBot(id); err != nil {
+		if errors.Is(err, chat.ErrInvalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": strings.TrimPrefix(err.Error(), chat.ErrInvalid.Error()+": ")})
+			return false
+		}
+		logger.Error().Err(err).Msg("Failed to get bot")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+		return false
+	}
+	return true
+}
+
+// loadCommand loads the command named in the route, writing an error response
+// if it cannot
+func (h *Handler) loadCommand(c *gin.Context) (*models.SlashCommand, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid command ID"})
+		return nil, false
+	}
+
+	var cmd models.SlashCommand
+	if err := h.db.First(&cmd, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "command not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get slash command")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch command"})
+		return nil, false
+	}
+	return &cmd, true
+}
+
+// loadIncomingWebhook loads the incoming webhook named in the route, writing
+// an error response if it cannot
+func (h *Handler) loadIncomingWebhook(c *gin.Context) (*models.IncomingWebhook, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid incoming webhook ID"})
+		return nil, false
+	}
+
+	var hook models.IncomingWebhook
+	if err := h.db.First(&hook, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "incoming webhook not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get incoming webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch incoming webhook"})
+		return nil, false
+	}
+	return &hook, true
+}
+
+// validateCommand checks a command's name and URL, returning a message
+// describing the first problem or "" if there is none
+func validateCommand(name, rawURL string) string {
+	if !chat.ValidCommandName(name) {
+		return "name must start with a letter and contain only lower case letters, digits, '-' and '_'"
+	}
+	if IsBuiltin(name) {
+		return "/" + name + " is a built-in command"
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url must be an absolute http or https URL"
+	}
+	if u.User != nil {
+		return "url must not contain credentials"
+	}
+	return ""
+}
+
+// newToken generates an incoming webhook token and the hash stored for it
+func newToken() (token, hash string, err error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
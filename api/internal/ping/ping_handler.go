@@ -18,7 +18,7 @@ func NewHandler(service *Service) *Handler {
 // RegisterRoutes registers all ping routes
 func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
 	// Ping requires authentication and ping:read permission
-	router.GET("/ping", middleware.JWTAuth(), middleware.RequirePermission("ping:read"), h.Ping)
+	router.GET("/ping", middleware.JWTOrAPIKeyAuth(), middleware.RequirePermission("ping:read"), h.Ping)
 }
 
 // Ping godoc
@@ -15,11 +15,11 @@ func NewHandler() *Handler {
 	return &Handler{}
 }
 
-// RegisterRoutes registers protected routes (requires JWT)
+// RegisterRoutes registers protected routes (requires a JWT or API key)
 func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
-	// All routes in this group require valid JWT
+	// All routes in this group require a valid JWT or API key
 	protected := router.Group("/protected")
-	protected.Use(middleware.JWTAuth())
+	protected.Use(middleware.JWTOrAPIKeyAuth())
 	{
 		protected.GET("/secret", h.Secret)
 		protected.GET("/profile", h.Profile)
@@ -27,6 +27,7 @@ func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
 		// Admin-only routes
 		admin := protected.Group("/admin")
 		admin.Use(middleware.RequireRole("admin"))
+		admin.Use(middleware.RequireMFA())
 		{
 			admin.GET("/dashboard", h.AdminDashboard)
 		}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// store is the delivery queue the dispatcher works through
+type store interface {
+	// claim takes up to limit due deliveries, oldest first, and leases them
+	// until the given time by moving their next attempt there
+	claim(limit int, until time.Time) ([]models.WebhookDelivery, error)
+	// webhook loads a webhook, or returns gorm.ErrRecordNotFound once it is deleted
+	webhook(id uint) (*models.Webhook, error)
+	// record saves an attempt along with the delivery's new state
+	record(attempt *models.WebhookAttempt, delivery *models.WebhookDelivery) error
+	// purge deletes finished deliveries created before the given time, and
+	// their attempts, returning how many deliveries went
+	purge(before time.Time) (int64, error)
+}
+
+// gormStore keeps the delivery queue in the database
+type gormStore struct {
+	db *gorm.DB
+}
+
+func (s *gormStore) claim(limit int, until time.Time) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", models.DeliveryStatusPending, time.Now().UTC()).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(deliveries))
+		for i := range deliveries {
+			ids[i] = deliveries[i].ID
+			deliveries[i].NextAttemptAt = until
+		}
+		return tx.Model(&models.WebhookDelivery{}).Where("id IN ?", ids).
+			Update("next_attempt_at", until).Error
+	})
+	return deliveries, err
+}
+
+func (s *gormStore) webhook(id uint) (*models.Webhook, error) {
+	var hook models.Webhook
+	if err := s.db.First(&hook, id).Error; err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (s *gormStore) record(attempt *models.WebhookAttempt, delivery *models.WebhookDelivery) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(attempt).Error; err != nil {
+			return err
+		}
+		return tx.Model(delivery).
+			Select("attempts", "status", "next_attempt_at", "last_error", "delivered_at").
+			Updates(delivery).Error
+	})
+}
+
+func (s *gormStore) purge(before time.Time) (int64, error) {
+	old := s.db.Model(&models.WebhookDelivery{}).Select("id").
+		Where("status <> ? AND created_at < ?", models.DeliveryStatusPending, before)
+	var deleted int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("delivery_id IN (?)", old).Delete(&models.WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("id IN (?)", old).Delete(&models.WebhookDelivery{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	return deleted, err
+}
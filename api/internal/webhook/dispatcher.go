@@ -0,0 +1,256 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	pollInterval  = time.Second
+	purgeInterval = 24 * time.Hour
+	// leaseMargin is added to the request timeout while a delivery is in
+	// flight; if the worker dies, the delivery comes due again after it
+	leaseMargin = 30 * time.Second
+	// maxErrorLength caps the error or response excerpt kept per attempt
+	maxErrorLength = 1024
+)
+
+// Config holds delivery settings. Zero values take the defaults.
+type Config struct {
+	Workers     int           // deliveries sent at once; default 4
+	Timeout     time.Duration // per attempt; default 10s
+	MaxAttempts int           // attempts before a delivery becomes a dead letter; default 8
+	BaseBackoff time.Duration // wait after the first failure, doubling after each; default 30s
+	MaxBackoff  time.Duration // longest wait between attempts; default 6h
+	Retention   time.Duration // delivered and dead deliveries older than this are deleted; zero keeps them
+}
+
+// Dispatcher sends queued deliveries to webhooks, retrying failures with
+// exponential backoff. Deliveries are claimed with SKIP LOCKED, so every
+// replica can run one.
+type Dispatcher struct {
+	store  store
+	client *http.Client
+	cfg    Config
+}
+
+// NewDispatcher creates a dispatcher
+func NewDispatcher(db *gorm.DB, cfg Config) *Dispatcher {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 8
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = 30 * time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 6 * time.Hour
+	}
+
+	client := &http.Client{
+		Timeout: cfg.Timeout,
+		// A redirect is a failed delivery, not a new destination
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Dispatcher{store: &gormStore{db: db}, client: client, cfg: cfg}
+}
+
+// Run sends due deliveries until the context is cancelled, and deletes old
+// ones once a day when a retention period is set
+func (d *Dispatcher) Run(ctx context.Context) {
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	purge := time.NewTicker(purgeInterval)
+	defer purge.Stop()
+
+	d.purge()
+	for {
+		// Keep going while there is a backlog
+		for d.dispatch(ctx) == d.cfg.Workers && ctx.Err() == nil {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-purge.C:
+			d.purge()
+		}
+	}
+}
+
+// dispatch sends a batch of due deliveries and returns how many there were
+func (d *Dispatcher) dispatch(ctx context.Context) int {
+	deliveries, err := d.claim(d.cfg.Workers)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to claim webhook deliveries")
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		wg.Add(1)
+		go func(delivery *models.WebhookDelivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(&deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+// claim takes up to limit due deliveries, leasing them so other replicas
+// skip them while they are in flight
+func (d *Dispatcher) claim(limit int) ([]models.WebhookDelivery, error) {
+	return d.store.claim(limit, time.Now().UTC().Add(d.cfg.Timeout+leaseMargin))
+}
+
+// deliver makes one attempt at a delivery and records the outcome
+func (d *Dispatcher) deliver(ctx context.Context, delivery *models.WebhookDelivery) {
+	hook, err := d.store.webhook(delivery.WebhookID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Error().Err(err).Uint("delivery_id", delivery.ID).Msg("Failed to load webhook")
+			return
+		}
+		d.record(delivery, 0, errors.New("webhook deleted"), 0, true)
+		return
+	}
+	if !hook.Active {
+		d.record(delivery, 0, errors.New("webhook inactive"), 0, true)
+		return
+	}
+
+	started := time.Now()
+	status, err := d.send(ctx, hook, delivery)
+	if ctx.Err() != nil {
+		// Shutting down; the lease runs out and another worker retries
+		return
+	}
+	d.record(delivery, status, err, time.Since(started), false)
+}
+
+// send posts a delivery's payload to its webhook, returning the response
+// status. Any status other than 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, hook *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChattyCathy-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, time.Now(), delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorLength))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d: %s", resp.StatusCode, excerpt)
+	}
+	return resp.StatusCode, nil
+}
+
+// record logs an attempt and moves the delivery on: to delivered, to its next
+// attempt, or to the dead letters once attempts run out or giveUp is set
+func (d *Dispatcher) record(delivery *models.WebhookDelivery, status int, sendErr error, elapsed time.Duration, giveUp bool) {
+	attempt := models.WebhookAttempt{
+		DeliveryID: delivery.ID,
+		StatusCode: status,
+		DurationMS: elapsed.Milliseconds(),
+	}
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastError = ""
+	switch {
+	case sendErr == nil:
+		delivery.Status = models.DeliveryStatusDelivered
+		delivery.DeliveredAt = &now
+	case giveUp || delivery.Attempts >= d.cfg.MaxAttempts:
+		attempt.Error = truncate(sendErr.Error())
+		delivery.Status = models.DeliveryStatusDead
+		delivery.LastError = attempt.Error
+	default:
+		attempt.Error = truncate(sendErr.Error())
+		delivery.NextAttemptAt = now.Add(d.backoff(delivery.Attempts))
+		delivery.LastError = attempt.Error
+	}
+
+	if err := d.store.record(&attempt, delivery); err != nil {
+		logger.Error().Err(err).Uint("delivery_id", delivery.ID).Msg("Failed to record webhook attempt")
+		return
+	}
+	if delivery.Status == models.DeliveryStatusDead {
+		logger.Warn().
+			Uint("delivery_id", delivery.ID).
+			Uint("webhook_id", delivery.WebhookID).
+			Str("event", delivery.Event).
+			Str("error", attempt.Error).
+			Msg("Webhook delivery moved to dead letters")
+	}
+}
+
+// backoff returns the wait before the next attempt after the given number of
+// failed ones, doubling each time, with up to 10% jitter so retries of many
+// deliveries spread out
+func (d *Dispatcher) backoff(failures int) time.Duration {
+	wait := d.cfg.BaseBackoff
+	for i := 1; i < failures && wait < d.cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > d.cfg.MaxBackoff {
+		wait = d.cfg.MaxBackoff
+	}
+	return wait + rand.N(wait/10+1)
+}
+
+// purge deletes finished deliveries, and their attempts, older than the
+// retention period
+func (d *Dispatcher) purge() {
+	if d.cfg.Retention <= 0 {
+		return
+	}
+
+	deleted, err := d.store.purge(time.Now().Add(-d.cfg.Retention))
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to purge webhook deliveries")
+		return
+	}
+	if deleted > 0 {
+		logger.Info().Int64("deleted", deleted).Msg("Purged old webhook deliveries")
+	}
+}
+
+// truncate shortens an error to maxErrorLength and makes it storable as
+// text, since it can quote arbitrary response bytes
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		s = s[:maxErrorLength]
+	}
+	return strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+}
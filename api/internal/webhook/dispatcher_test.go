@@ -0,0 +1,459 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"gorm.io/gorm"
+)
+
+const testSecret = "whsec_test"
+
+// receiver is a local webhook endpoint that answers with a fixed status and
+// keeps the last request it got
+type receiver struct {
+	*httptest.Server
+	mu     sync.Mutex
+	header http.Header
+	body   []byte
+	hits   int
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	t.Helper()
+	r := &receiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.header, r.body = req.Header.Clone(), body
+		r.hits++
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestSendSignsPayload(t *testing.T) {
+	recv := newReceiver(t, http.StatusNoContent)
+	d, _ := newTestDispatcher(t, Config{})
+	hook := &models.Webhook{ID: 1, URL: recv.URL, Secret: testSecret, Active: true}
+	delivery := &models.WebhookDelivery{ID: 7, WebhookID: 1, Event: EventPing, Payload: models.JSON(`{"id":"e1","type":"ping"}`)}
+
+	status, err := d.send(context.Background(), hook, delivery)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("send = %d, %v; want 204, nil", status, err)
+	}
+	if got := recv.header.Get(EventHeader); got != EventPing {
+		t.Errorf("%s = %q, want %q", EventHeader, got, EventPing)
+	}
+	if got := recv.header.Get(DeliveryHeader); got != "7" {
+		t.Errorf("%s = %q, want 7", DeliveryHeader, got)
+	}
+
+	header := recv.header.Get(SignatureHeader)
+	if err := Verify(testSecret, header, recv.body, 5*time.Minute); err != nil {
+		t.Errorf("Verify(received signature) = %v, want nil", err)
+	}
+	if err := Verify(testSecret, header, []byte(`{"id":"e1","type":"tampered"}`), 5*time.Minute); err == nil {
+		t.Error("Verify accepted a tampered body")
+	}
+	if err := Verify("whsec_other", header, recv.body, 5*time.Minute); err == nil {
+		t.Error("Verify accepted the wrong secret")
+	}
+	stale := Sign(testSecret, time.Now().Add(-time.Hour), recv.body)
+	if err := Verify(testSecret, stale, recv.body, 5*time.Minute); err == nil {
+		t.Error("Verify accepted a stale signature")
+	}
+}
+
+func TestDispatchClaimsDueDeliveriesInBatches(t *testing.T) {
+	recv := newReceiver(t, http.StatusOK)
+	d, q := newTestDispatcher(t, Config{Workers: 2, Timeout: 5 * time.Second})
+	q.addWebhook(recv.URL, true)
+	now := time.Now().UTC()
+	q.addDelivery(1, now.Add(-time.Minute))
+	q.addDelivery(2, now.Add(-2*time.Minute))
+	q.addDelivery(3, now.Add(-3*time.Minute))
+	q.addDelivery(4, now.Add(time.Hour)) // not due yet
+
+	// The oldest two come first, and are leased while they are in flight
+	claimed, err := d.claim(d.cfg.Workers)
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if len(claimed) != 2 || claimed[0].ID != 3 || claimed[1].ID != 2 {
+		t.Fatalf("claimed %v, want deliveries 3 and 2", deliveryIDs(claimed))
+	}
+	for _, id := range []uint{2, 3} {
+		lease := time.Until(q.delivery(id).NextAttemptAt)
+		if lease < leaseMargin || lease > 5*time.Second+leaseMargin {
+			t.Errorf("delivery %d leased for %v, want the timeout plus %v", id, lease, leaseMargin)
+		}
+	}
+	if again, _ := d.claim(d.cfg.Workers); len(again) != 1 || again[0].ID != 1 {
+		t.Fatalf("claim while leased = %v, want delivery 1 only", deliveryIDs(again))
+	}
+
+	// Leases that run out make deliveries due again, as when a worker dies
+	for _, id := range []uint{1, 2, 3} {
+		q.delivery(id).NextAttemptAt = now.Add(-time.Minute)
+	}
+	if n := d.dispatch(context.Background()); n != 2 {
+		t.Errorf("first dispatch sent %d deliveries, want 2", n)
+	}
+	if n := d.dispatch(context.Background()); n != 1 {
+		t.Errorf("second dispatch sent %d deliveries, want 1", n)
+	}
+	if n := d.dispatch(context.Background()); n != 0 {
+		t.Errorf("third dispatch sent %d deliveries, want 0", n)
+	}
+	if recv.hits != 3 {
+		t.Errorf("receiver got %d requests, want 3", recv.hits)
+	}
+	if status := q.delivery(4).Status; status != models.DeliveryStatusPending {
+		t.Errorf("delivery that is not due has status %s, want it left pending", status)
+	}
+}
+
+func TestSuccessfulDeliveryIsDelivered(t *testing.T) {
+	recv := newReceiver(t, http.StatusOK)
+	d, q := newTestDispatcher(t, Config{})
+	q.addWebhook(recv.URL, true)
+	q.addDelivery(3, time.Now().UTC())
+
+	if n := d.dispatch(context.Background()); n != 1 {
+		t.Fatalf("dispatch sent %d deliveries, want 1", n)
+	}
+
+	if n := len(q.attempts); n != 1 {
+		t.Fatalf("recorded %d attempts, want 1", n)
+	}
+	if status := q.attempts[0].StatusCode; status != http.StatusOK {
+		t.Errorf("attempt status = %d, want 200", status)
+	}
+	delivery := q.delivery(3)
+	if delivery.Status != models.DeliveryStatusDelivered {
+		t.Errorf("status = %s, want %s", delivery.Status, models.DeliveryStatusDelivered)
+	}
+	if delivery.DeliveredAt == nil {
+		t.Error("delivered_at not set")
+	}
+	if delivery.Attempts != 1 {
+		t.Errorf("attempts = %d, want 1", delivery.Attempts)
+	}
+}
+
+func TestFailedDeliveryIsRescheduledWithBackoff(t *testing.T) {
+	recv := newReceiver(t, http.StatusInternalServerError)
+	d, q := newTestDispatcher(t, Config{BaseBackoff: 30 * time.Second, MaxBackoff: time.Hour, MaxAttempts: 10})
+	q.addWebhook(recv.URL, true)
+
+	for _, tc := range []struct {
+		previous int
+		wait     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{7, time.Hour}, // 64 minutes is capped
+	} {
+		q.attempts = nil
+		delivery := *q.addDelivery(5, time.Now().UTC())
+		delivery.Attempts = tc.previous
+		before := time.Now()
+		d.deliver(context.Background(), &delivery)
+
+		if n := len(q.attempts); n != 1 {
+			t.Fatalf("after %d failures: recorded %d attempts, want 1", tc.previous, n)
+		}
+		stored := q.delivery(5)
+		if stored.Status != models.DeliveryStatusPending {
+			t.Errorf("after %d failures: status = %s, want it left pending", tc.previous, stored.Status)
+		}
+		if stored.Attempts != tc.previous+1 {
+			t.Errorf("after %d failures: attempts = %d, want %d", tc.previous, stored.Attempts, tc.previous+1)
+		}
+		if !strings.Contains(stored.LastError, "500") {
+			t.Errorf("after %d failures: last_error = %q, want the status", tc.previous, stored.LastError)
+		}
+		if wait := stored.NextAttemptAt.Sub(before); wait < tc.wait || wait > tc.wait+tc.wait/10+time.Second {
+			t.Errorf("after %d failures: next attempt in %v, want %v plus up to 10%%", tc.previous, wait, tc.wait)
+		}
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	d, _ := newTestDispatcher(t, Config{BaseBackoff: 10 * time.Second, MaxBackoff: time.Minute})
+
+	for failures, want := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		3:  40 * time.Second,
+		4:  time.Minute,
+		50: time.Minute,
+	} {
+		for i := 0; i < 20; i++ {
+			if got := d.backoff(failures); got < want || got > want+want/10 {
+				t.Fatalf("backoff(%d) = %v, want %v plus up to 10%%", failures, got, want)
+			}
+		}
+	}
+}
+
+func TestRedirectIsFailedDelivery(t *testing.T) {
+	target := newReceiver(t, http.StatusOK)
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	d, q := newTestDispatcher(t, Config{})
+	q.addWebhook(redirect.URL, true)
+
+	delivery := *q.addDelivery(9, time.Now().UTC())
+	d.deliver(context.Background(), &delivery)
+
+	if target.hits != 0 {
+		t.Error("redirect was followed")
+	}
+	if n := len(q.attempts); n != 1 || q.attempts[0].StatusCode != http.StatusFound {
+		t.Fatalf("attempts = %+v, want one answered 302", q.attempts)
+	}
+	if delivery := q.delivery(9); delivery.Status != models.DeliveryStatusPending || !delivery.NextAttemptAt.After(time.Now()) {
+		t.Errorf("delivery = %+v, want it rescheduled", delivery)
+	}
+}
+
+func TestDeliveryIsDeadAfterMaxAttempts(t *testing.T) {
+	recv := newReceiver(t, http.StatusServiceUnavailable)
+	d, q := newTestDispatcher(t, Config{MaxAttempts: 3})
+	q.addWebhook(recv.URL, true)
+	q.addDelivery(11, time.Now().UTC())
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		// Make the delivery due again instead of waiting out the backoff
+		q.delivery(11).NextAttemptAt = time.Now().UTC()
+		if n := d.dispatch(context.Background()); n != 1 {
+			t.Fatalf("attempt %d: dispatch sent %d deliveries, want 1", attempt, n)
+		}
+
+		delivery := q.delivery(11)
+		if attempt < 3 {
+			if delivery.Status != models.DeliveryStatusPending {
+				t.Errorf("attempt %d: status = %s, want it left pending", attempt, delivery.Status)
+			}
+			continue
+		}
+		if delivery.Status != models.DeliveryStatusDead {
+			t.Errorf("attempt %d: status = %s, want %s", attempt, delivery.Status, models.DeliveryStatusDead)
+		}
+	}
+	if n := d.dispatch(context.Background()); n != 0 {
+		t.Errorf("dispatch after the delivery died sent %d deliveries, want 0", n)
+	}
+	if recv.hits != 3 || len(q.attempts) != 3 {
+		t.Errorf("receiver got %d requests and %d attempts were recorded, want 3 of each", recv.hits, len(q.attempts))
+	}
+}
+
+func TestDeliveryToRemovedWebhookIsDead(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		deleted bool
+		want    string
+	}{
+		{"deleted", true, "webhook deleted"},
+		{"inactive", false, "webhook inactive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recv := newReceiver(t, http.StatusOK)
+			d, q := newTestDispatcher(t, Config{})
+			q.addWebhook(recv.URL, false)
+			if tc.deleted {
+				delete(q.hooks, 1)
+			}
+			q.addDelivery(13, time.Now().UTC())
+
+			if n := d.dispatch(context.Background()); n != 1 {
+				t.Fatalf("dispatch sent %d deliveries, want 1", n)
+			}
+
+			if recv.hits != 0 {
+				t.Error("delivery was sent")
+			}
+			delivery := q.delivery(13)
+			if delivery.Status != models.DeliveryStatusDead || delivery.LastError != tc.want {
+				t.Errorf("delivery = %s, %q; want %s, %q", delivery.Status, delivery.LastError, models.DeliveryStatusDead, tc.want)
+			}
+			if n := len(q.attempts); n != 1 || q.attempts[0].StatusCode != 0 {
+				t.Errorf("attempts = %+v, want one without a response", q.attempts)
+			}
+		})
+	}
+}
+
+func TestShutdownLeavesDeliveryLeased(t *testing.T) {
+	recv := newReceiver(t, http.StatusOK)
+	d, q := newTestDispatcher(t, Config{})
+	q.addWebhook(recv.URL, true)
+	q.addDelivery(15, time.Now().UTC())
+
+	claimed, err := d.claim(1)
+	if err != nil || len(claimed) != 1 {
+		t.Fatalf("claim = %v, %v; want one delivery", deliveryIDs(claimed), err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.deliver(ctx, &claimed[0])
+
+	if len(q.attempts) != 0 {
+		t.Errorf("recorded %d attempts, want none", len(q.attempts))
+	}
+	if delivery := q.delivery(15); delivery.Attempts != 0 || !delivery.NextAttemptAt.Equal(claimed[0].NextAttemptAt) {
+		t.Errorf("delivery = %+v, want it left leased for another worker", delivery)
+	}
+}
+
+func TestPurgeKeepsPendingDeliveries(t *testing.T) {
+	d, q := newTestDispatcher(t, Config{Retention: 24 * time.Hour})
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	for id, status := range map[uint]string{
+		1: models.DeliveryStatusDelivered,
+		2: models.DeliveryStatusDead,
+		3: models.DeliveryStatusPending,
+	} {
+		delivery := q.addDelivery(id, old)
+		delivery.Status, delivery.CreatedAt = status, old
+	}
+	q.addDelivery(4, time.Now().UTC()).Status = models.DeliveryStatusDelivered
+
+	d.purge()
+
+	if ids := q.deliveryIDs(); len(ids) != 2 || ids[0] != 3 || ids[1] != 4 {
+		t.Errorf("deliveries left = %v, want 3 and 4", ids)
+	}
+}
+
+func newTestDispatcher(t *testing.T, cfg Config) (*Dispatcher, *memStore) {
+	t.Helper()
+	q := &memStore{hooks: map[uint]*models.Webhook{}, deliveries: map[uint]*models.WebhookDelivery{}}
+	d := NewDispatcher(nil, cfg)
+	d.store = q
+	return d, q
+}
+
+// memStore is an in-memory delivery queue. Tests use one webhook, with ID 1.
+type memStore struct {
+	mu         sync.Mutex
+	hooks      map[uint]*models.Webhook
+	deliveries map[uint]*models.WebhookDelivery
+	attempts   []models.WebhookAttempt
+}
+
+func (s *memStore) addWebhook(url string, active bool) {
+	s.hooks[1] = &models.Webhook{ID: 1, URL: url, Secret: testSecret, Active: active}
+}
+
+// addDelivery queues a ping to the webhook, due at the given time
+func (s *memStore) addDelivery(id uint, due time.Time) *models.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries[id] = &models.WebhookDelivery{
+		ID:            id,
+		WebhookID:     1,
+		Event:         EventPing,
+		Payload:       models.JSON(`{}`),
+		Status:        models.DeliveryStatusPending,
+		NextAttemptAt: due,
+		CreatedAt:     time.Now().UTC(),
+	}
+	return s.deliveries[id]
+}
+
+// delivery returns a stored delivery; tests change it to move time along
+func (s *memStore) delivery(id uint) *models.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deliveries[id]
+}
+
+func (s *memStore) deliveryIDs() []uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]uint, 0, len(s.deliveries))
+	for id := range s.deliveries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (s *memStore) claim(limit int, until time.Time) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*models.WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if delivery.Status == models.DeliveryStatusPending && !delivery.NextAttemptAt.After(time.Now()) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]models.WebhookDelivery, len(due))
+	for i, delivery := range due {
+		delivery.NextAttemptAt = until
+		claimed[i] = *delivery
+	}
+	return claimed, nil
+}
+
+func (s *memStore) webhook(id uint) (*models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hook, ok := s.hooks[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *hook
+	return &copied, nil
+}
+
+func (s *memStore) record(attempt *models.WebhookAttempt, delivery *models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt.ID = uint(len(s.attempts) + 1)
+	s.attempts = append(s.attempts, *attempt)
+	stored := *delivery
+	s.deliveries[delivery.ID] = &stored
+	return nil
+}
+
+func (s *memStore) purge(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for id, delivery := range s.deliveries {
+		if delivery.Status != models.DeliveryStatusPending && delivery.CreatedAt.Before(before) {
+			delete(s.deliveries, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func deliveryIDs(deliveries []models.WebhookDelivery) []uint {
+	ids := make([]uint, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = delivery.ID
+	}
+	return ids
+}
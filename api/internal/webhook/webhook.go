@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Event types sent to webhooks
+const (
+	EventMessageCreated   = "message.created"
+	EventUserCreated      = "user.created"
+	EventUserRolesChanged = "user.roles_changed"
+	EventRoleCreated      = "role.created"
+	EventRoleUpdated      = "role.updated"
+	EventRoleDeleted      = "role.deleted"
+	// Sent on request to test a webhook, whatever it subscribes to
+	EventPing = "ping"
+
+	// AllEvents subscribes a webhook to every event type
+	AllEvents = "*"
+)
+
+// Events lists the event types webhooks can subscribe to
+var Events = []string{
+	EventMessageCreated,
+	EventUserCreated,
+	EventUserRolesChanged,
+	EventRoleCreated,
+	EventRoleUpdated,
+	EventRoleDeleted,
+}
+
+// Request headers sent with every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Payload is the JSON body posted to webhooks. ID identifies the event, so
+// receivers can drop the duplicates that retries may cause.
+type Payload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Enqueue queues an event for every active webhook subscribed to it. Call it
+// in the transaction making the change, so the event is sent if and only if
+// the change is committed.
+func Enqueue(tx *gorm.DB, event string, data interface{}) error {
+	var hooks []models.Webhook
+	err := tx.Select("id").
+		Where("active AND (events @> ?::jsonb OR events @> ?::jsonb)", jsonArray(event), jsonArray(AllEvents)).
+		Find(&hooks).Error
+	if err != nil {
+		return err
+	}
+	_, err = enqueue(tx, hooks, event, data)
+	return err
+}
+
+// Notify queues an event outside a transaction. Failures are logged but never
+// fail the request.
+func Notify(db *gorm.DB, event string, data interface{}) {
+	if err := Enqueue(db, event, data); err != nil {
+		logger.Error().Err(err).Str("event", event).Msg("Failed to queue webhook event")
+	}
+}
+
+// enqueue creates a delivery of the event to each webhook
+func enqueue(tx *gorm.DB, hooks []models.Webhook, event string, data interface{}) ([]models.WebhookDelivery, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	payload := Payload{ID: uuid.NewString(), Type: event, CreatedAt: now, Data: data}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s payload: %w", event, err)
+	}
+
+	deliveries := make([]models.WebhookDelivery, len(hooks))
+	for i, hook := range hooks {
+		deliveries[i] = models.WebhookDelivery{
+			WebhookID:     hook.ID,
+			EventID:       payload.ID,
+			Event:         event,
+			Payload:       body,
+			Status:        models.DeliveryStatusPending,
+			NextAttemptAt: now,
+		}
+	}
+	if err := tx.Create(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// secretBytes is the length of a signing secret before encoding
+const secretBytes = 32
+
+// NewSecret generates a signing secret for Sign. Slash commands are signed
+// the same way, so they use it too.
+func NewSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header for a body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+// Signing the timestamp lets receivers reject replayed requests.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + signature(secret, ts, body)
+}
+
+// Verify checks a signature header made by Sign, rejecting ones older than
+// tolerance. It is what receivers written in Go can use.
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing signature timestamp")
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	expected := signature(secret, ts, body)
+	for _, s := range signatures {
+		if hmac.Equal([]byte(s), []byte(expected)) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+func signature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// jsonArray returns a one-element JSON array, for jsonb containment queries
+func jsonArray(s string) string {
+	data, _ := json.Marshal([]string{s})
+	return string(data)
+}
@@ -0,0 +1,469 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/chattycathy/api/db/models"
+	"github.com/chattycathy/api/internal/audit"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/chattycathy/api/pkg/middleware"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+// Handler manages webhook subscriptions and their delivery log
+type Handler struct {
+	db *gorm.DB
+}
+
+// NewHandler creates a new webhook handler
+func NewHandler(db *gorm.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// RegisterRoutes registers webhook routes (requires webhooks:manage and an MFA session)
+func (h *Handler) RegisterRoutes(router *gin.RouterGroup) {
+	webhooks := router.Group("/admin/webhooks")
+	webhooks.Use(middleware.JWTAuth())
+	webhooks.Use(middleware.RequireMFA())
+	webhooks.Use(middleware.RequirePermission("webhooks:manage"))
+	{
+		webhooks.GET("", h.ListWebhooks)
+		webhooks.POST("", h.CreateWebhook)
+		webhooks.GET("/:id", h.GetWebhook)
+		webhooks.PATCH("/:id", h.UpdateWebhook)
+		webhooks.DELETE("/:id", h.DeleteWebhook)
+		webhooks.POST("/:id/secret", h.RotateSecret)
+		webhooks.POST("/:id/ping", h.Ping)
+
+		// Delivery log and dead letters
+		webhooks.GET("/:id/deliveries", h.ListDeliveries)
+		webhooks.GET("/:id/deliveries/:delivery_id", h.GetDelivery)
+		webhooks.POST("/:id/deliveries/:delivery_id/redeliver", h.Redeliver)
+	}
+}
+
+// WebhookResponse represents a webhook. The secret is only included when it
+// is created or rotated.
+type WebhookResponse struct {
+	models.Webhook
+	Secret string `json:"secret,omitempty"`
+}
+
+// DeliveryListResponse represents a page of deliveries, newest first
+type DeliveryListResponse struct {
+	Deliveries []models.WebhookDelivery `json:"deliveries"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// DeliveryResponse represents a delivery with every attempt at it, oldest first
+type DeliveryResponse struct {
+	models.WebhookDelivery
+	AttemptLog []models.WebhookAttempt `json:"attempt_log"`
+}
+
+// ListWebhooks returns every webhook
+func (h *Handler) ListWebhooks(c *gin.Context) {
+	webhooks := []models.Webhook{}
+	if err := h.db.Order("id").Find(&webhooks).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list webhooks")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"webhooks": webhooks, "events": Events})
+}
+
+// CreateWebhookRequest represents a new webhook subscription
+type CreateWebhookRequest struct {
+	URL         string   `json:"url" binding:"required,max=2048"`
+	Description string   `json:"description" binding:"max=255"`
+	Events      []string `json:"events" binding:"required,min=1"`
+	Active      *bool    `json:"active"` // true when omitted
+}
+
+// CreateWebhook subscribes a URL to events. The response carries the signing
+// secret, which is not shown again.
+func (h *Handler) CreateWebhook(c *gin.Context) {
+	var req CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+	if msg := validateWebhook(req.URL, req.Events); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+		return
+	}
+
+	secret, err := NewSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate webhook secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create webhook"})
+		return
+	}
+	hook := models.Webhook{
+		URL:         req.URL,
+		Description: req.Description,
+		Secret:      secret,
+		Events:      req.Events,
+		Active:      req.Active == nil || *req.Active,
+		CreatedByID: userID,
+	}
+	// Active defaults to true in the database, so false must be written explicitly
+	if err := h.db.Select("*").Omit("id").Create(&hook).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to create webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create webhook"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "webhook.create",
+		TargetType: "webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		After:      hook,
+	})
+
+	c.JSON(http.StatusCreated, WebhookResponse{Webhook: hook, Secret: secret})
+}
+
+// GetWebhook returns a webhook
+func (h *Handler) GetWebhook(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, hook)
+}
+
+// UpdateWebhookRequest represents changes to a webhook; omitted fields are
+// left as they are
+type UpdateWebhookRequest struct {
+	URL         *string  `json:"url" binding:"omitempty,max=2048"`
+	Description *string  `json:"description" binding:"omitempty,max=255"`
+	Events      []string `json:"events"`
+	Active      *bool    `json:"active"`
+}
+
+// UpdateWebhook changes a webhook's URL, description, events or whether it is
+// active. Deliveries of an inactive webhook go to the dead letters.
+func (h *Handler) UpdateWebhook(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	before := *hook
+	if req.URL != nil {
+		hook.URL = *req.URL
+	}
+	if req.Description != nil {
+		hook.Description = *req.Description
+	}
+	if req.Events != nil {
+		hook.Events = req.Events
+	}
+	if req.Active != nil {
+		hook.Active = *req.Active
+	}
+	if msg := validateWebhook(hook.URL, hook.Events); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	if err := h.db.Save(hook).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to update webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update webhook"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "webhook.update",
+		TargetType: "webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		Before:     before,
+		After:      hook,
+	})
+
+	c.JSON(http.StatusOK, hook)
+}
+
+// DeleteWebhook deletes a webhook with its queued deliveries and delivery log
+func (h *Handler) DeleteWebhook(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		deliveries := tx.Model(&models.WebhookDelivery{}).Select("id").Where("webhook_id = ?", hook.ID)
+		if err := tx.Where("delivery_id IN (?)", deliveries).Delete(&models.WebhookAttempt{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&models.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to delete webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete webhook"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "webhook.delete",
+		TargetType: "webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+		Before:     hook,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted"})
+}
+
+// RotateSecret replaces a webhook's signing secret and returns the new one.
+// Deliveries are signed with the new secret from the next attempt.
+func (h *Handler) RotateSecret(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	secret, err := NewSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to generate webhook secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+		return
+	}
+	if err := h.db.Model(hook).Update("secret", secret).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to rotate webhook secret")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate secret"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "webhook.rotate_secret",
+		TargetType: "webhook",
+		TargetID:   audit.IDTarget(hook.ID),
+	})
+
+	c.JSON(http.StatusOK, WebhookResponse{Webhook: *hook, Secret: secret})
+}
+
+// Ping queues a ping event to a webhook to test it
+func (h *Handler) Ping(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	deliveries, err := enqueue(h.db, []models.Webhook{*hook}, EventPing, gin.H{"webhook_id": hook.ID})
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to queue webhook ping")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to queue ping"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, deliveries[0])
+}
+
+// ListDeliveries returns a webhook's deliveries, newest first.
+// Query parameters: status (pending, delivered or dead), event, limit and
+// cursor (the next_cursor of the previous page).
+func (h *Handler) ListDeliveries(c *gin.Context) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeliveryLimit)))
+	if limit < 1 || limit > maxDeliveryLimit {
+		limit = defaultDeliveryLimit
+	}
+
+	query := h.db.Where("webhook_id = ?", hook.ID)
+	if v := c.Query("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	if v := c.Query("event"); v != "" {
+		query = query.Where("event = ?", v)
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		query = query.Where("id < ?", cursor)
+	}
+
+	// Fetch one extra row to know whether there is another page
+	var deliveries []models.WebhookDelivery
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&deliveries).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list webhook deliveries")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch deliveries"})
+		return
+	}
+
+	response := DeliveryListResponse{Deliveries: deliveries}
+	if len(deliveries) > limit {
+		response.Deliveries = deliveries[:limit]
+		response.NextCursor = strconv.FormatUint(uint64(deliveries[limit-1].ID), 10)
+	}
+	if response.Deliveries == nil {
+		response.Deliveries = []models.WebhookDelivery{}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetDelivery returns a delivery with its attempts
+func (h *Handler) GetDelivery(c *gin.Context) {
+	delivery, ok := h.loadDelivery(c)
+	if !ok {
+		return
+	}
+
+	attempts := []models.WebhookAttempt{}
+	if err := h.db.Where("delivery_id = ?", delivery.ID).Order("id").Find(&attempts).Error; err != nil {
+		logger.Error().Err(err).Msg("Failed to list webhook attempts")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, DeliveryResponse{WebhookDelivery: *delivery, AttemptLog: attempts})
+}
+
+// Redeliver queues a delivered or dead delivery to be sent again, with a
+// fresh set of attempts
+func (h *Handler) Redeliver(c *gin.Context) {
+	delivery, ok := h.loadDelivery(c)
+	if !ok {
+		return
+	}
+	if delivery.Status == models.DeliveryStatusPending {
+		c.JSON(http.StatusConflict, gin.H{"error": "delivery is already queued"})
+		return
+	}
+
+	delivery.Status = models.DeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().UTC()
+	err := h.db.Model(delivery).Updates(map[string]interface{}{
+		"status": delivery.Status, "attempts": 0, "next_attempt_at": delivery.NextAttemptAt,
+	}).Error
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to requeue webhook delivery")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to requeue delivery"})
+		return
+	}
+
+	audit.Record(c, h.db, audit.Event{
+		Action:     "webhook.redeliver",
+		TargetType: "webhook",
+		TargetID:   audit.IDTarget(delivery.WebhookID),
+		After:      gin.H{"delivery_id": delivery.ID, "event": delivery.Event},
+	})
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// loadWebhook loads the webhook named in the route, writing an error response
+// if it cannot
+func (h *Handler) loadWebhook(c *gin.Context) (*models.Webhook, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook ID"})
+		return nil, false
+	}
+
+	var hook models.Webhook
+	if err := h.db.First(&hook, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get webhook")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch webhook"})
+		return nil, false
+	}
+	return &hook, true
+}
+
+// loadDelivery loads the delivery named in the route, which must belong to
+// the webhook named there
+func (h *Handler) loadDelivery(c *gin.Context) (*models.WebhookDelivery, bool) {
+	hook, ok := h.loadWebhook(c)
+	if !ok {
+		return nil, false
+	}
+	id, err := strconv.ParseUint(c.Param("delivery_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery ID"})
+		return nil, false
+	}
+
+	var delivery models.WebhookDelivery
+	if err := h.db.Where("id = ? AND webhook_id = ?", id, hook.ID).First(&delivery).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+			return nil, false
+		}
+		logger.Error().Err(err).Msg("Failed to get webhook delivery")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch delivery"})
+		return nil, false
+	}
+	return &delivery, true
+}
+
+// validateWebhook checks a webhook's URL and events, returning a message
+// describing the first problem or "" if there is none
+func validateWebhook(rawURL string, events []string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url must be an absolute http or https URL"
+	}
+	if u.User != nil {
+		return "url must not contain credentials"
+	}
+	if len(events) == 0 {
+		return "at least one event is required"
+	}
+	for _, event := range events {
+		if !validEvent(event) {
+			return "unknown event: " + event
+		}
+	}
+	return ""
+}
+
+func validEvent(event string) bool {
+	if event == AllEvents {
+		return true
+	}
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/chattycathy/api/pkg/redis"
+)
+
+const (
+	emailVerifyPrefix   = "email_verify:"
+	passwordResetPrefix = "password_reset:"
+
+	// EmailVerificationExpiry is how long an email verification link stays valid
+	EmailVerificationExpiry = 24 * time.Hour
+	// PasswordResetExpiry is how long a password reset link stays valid
+	PasswordResetExpiry = time.Hour
+)
+
+// GenerateActionToken creates a random single-use token for email links
+func GenerateActionToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// StoreEmailVerificationToken stores an email verification token for a user
+func StoreEmailVerificationToken(ctx context.Context, token, userID string) error {
+	return storeActionToken(ctx, emailVerifyPrefix, token, userID, EmailVerificationExpiry)
+}
+
+// ConsumeEmailVerificationToken returns the user ID for a verification token and invalidates it
+func ConsumeEmailVerificationToken(ctx context.Context, token string) (string, error) {
+	return consumeActionToken(ctx, emailVerifyPrefix, token)
+}
+
+// StorePasswordResetToken stores a password reset token for a user
+func StorePasswordResetToken(ctx context.Context, token, userID string) error {
+	return storeActionToken(ctx, passwordResetPrefix, token, userID, PasswordResetExpiry)
+}
+
+// ConsumePasswordResetToken returns the user ID for a reset token and invalidates it
+func ConsumePasswordResetToken(ctx context.Context, token string) (string, error) {
+	return consumeActionToken(ctx, passwordResetPrefix, token)
+}
+
+// storeActionToken stores a token and replaces any earlier token of the same
+// kind for the user, so only the most recent link works
+func storeActionToken(ctx context.Context, prefix, token, userID string, expiry time.Duration) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+
+	userKey := prefix + "user:" + userID
+	if previous, err := redis.Client.Get(ctx, userKey).Result(); err == nil {
+		redis.Client.Del(ctx, prefix+previous)
+	}
+
+	if err := redis.Client.Set(ctx, prefix+token, userID, expiry).Err(); err != nil {
+		return fmt.Errorf("failed to store token: %w", err)
+	}
+	if err := redis.Client.Set(ctx, userKey, token, expiry).Err(); err != nil {
+		return fmt.Errorf("failed to store token index: %w", err)
+	}
+
+	return nil
+}
+
+// consumeActionToken atomically reads and deletes a token
+func consumeActionToken(ctx context.Context, prefix, token string) (string, error) {
+	if redis.Client == nil {
+		return "", fmt.Errorf("redis client not initialized")
+	}
+
+	userID, err := redis.Client.GetDel(ctx, prefix+token).Result()
+	if err != nil {
+		return "", fmt.Errorf("token not found or expired")
+	}
+	redis.Client.Del(ctx, prefix+"user:"+userID)
+
+	return userID, nil
+}
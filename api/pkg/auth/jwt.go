@@ -1,24 +1,21 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/chattycathy/api/pkg/logger"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-var (
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
-)
+// keys is the key ring used to sign and verify tokens
+var keys *KeyRing
 
 // Claims represents the JWT claims
 type Claims struct {
@@ -26,9 +23,31 @@ type Claims struct {
 	Username    string   `json:"username"`
 	Role        string   `json:"role"`
 	Permissions []string `json:"permissions,omitempty"`
+	AMR         []string `json:"amr,omitempty"` // authentication methods used, e.g. ["pwd", "otp", "mfa"]
+	SessionID   string   `json:"sid,omitempty"` // session the token was issued to
 	jwt.RegisteredClaims
 }
 
+// HasAMR reports whether the claims include the given authentication method
+func (c *Claims) HasAMR(method string) bool {
+	for _, m := range c.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the claims include the given permission
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // TokenPair represents access and refresh tokens
 type TokenPair struct {
 	AccessToken           string `json:"access_token"`
@@ -40,113 +59,85 @@ type TokenPair struct {
 
 // Config holds JWT configuration
 type Config struct {
-	PrivateKeyPath         string
-	PublicKeyPath          string
+	KeysDir                string
+	PrivateKeyPath         string // legacy single key, imported into the key ring on first start
 	Issuer                 string
 	AccessTokenExpiryMins  int
 	RefreshTokenExpiryDays int
 }
 
-// Init initializes the JWT module with RSA keys
+// Init loads the signing key ring. On first start the ring is seeded from the
+// legacy key file if present, otherwise with a newly generated key, and saved
+// so that restarts keep existing sessions valid.
 func Init(cfg *Config) error {
-	// Try to load existing keys
-	if cfg.PrivateKeyPath != "" && cfg.PublicKeyPath != "" {
-		if err := loadKeys(cfg.PrivateKeyPath, cfg.PublicKeyPath); err == nil {
-			logger.Info().Msg("JWT keys loaded from files")
-			return nil
-		}
-	}
-
-	// Generate new keys if not found
-	logger.Info().Msg("Generating new RSA key pair for JWT")
-	var err error
-	privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	ring, err := LoadKeyRing(cfg.KeysDir)
 	if err != nil {
-		return fmt.Errorf("failed to generate RSA key: %w", err)
+		return err
 	}
-	publicKey = &privateKey.PublicKey
 
-	// Save keys if paths provided
-	if cfg.PrivateKeyPath != "" && cfg.PublicKeyPath != "" {
-		if err := saveKeys(cfg.PrivateKeyPath, cfg.PublicKeyPath); err != nil {
-			logger.Warn().Err(err).Msg("Failed to save JWT keys to files")
+	if ring.Empty() {
+		// Replicas starting together race to seed the ring; Seed lets only
+		// the first one add a key
+		newKey := generateKey
+		legacy, legacyErr := readPrivateKey(cfg.PrivateKeyPath)
+		if legacyErr == nil {
+			newKey = func() (*rsa.PrivateKey, error) { return legacy, nil }
+		}
+		kid, created, err := ring.Seed(newKey)
+		switch {
+		case err != nil:
+			return fmt.Errorf("failed to create initial JWT key: %w", err)
+		case !created:
+			logger.Info().Str("kid", kid).Msg("JWT key ring created by another instance")
+		case legacyErr == nil:
+			logger.Info().Str("kid", kid).Msg("Imported legacy JWT key into key ring")
+		default:
+			logger.Warn().Str("kid", kid).Str("dir", cfg.KeysDir).Msg("No JWT signing keys found, generated initial key")
 		}
 	}
 
+	keys = ring
+	if cfg.AccessTokenExpiryMins > 0 {
+		accessTokenTTL = time.Duration(cfg.AccessTokenExpiryMins) * time.Minute
+	}
+	logger.Info().Str("kid", ring.ActiveKeyID()).Msg("JWT key ring loaded")
 	return nil
 }
 
-// loadKeys loads RSA keys from PEM files
-func loadKeys(privatePath, publicPath string) error {
-	// Load private key
-	privateBytes, err := os.ReadFile(privatePath)
-	if err != nil {
-		return err
-	}
-	block, _ := pem.Decode(privateBytes)
-	if block == nil {
-		return errors.New("failed to decode private key PEM")
-	}
-	privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return err
+// WatchKeys reloads the key ring periodically so rotations done by the CLI
+// or another replica take effect without a restart
+func WatchKeys(ctx context.Context, interval time.Duration) {
+	if keys != nil {
+		keys.Watch(ctx, interval)
 	}
+}
 
-	// Load public key
-	publicBytes, err := os.ReadFile(publicPath)
-	if err != nil {
-		return err
-	}
-	block, _ = pem.Decode(publicBytes)
-	if block == nil {
-		return errors.New("failed to decode public key PEM")
-	}
-	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+// RotateKeys generates a new signing key in the key ring stored in dir
+func RotateKeys(dir string, overlap time.Duration) (string, error) {
+	ring, err := LoadKeyRing(dir)
 	if err != nil {
-		return err
-	}
-	var ok bool
-	publicKey, ok = pub.(*rsa.PublicKey)
-	if !ok {
-		return errors.New("not an RSA public key")
+		return "", err
 	}
-
-	return nil
+	return ring.Rotate(overlap)
 }
 
-// saveKeys saves RSA keys to PEM files
-func saveKeys(privatePath, publicPath string) error {
-	// Save private key
-	privateBytes := x509.MarshalPKCS1PrivateKey(privateKey)
-	privatePEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: privateBytes,
-	})
-	if err := os.WriteFile(privatePath, privatePEM, 0600); err != nil {
-		return err
-	}
-
-	// Save public key
-	publicBytes, err := x509.MarshalPKIXPublicKey(publicKey)
-	if err != nil {
-		return err
+// GetJWKS returns the public keys currently accepted for verification
+func GetJWKS() JWKS {
+	if keys == nil {
+		return JWKS{Keys: []JWK{}}
 	}
-	publicPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: publicBytes,
-	})
-	if err := os.WriteFile(publicPath, publicPEM, 0644); err != nil {
-		return err
-	}
-
-	return nil
+	return keys.JWKS()
 }
 
 // GenerateAccessToken creates a new short-lived JWT access token
-func GenerateAccessToken(userID, username, role string, permissions []string, issuer string, expiryMins int) (string, error) {
-	if privateKey == nil {
+func GenerateAccessToken(userID, username, role, sessionID string, permissions, amr []string, issuer string, expiryMins int) (string, error) {
+	if keys == nil {
 		return "", errors.New("JWT not initialized")
 	}
+	key, err := keys.signingKey()
+	if err != nil {
+		return "", err
+	}
 
 	now := time.Now()
 	claims := Claims{
@@ -154,7 +145,10 @@ func GenerateAccessToken(userID, username, role string, permissions []string, is
 		Username:    username,
 		Role:        role,
 		Permissions: permissions,
+		AMR:         amr,
+		SessionID:   sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			Issuer:    issuer,
 			Subject:   userID,
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -164,7 +158,8 @@ func GenerateAccessToken(userID, username, role string, permissions []string, is
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(privateKey)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
 }
 
 // GenerateRefreshToken creates a cryptographically secure refresh token
@@ -177,8 +172,8 @@ func GenerateRefreshToken() (string, error) {
 }
 
 // GenerateTokenPair creates both access and refresh tokens
-func GenerateTokenPair(userID, username, role string, permissions []string, issuer string, accessExpiryMins, refreshExpiryDays int) (*TokenPair, error) {
-	accessToken, err := GenerateAccessToken(userID, username, role, permissions, issuer, accessExpiryMins)
+func GenerateTokenPair(userID, username, role, sessionID string, permissions, amr []string, issuer string, accessExpiryMins, refreshExpiryDays int) (*TokenPair, error) {
+	accessToken, err := GenerateAccessToken(userID, username, role, sessionID, permissions, amr, issuer, accessExpiryMins)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate access token: %w", err)
 	}
@@ -199,7 +194,7 @@ func GenerateTokenPair(userID, username, role string, permissions []string, issu
 
 // ValidateToken validates a JWT token and returns the claims
 func ValidateToken(tokenString string) (*Claims, error) {
-	if publicKey == nil {
+	if keys == nil {
 		return nil, errors.New("JWT not initialized")
 	}
 
@@ -207,7 +202,17 @@ func ValidateToken(tokenString string) (*Claims, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return publicKey, nil
+
+		// Tokens issued before key rotation have no kid; try every active key
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			set := jwt.VerificationKeySet{}
+			for _, key := range keys.publicKeys() {
+				set.Keys = append(set.Keys, &key.Private.PublicKey)
+			}
+			return set, nil
+		}
+		return keys.verificationKey(kid)
 	})
 
 	if err != nil {
@@ -221,7 +226,14 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return nil, errors.New("invalid token")
 }
 
-// GetPublicKey returns the public key for external verification
+// GetPublicKey returns the active public key for external verification
 func GetPublicKey() *rsa.PublicKey {
-	return publicKey
+	if keys == nil {
+		return nil
+	}
+	key, err := keys.signingKey()
+	if err != nil {
+		return nil
+	}
+	return &key.Private.PublicKey
 }
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package auth
+
+// lockKeyDir is a no-op where flock is unavailable; only one process should
+// manage the key directory on these platforms
+func lockKeyDir(path string) (func(), error) {
+	return func() {}, nil
+}
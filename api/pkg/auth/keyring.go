@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chattycathy/api/pkg/logger"
+)
+
+const (
+	keyManifestFile = "keyring.json"
+	keyLockFile     = "keyring.lock"
+
+	// keyRemovalGrace is how long a retired key's file is kept after it stops
+	// verifying, so processes whose clocks lag can still load the ring
+	keyRemovalGrace = time.Hour
+	keyBits         = 2048
+	// keyReloadInterval limits how often an unknown kid triggers a reload from disk
+	keyReloadInterval = 10 * time.Second
+)
+
+// signingKey is an RSA key in the key ring
+type signingKey struct {
+	ID        string
+	Private   *rsa.PrivateKey
+	CreatedAt time.Time
+	RetiresAt *time.Time // set when the key is rotated out; verification stops after this time
+}
+
+func (k *signingKey) retired(now time.Time) bool {
+	return k.RetiresAt != nil && !now.Before(*k.RetiresAt)
+}
+
+// keyManifest is the on-disk description of the key ring
+type keyManifest struct {
+	ActiveKID string          `json:"active_kid"`
+	Keys      []manifestEntry `json:"keys"`
+}
+
+type manifestEntry struct {
+	KID       string     `json:"kid"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+}
+
+// KeyRing holds the active signing key and the older keys still accepted for verification
+type KeyRing struct {
+	mu       sync.RWMutex
+	dir      string
+	activeID string
+	keys     map[string]*signingKey
+	loadedAt time.Time
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadKeyRing reads the key ring from a directory. A missing directory or
+// manifest yields an empty ring.
+func LoadKeyRing(dir string) (*KeyRing, error) {
+	r := &KeyRing{dir: dir, keys: make(map[string]*signingKey)}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the key ring from disk, picking up rotations done by other processes
+func (r *KeyRing) Reload() error {
+	manifest, err := readManifest(r.dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keys := make(map[string]*signingKey)
+	for _, entry := range manifest.Keys {
+		key := &signingKey{ID: entry.KID, CreatedAt: entry.CreatedAt, RetiresAt: entry.RetiresAt}
+		if key.retired(now) && entry.KID != manifest.ActiveKID {
+			continue
+		}
+		priv, err := readPrivateKey(filepath.Join(r.dir, entry.KID+".pem"))
+		if err != nil {
+			return fmt.Errorf("failed to load key %s: %w", entry.KID, err)
+		}
+		key.Private = priv
+		keys[entry.KID] = key
+	}
+
+	if manifest.ActiveKID != "" {
+		if _, ok := keys[manifest.ActiveKID]; !ok {
+			return fmt.Errorf("active key %s missing from key ring", manifest.ActiveKID)
+		}
+	}
+
+	r.mu.Lock()
+	r.activeID = manifest.ActiveKID
+	r.keys = keys
+	r.loadedAt = now
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Empty reports whether the ring has no active key
+func (r *KeyRing) Empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.activeID == ""
+}
+
+// ActiveKeyID returns the kid of the current signing key
+func (r *KeyRing) ActiveKeyID() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.activeID
+}
+
+// Rotate generates a new signing key. The previous active key keeps verifying
+// tokens for the overlap window, which should be at least the access token lifetime.
+func (r *KeyRing) Rotate(overlap time.Duration) (string, error) {
+	kid, _, err := r.add(generateKey, overlap, false)
+	return kid, err
+}
+
+// Seed makes the key from newKey the active key if the ring has none, even
+// counting keys another process saved since the ring was loaded. created
+// reports whether it did; if not, kid is the existing active key.
+func (r *KeyRing) Seed(newKey func() (*rsa.PrivateKey, error)) (kid string, created bool, err error) {
+	return r.add(newKey, 0, true)
+}
+
+// add makes the key from newKey the active key and saves the ring. The key
+// directory is locked while the ring is re-read, changed and written, so
+// processes sharing it never overwrite or delete each other's keys. With
+// ifEmpty set, nothing is added if the ring already has an active key.
+func (r *KeyRing) add(newKey func() (*rsa.PrivateKey, error), overlap time.Duration, ifEmpty bool) (string, bool, error) {
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return "", false, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	unlock, err := lockKeyDir(filepath.Join(r.dir, keyLockFile))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to lock key directory: %w", err)
+	}
+	defer unlock()
+
+	// Start from what is on disk, which may include keys added elsewhere
+	if err := r.Reload(); err != nil {
+		return "", false, err
+	}
+	if ifEmpty && !r.Empty() {
+		return r.ActiveKeyID(), false, nil
+	}
+
+	priv, err := newKey()
+	if err != nil {
+		return "", false, err
+	}
+	kid := keyThumbprint(&priv.PublicKey)
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if previous, ok := r.keys[r.activeID]; ok && previous.ID != kid {
+		retiresAt := now.Add(overlap)
+		previous.RetiresAt = &retiresAt
+	}
+	r.keys[kid] = &signingKey{ID: kid, Private: priv, CreatedAt: now}
+	r.activeID = kid
+
+	if err := r.save(now); err != nil {
+		return "", false, err
+	}
+	return kid, true, nil
+}
+
+// save writes key files and the manifest, and deletes the files of keys
+// retired for longer than keyRemovalGrace. Callers must hold the write lock
+// and the key directory lock, and have just reloaded the ring.
+func (r *KeyRing) save(now time.Time) error {
+	// Retired keys are not in the ring but stay in the manifest until their
+	// grace period is over. Files not in the manifest are left alone.
+	previous, err := readManifest(r.dir)
+	if err != nil {
+		return err
+	}
+	manifest := keyManifest{ActiveKID: r.activeID}
+	var expired []string
+	for _, entry := range previous.Keys {
+		if _, ok := r.keys[entry.KID]; ok {
+			continue
+		}
+		key := signingKey{RetiresAt: entry.RetiresAt}
+		if key.retired(now.Add(-keyRemovalGrace)) {
+			expired = append(expired, entry.KID)
+		} else {
+			manifest.Keys = append(manifest.Keys, entry)
+		}
+	}
+
+	for _, key := range r.keys {
+		path := filepath.Join(r.dir, key.ID+".pem")
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			privatePEM := pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(key.Private),
+			})
+			if err := os.WriteFile(path, privatePEM, 0600); err != nil {
+				return fmt.Errorf("failed to write key %s: %w", key.ID, err)
+			}
+		}
+		manifest.Keys = append(manifest.Keys, manifestEntry{KID: key.ID, CreatedAt: key.CreatedAt, RetiresAt: key.RetiresAt})
+	}
+	sort.Slice(manifest.Keys, func(i, j int) bool {
+		return manifest.Keys[i].CreatedAt.Before(manifest.Keys[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal key manifest: %w", err)
+	}
+
+	// Write then rename so readers never see a partial manifest
+	tmp := filepath.Join(r.dir, keyManifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write key manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(r.dir, keyManifestFile)); err != nil {
+		return fmt.Errorf("failed to write key manifest: %w", err)
+	}
+
+	for _, kid := range expired {
+		if err := os.Remove(filepath.Join(r.dir, kid+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn().Err(err).Str("kid", kid).Msg("Failed to remove expired JWT key")
+		}
+	}
+
+	return nil
+}
+
+// readManifest reads the key manifest in dir. A missing manifest is empty.
+func readManifest(dir string) (*keyManifest, error) {
+	var manifest keyManifest
+	data, err := os.ReadFile(filepath.Join(dir, keyManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return &manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse key manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// generateKey generates a new RSA signing key
+func generateKey() (*rsa.PrivateKey, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+	return priv, nil
+}
+
+// signingKey returns the active key
+func (r *KeyRing) signingKey() (*signingKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[r.activeID]
+	if !ok {
+		return nil, errors.New("no active signing key")
+	}
+	return key, nil
+}
+
+// verificationKey returns the public key for a kid, reloading from disk once
+// if the kid is unknown (another replica may have rotated)
+func (r *KeyRing) verificationKey(kid string) (*rsa.PublicKey, error) {
+	if key := r.lookup(kid); key != nil {
+		return key, nil
+	}
+
+	r.mu.RLock()
+	stale := time.Since(r.loadedAt) > keyReloadInterval
+	r.mu.RUnlock()
+	if stale {
+		if err := r.Reload(); err != nil {
+			logger.Warn().Err(err).Msg("Failed to reload JWT key ring")
+		}
+		if key := r.lookup(kid); key != nil {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key: %s", kid)
+}
+
+func (r *KeyRing) lookup(kid string) *rsa.PublicKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	key, ok := r.keys[kid]
+	if !ok || (kid != r.activeID && key.retired(time.Now())) {
+		return nil
+	}
+	return &key.Private.PublicKey
+}
+
+// publicKeys returns every key currently accepted for verification
+func (r *KeyRing) publicKeys() []*signingKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	var keys []*signingKey
+	for id, key := range r.keys {
+		if id == r.activeID || !key.retired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// JWKS returns the public keys in JSON Web Key Set format
+func (r *KeyRing) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range r.publicKeys() {
+		pub := key.Private.PublicKey
+		jwks.Keys = append(jwks.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: key.ID,
+			N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return jwks
+}
+
+// Watch reloads the key ring periodically until the context is cancelled
+func (r *KeyRing) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			before := r.ActiveKeyID()
+			if err := r.Reload(); err != nil {
+				logger.Warn().Err(err).Msg("Failed to reload JWT key ring")
+				continue
+			}
+			if after := r.ActiveKeyID(); after != before {
+				logger.Info().Str("kid", after).Msg("JWT signing key rotated")
+			}
+		}
+	}
+}
+
+// keyThumbprint computes the RFC 7638 JWK thumbprint used as the kid
+func keyThumbprint(pub *rsa.PublicKey) string {
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	n := base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// readPrivateKey reads a PKCS1 PEM-encoded RSA private key
+func readPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode private key PEM")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
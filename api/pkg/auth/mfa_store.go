@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chattycathy/api/pkg/redis"
+)
+
+const (
+	mfaChallengePrefix         = "mfa_challenge:"
+	mfaChallengeAttemptsPrefix = "mfa_challenge_attempts:"
+	mfaPendingSecretPrefix     = "mfa_pending_secret:"
+	mfaFailuresKeyPrefix       = "mfa:"
+
+	// MFAChallengeExpiry is how long a user has to complete the second factor
+	MFAChallengeExpiry = 5 * time.Minute
+	// MFAChallengeMaxAttempts is how many wrong codes invalidate a challenge
+	MFAChallengeMaxAttempts = 5
+	// MFAFailureLimit is how many wrong codes a user may enter across all
+	// their challenges in MFAFailureWindow. Once reached, no new challenges
+	// are issued until the window resets.
+	MFAFailureLimit  = 10
+	MFAFailureWindow = 15 * time.Minute
+	// MFAEnrollmentExpiry is how long a generated secret waits for confirmation
+	MFAEnrollmentExpiry = 10 * time.Minute
+)
+
+// MFAChallengeData stores the result of a completed first factor
+type MFAChallengeData struct {
+	UserID    string    `json:"user_id"`
+	AMR       []string  `json:"amr"` // methods satisfied so far, e.g. ["pwd"]
+	CreatedAt time.Time `json:"created_at"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// StoreMFAChallenge stores a pending MFA challenge
+func StoreMFAChallenge(ctx context.Context, token string, data *MFAChallengeData) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal challenge data: %w", err)
+	}
+
+	if err := redis.Client.Set(ctx, mfaChallengePrefix+token, jsonData, MFAChallengeExpiry).Err(); err != nil {
+		return fmt.Errorf("failed to store MFA challenge: %w", err)
+	}
+	return nil
+}
+
+// GetMFAChallenge retrieves a pending MFA challenge
+func GetMFAChallenge(ctx context.Context, token string) (*MFAChallengeData, error) {
+	if redis.Client == nil {
+		return nil, fmt.Errorf("redis client not initialized")
+	}
+
+	jsonData, err := redis.Client.Get(ctx, mfaChallengePrefix+token).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("MFA challenge not found or expired")
+	}
+
+	var data MFAChallengeData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal challenge data: %w", err)
+	}
+	return &data, nil
+}
+
+// DeleteMFAChallenge removes a challenge once it has been completed or exhausted
+func DeleteMFAChallenge(ctx context.Context, token string) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+	return redis.Client.Del(ctx, mfaChallengePrefix+token, mfaChallengeAttemptsPrefix+token).Err()
+}
+
+// RecordMFAChallengeFailure counts a wrong code and returns the attempts so far
+func RecordMFAChallengeFailure(ctx context.Context, token string) (int, error) {
+	if redis.Client == nil {
+		return 0, fmt.Errorf("redis client not initialized")
+	}
+
+	key := mfaChallengeAttemptsPrefix + token
+	attempts, err := redis.Client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to record MFA attempt: %w", err)
+	}
+	redis.Client.Expire(ctx, key, MFAChallengeExpiry)
+
+	return int(attempts), nil
+}
+
+// RecordMFAFailure counts a wrong code against the user, whichever challenge
+// it was entered on, and reports whether the user is now locked out
+func RecordMFAFailure(ctx context.Context, userID string) (locked bool, err error) {
+	// Allowed while the failures so far, this one included, are under the limit
+	allowed, _, err := redis.Allow(ctx, mfaFailuresKeyPrefix+userID, MFAFailureLimit-1, MFAFailureWindow)
+	if err != nil {
+		return false, err
+	}
+	return !allowed, nil
+}
+
+// MFALockedOut reports whether the user has used up MFAFailureLimit, and if
+// so how long until they can try again
+func MFALockedOut(ctx context.Context, userID string) (bool, time.Duration, error) {
+	return redis.Exhausted(ctx, mfaFailuresKeyPrefix+userID, MFAFailureLimit)
+}
+
+// StorePendingTOTPSecret keeps a newly generated secret until the user confirms it
+func StorePendingTOTPSecret(ctx context.Context, userID, secret string) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+	return redis.Client.Set(ctx, mfaPendingSecretPrefix+userID, secret, MFAEnrollmentExpiry).Err()
+}
+
+// GetPendingTOTPSecret returns the secret awaiting confirmation for a user
+func GetPendingTOTPSecret(ctx context.Context, userID string) (string, error) {
+	if redis.Client == nil {
+		return "", fmt.Errorf("redis client not initialized")
+	}
+
+	secret, err := redis.Client.Get(ctx, mfaPendingSecretPrefix+userID).Result()
+	if err != nil {
+		return "", fmt.Errorf("no pending enrollment")
+	}
+	return secret, nil
+}
+
+// DeletePendingTOTPSecret removes a pending secret after confirmation
+func DeletePendingTOTPSecret(ctx context.Context, userID string) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+	return redis.Client.Del(ctx, mfaPendingSecretPrefix+userID).Err()
+}
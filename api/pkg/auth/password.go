@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordCost is the bcrypt work factor used for new password hashes
+const PasswordCost = 12
+
+// MaxPasswordLength is the longest password bcrypt can hash without truncation
+const MaxPasswordLength = 72
+
+// ErrPasswordTooLong is returned when a password exceeds MaxPasswordLength bytes
+var ErrPasswordTooLong = errors.New("password exceeds 72 bytes")
+
+// dummyHash is compared against when an account has no password, so that a
+// failed lookup takes as long as a failed password check
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("chattycathy-dummy-password"), PasswordCost)
+
+// HashPassword returns a bcrypt hash of the given password
+func HashPassword(password string) (string, error) {
+	if len(password) > MaxPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// VerifyPassword reports whether password matches the stored hash.
+// An empty hash (unknown user or Google-only account) still performs a full
+// bcrypt comparison so callers cannot be used to enumerate accounts by timing.
+func VerifyPassword(hash, password string) bool {
+	if hash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
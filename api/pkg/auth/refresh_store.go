@@ -3,28 +3,81 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/chattycathy/api/pkg/redis"
+	goredis "github.com/redis/go-redis/v9"
 )
 
 const (
-	refreshTokenPrefix = "refresh_token:"
-	userTokensPrefix   = "user_tokens:"
+	refreshTokenPrefix     = "refresh_token:"
+	usedRefreshTokenPrefix = "refresh_token_used:"
+	refreshFamilyPrefix    = "refresh_family:"
+	userTokensPrefix       = "user_tokens:"
 )
 
+// ErrRefreshTokenReused is returned when a refresh token that was already
+// rotated is presented again, which means it has been copied
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// ErrSessionNotFound is returned when a session ID does not match a live session of the user
+var ErrSessionNotFound = errors.New("session not found")
+
 // RefreshTokenData stores metadata about a refresh token
 type RefreshTokenData struct {
-	UserID      string   `json:"user_id"`
-	Username    string   `json:"username"`
-	Role        string   `json:"role"`
-	Permissions []string `json:"permissions,omitempty"`
-	CreatedAt   time.Time `json:"created_at"`
+	UserID string `json:"user_id"`
+	// SessionID identifies the login to users and admins. It survives rotation
+	// and, unlike the token, is safe to expose.
+	SessionID string `json:"session_id,omitempty"`
+	// FamilyID is shared by every token descended from the same login
+	FamilyID    string    `json:"family_id,omitempty"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	Permissions []string  `json:"permissions,omitempty"`
+	AMR         []string  `json:"amr,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`   // when the session started
+	LastUsedAt  time.Time `json:"last_used_at"` // when the session was last refreshed
 	UserAgent   string    `json:"user_agent"`
 	IP          string    `json:"ip"`
 }
 
+// SessionInfo describes a session without exposing its tokens
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+// SessionInfos converts refresh token data into session descriptions, most
+// recently used first. currentSessionID marks the caller's own session.
+func SessionInfos(tokens []*RefreshTokenData, currentSessionID string) []SessionInfo {
+	sessions := make([]SessionInfo, 0, len(tokens))
+	for _, t := range tokens {
+		lastUsed := t.LastUsedAt
+		if lastUsed.IsZero() {
+			lastUsed = t.CreatedAt
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:         t.SessionID,
+			CreatedAt:  t.CreatedAt,
+			LastUsedAt: lastUsed,
+			UserAgent:  t.UserAgent,
+			IP:         t.IP,
+			Current:    t.SessionID != "" && t.SessionID == currentSessionID,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions
+}
+
 // StoreRefreshToken stores a refresh token in Redis with associated user data
 func StoreRefreshToken(ctx context.Context, token string, data *RefreshTokenData, expiry time.Duration) error {
 	if redis.Client == nil {
@@ -50,9 +103,95 @@ func StoreRefreshToken(ctx context.Context, token string, data *RefreshTokenData
 	// Set expiry on user's token set (refresh if exists)
 	redis.Client.Expire(ctx, userKey, expiry)
 
+	// Track the live tokens of the family so it can be revoked as a whole
+	if data.FamilyID != "" {
+		familyKey := refreshFamilyPrefix + data.FamilyID
+		if err := redis.Client.SAdd(ctx, familyKey, token).Err(); err != nil {
+			return fmt.Errorf("failed to add token to family set: %w", err)
+		}
+		redis.Client.Expire(ctx, familyKey, expiry)
+	}
+
 	return nil
 }
 
+// RotateRefreshToken consumes a refresh token so it can be replaced by a new one.
+// The token is kept as a tombstone until tombstoneExpiry so a later replay can be
+// told apart from an expired token: replaying it revokes the whole family and
+// returns the original data together with ErrRefreshTokenReused.
+func RotateRefreshToken(ctx context.Context, token string, tombstoneExpiry time.Duration) (*RefreshTokenData, error) {
+	if redis.Client == nil {
+		return nil, fmt.Errorf("redis client not initialized")
+	}
+
+	// GETDEL makes sure only one concurrent request can rotate the token
+	jsonData, err := redis.Client.GetDel(ctx, refreshTokenPrefix+token).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return detectRefreshTokenReuse(ctx, token)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	var data RefreshTokenData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token data: %w", err)
+	}
+
+	redis.Client.SRem(ctx, userTokensPrefix+data.UserID, token)
+	if data.FamilyID != "" {
+		redis.Client.SRem(ctx, refreshFamilyPrefix+data.FamilyID, token)
+	}
+
+	if err := redis.Client.Set(ctx, usedRefreshTokenPrefix+token, jsonData, tombstoneExpiry).Err(); err != nil {
+		return nil, fmt.Errorf("failed to store refresh token tombstone: %w", err)
+	}
+
+	return &data, nil
+}
+
+// detectRefreshTokenReuse checks a token that is no longer live against the tombstones
+func detectRefreshTokenReuse(ctx context.Context, token string) (*RefreshTokenData, error) {
+	jsonData, err := redis.Client.Get(ctx, usedRefreshTokenPrefix+token).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("refresh token not found or expired")
+	}
+
+	var data RefreshTokenData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token data: %w", err)
+	}
+
+	if data.FamilyID != "" {
+		if err := RevokeRefreshTokenFamily(ctx, data.FamilyID); err != nil {
+			return &data, fmt.Errorf("%w: %v", ErrRefreshTokenReused, err)
+		}
+	}
+
+	return &data, ErrRefreshTokenReused
+}
+
+// RevokeRefreshTokenFamily removes every live refresh token descended from the same login
+func RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+
+	familyKey := refreshFamilyPrefix + familyID
+	tokens, err := redis.Client.SMembers(ctx, familyKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get family tokens: %w", err)
+	}
+
+	for _, token := range tokens {
+		if err := RevokeRefreshToken(ctx, token); err != nil {
+			return err
+		}
+	}
+
+	return redis.Client.Del(ctx, familyKey).Err()
+}
+
 // GetRefreshTokenData retrieves the data associated with a refresh token
 func GetRefreshTokenData(ctx context.Context, token string) (*RefreshTokenData, error) {
 	if redis.Client == nil {
@@ -84,12 +223,50 @@ func RevokeRefreshToken(ctx context.Context, token string) error {
 	if err == nil && data != nil {
 		userKey := userTokensPrefix + data.UserID
 		redis.Client.SRem(ctx, userKey, token)
+		if data.FamilyID != "" {
+			redis.Client.SRem(ctx, refreshFamilyPrefix+data.FamilyID, token)
+		}
 	}
 
 	key := refreshTokenPrefix + token
 	return redis.Client.Del(ctx, key).Err()
 }
 
+// RevokeUserSession signs out a single session of a user: its refresh tokens
+// are removed and access tokens issued to it are rejected
+func RevokeUserSession(ctx context.Context, userID, sessionID string) error {
+	if redis.Client == nil {
+		return fmt.Errorf("redis client not initialized")
+	}
+
+	tokens, err := redis.Client.SMembers(ctx, userTokensPrefix+userID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get user tokens: %w", err)
+	}
+
+	found := false
+	for _, token := range tokens {
+		data, err := GetRefreshTokenData(ctx, token)
+		if err != nil || data.SessionID != sessionID {
+			continue
+		}
+		found = true
+		if data.FamilyID != "" {
+			if err := RevokeRefreshTokenFamily(ctx, data.FamilyID); err != nil {
+				return err
+			}
+		}
+		if err := RevokeRefreshToken(ctx, token); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return ErrSessionNotFound
+	}
+	return RevokeSessionAccessTokens(ctx, sessionID)
+}
+
 // RevokeAllUserTokens removes all refresh tokens for a user
 func RevokeAllUserTokens(ctx context.Context, userID string) error {
 	if redis.Client == nil {
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/google/uuid"
+)
+
+// Message represents an outgoing email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// Config holds mailer configuration
+type Config struct {
+	Driver string // "log" or "file"
+	From   string
+	Dir    string // output directory for the file driver
+}
+
+// New creates a mailer for the configured driver
+func New(cfg *Config) (Mailer, error) {
+	switch cfg.Driver {
+	case "", "log":
+		return &LogMailer{from: cfg.From}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create mail directory: %w", err)
+		}
+		return &FileMailer{from: cfg.From, dir: cfg.Dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver: %s", cfg.Driver)
+	}
+}
+
+// LogMailer writes messages to the application log instead of sending them
+type LogMailer struct {
+	from string
+}
+
+// Send logs the message
+func (m *LogMailer) Send(ctx context.Context, msg *Message) error {
+	logger.Info().
+		Str("from", m.from).
+		Str("to", msg.To).
+		Str("subject", msg.Subject).
+		Str("body", msg.Body).
+		Msg("Mail sent (log driver)")
+	return nil
+}
+
+// FileMailer writes each message as an .eml file for local inspection
+type FileMailer struct {
+	from string
+	dir  string
+}
+
+// Send writes the message to a new file in the mail directory
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405"), uuid.New().String())
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write mail file: %w", err)
+	}
+
+	logger.Debug().Str("to", msg.To).Str("path", path).Msg("Mail written to file")
+	return nil
+}
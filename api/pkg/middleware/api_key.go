@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyResolver looks up an API key and returns claims for the account it
+// belongs to, in the same shape as a JWT's, or auth.ErrInvalidAPIKey
+type APIKeyResolver func(ctx context.Context, key, clientIP string) (*auth.Claims, error)
+
+// apiKeyResolver is set at startup by SetAPIKeyResolver
+var apiKeyResolver APIKeyResolver
+
+// SetAPIKeyResolver sets how API keys are checked. Until it is called, every
+// API key is rejected.
+func SetAPIKeyResolver(resolve APIKeyResolver) {
+	apiKeyResolver = resolve
+}
+
+// JWTOrAPIKeyAuth is middleware that accepts an API key or a JWT access token,
+// for routes that serve bots as well as people. Either way the handlers and
+// permission checks that follow see the same claims.
+func JWTOrAPIKeyAuth() gin.HandlerFunc {
+	jwtAuth := JWTAuth()
+	return func(c *gin.Context) {
+		if key, ok := bearerAPIKey(c); ok {
+			authenticateAPIKey(c, key)
+			return
+		}
+		jwtAuth(c)
+	}
+}
+
+// bearerAPIKey returns the bearer token if it is an API key
+func bearerAPIKey(c *gin.Context) (string, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader(AuthorizationHeader), BearerPrefix)
+	if !ok || !strings.HasPrefix(token, auth.APIKeyPrefix) {
+		return "", false
+	}
+	return token, true
+}
+
+func authenticateAPIKey(c *gin.Context, key string) {
+	if apiKeyResolver == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": auth.ErrInvalidAPIKey.Error(),
+		})
+		return
+	}
+
+	claims, err := apiKeyResolver(c.Request.Context(), key, c.ClientIP())
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidAPIKey) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		logger.Error().Err(err).Msg("Failed to check API key")
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "failed to check API key",
+		})
+		return
+	}
+
+	c.Set(ClaimsKey, claims)
+	c.Next()
+}
@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/chattycathy/api/pkg/auth"
+	"github.com/chattycathy/api/pkg/logger"
 	"github.com/gin-gonic/gin"
 )
 
@@ -44,6 +46,18 @@ func JWTAuth() gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens revoked by logout or an admin change. If Redis is
+		// unavailable the signature and expiry checks above still apply.
+		revoked, err := auth.IsAccessTokenRevoked(c.Request.Context(), claims)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to check access token revocation")
+		} else if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "token has been revoked",
+			})
+			return
+		}
+
 		// Store claims in context for handlers to use
 		c.Set(ClaimsKey, claims)
 		c.Next()
@@ -82,6 +96,30 @@ func RequireRole(roles ...string) gin.HandlerFunc {
 	}
 }
 
+// RequireMFA is middleware that only allows sessions established with a second factor.
+// Use it after RequireRole on routes where a stolen first factor must not be enough.
+func RequireMFA() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := GetClaims(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "not authenticated",
+			})
+			return
+		}
+
+		if !claims.HasAMR(auth.AMRMFA) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "multi-factor authentication required",
+				"code":  "mfa_required",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // GetClaims retrieves the JWT claims from the context
 func GetClaims(c *gin.Context) (*auth.Claims, bool) {
 	claimsInterface, exists := c.Get(ClaimsKey)
@@ -92,6 +130,19 @@ func GetClaims(c *gin.Context) (*auth.Claims, bool) {
 	return claims, ok
 }
 
+// GetUserID returns the authenticated user's ID from the JWT claims
+func GetUserID(c *gin.Context) (uint, bool) {
+	claims, ok := GetClaims(c)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(claims.UserID, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint(id), true
+}
+
 // RequirePermission is middleware that checks if the user has specific permissions
 func RequirePermission(permissions ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
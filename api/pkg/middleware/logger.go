@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"net/url"
 	"time"
 
 	"github.com/chattycathy/api/pkg/logger"
@@ -12,7 +13,7 @@ func Logger() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
 		path := c.Request.URL.Path
-		query := c.Request.URL.RawQuery
+		query := redactQuery(c.Request.URL)
 
 		c.Next()
 
@@ -39,3 +40,14 @@ func Logger() gin.HandlerFunc {
 			Msg("request")
 	}
 }
+
+// redactQuery returns the raw query with credentials passed as query
+// parameters (e.g. the WebSocket access_token) masked
+func redactQuery(u *url.URL) string {
+	values := u.Query()
+	if !values.Has("access_token") {
+		return u.RawQuery
+	}
+	values.Set("access_token", "REDACTED")
+	return values.Encode()
+}
@@ -7,12 +7,17 @@ import (
 
 const RequestIDHeader = "X-Request-ID"
 
-// RequestID adds a unique request ID to each request
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 64
+
+// RequestID adds a unique request ID to each request. A client's own ID is
+// kept if it is short and made of safe characters; otherwise a new one is
+// generated, since the ID is echoed back, logged and audited.
 func RequestID() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Check if request ID already exists in header
 		requestID := c.GetHeader(RequestIDHeader)
-		if requestID == "" {
+		if !validRequestID(requestID) {
 			requestID = uuid.New().String()
 		}
 
@@ -31,3 +36,20 @@ func GetRequestID(c *gin.Context) string {
 	}
 	return ""
 }
+
+// validRequestID reports whether id is 1 to 64 letters, digits, '-', '_',
+// '.' or ':'
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Scope describes a kind of resource that roles can be granted on, such as a
+// conversation, and how to find its ID in a route
+type Scope struct {
+	Resource string // e.g. "conversation"
+	Param    string // route parameter holding the resource ID, e.g. "id"
+
+	// Lookup returns the permissions a user has on a resource through roles
+	// bound to them there, and whether they have a role there at all
+	Lookup func(ctx context.Context, userID, resourceID uint) (permissions []string, bound bool, err error)
+}
+
+// Check reports whether the authenticated user has any of the permissions on
+// a resource. A permission held globally applies to every resource, which is
+// how admins override scoped roles. bound reports whether the user has a role
+// on the resource.
+func (s Scope) Check(c *gin.Context, resourceID uint, permissions ...string) (allowed, bound bool, err error) {
+	claims, ok := GetClaims(c)
+	if !ok {
+		return false, false, nil
+	}
+	for _, p := range permissions {
+		if claims.HasPermission(p) {
+			return true, true, nil
+		}
+	}
+
+	userID, ok := GetUserID(c)
+	if !ok {
+		return false, false, nil
+	}
+	scoped, bound, err := s.Lookup(c.Request.Context(), userID, resourceID)
+	if err != nil {
+		return false, false, err
+	}
+	for _, have := range scoped {
+		for _, p := range permissions {
+			if have == p {
+				return true, true, nil
+			}
+		}
+	}
+	return false, bound, nil
+}
+
+// RequireScopedPermission is middleware that checks if the user has any of the
+// permissions on the resource named in the route, either globally or through
+// a role bound to them on it. Users with no role on the resource get a 404
+// so its existence is not revealed.
+func RequireScopedPermission(scope Scope, permissions ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := GetClaims(c); !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "not authenticated",
+			})
+			return
+		}
+
+		resourceID, err := strconv.ParseUint(c.Param(scope.Param), 10, 32)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "invalid " + scope.Param,
+			})
+			return
+		}
+
+		allowed, bound, err := scope.Check(c, uint(resourceID), permissions...)
+		if err != nil {
+			logger.Error().Err(err).Str("resource", scope.Resource).Msg("Failed to check scoped permissions")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to check permissions",
+			})
+			return
+		}
+		if allowed {
+			c.Next()
+			return
+		}
+		if !bound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": scope.Resource + " not found",
+			})
+			return
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":    "insufficient permissions",
+			"required": permissions,
+		})
+	}
+}
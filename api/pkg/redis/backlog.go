@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const backlogKeyPrefix = "backlog:"
+
+// BacklogEntry is a message kept for replay
+type BacklogEntry struct {
+	ID      string
+	Channel string
+	Payload []byte
+}
+
+// Backlog keeps the most recent messages of each channel for a limited time
+// so subscribers can catch up after reconnecting. IDs have the form
+// "<unix ms>-<seq>", increase over time and are ordered with CompareIDs.
+type Backlog interface {
+	// Append stores a payload and returns its ID
+	Append(ctx context.Context, channel string, payload []byte) (string, error)
+	// Since returns the entries of the given channels after afterID, oldest
+	// first. complete is false when entries may already have been discarded,
+	// in which case the caller cannot rely on a replay.
+	Since(ctx context.Context, channels []string, afterID string) (entries []BacklogEntry, complete bool, err error)
+}
+
+// NewBacklog creates a backlog for the configured driver, keeping up to size
+// entries per channel for ttl
+func NewBacklog(driver string, size int, ttl time.Duration) (Backlog, error) {
+	switch driver {
+	case "", "redis":
+		if Client == nil {
+			return nil, fmt.Errorf("redis backlog requires a Redis connection")
+		}
+		return NewRedisBacklog(Client, size, ttl), nil
+	case "memory":
+		return NewMemoryBacklog(size, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown backlog driver: %s", driver)
+	}
+}
+
+// CompareIDs compares two backlog IDs, returning -1, 0 or 1. Malformed IDs
+// sort before every valid one.
+func CompareIDs(a, b string) int {
+	ams, aseq, aok := parseID(a)
+	bms, bseq, bok := parseID(b)
+	switch {
+	case !aok && !bok:
+		return 0
+	case !aok:
+		return -1
+	case !bok:
+		return 1
+	case ams != bms:
+		if ams < bms {
+			return -1
+		}
+		return 1
+	case aseq != bseq:
+		if aseq < bseq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func parseID(id string) (ms, seq uint64, ok bool) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
+
+// expired reports whether entries after the ID may have outlived ttl
+func expired(afterID string, ttl time.Duration) bool {
+	ms, _, ok := parseID(afterID)
+	return !ok || time.UnixMilli(int64(ms)).Before(time.Now().Add(-ttl))
+}
+
+func sortEntries(entries []BacklogEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return CompareIDs(entries[i].ID, entries[j].ID) < 0
+	})
+}
+
+// RedisBacklog is a Backlog kept in capped Redis streams, one per channel
+type RedisBacklog struct {
+	client *redis.Client
+	size   int
+	ttl    time.Duration
+}
+
+// NewRedisBacklog creates a Redis backed backlog
+func NewRedisBacklog(client *redis.Client, size int, ttl time.Duration) *RedisBacklog {
+	return &RedisBacklog{client: client, size: size, ttl: ttl}
+}
+
+// Append adds a payload to the channel's stream, trimming it to size
+func (b *RedisBacklog) Append(ctx context.Context, channel string, payload []byte) (string, error) {
+	key := backlogKeyPrefix + channel
+
+	var add *redis.StringCmd
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		add = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: int64(b.size),
+			Values: map[string]interface{}{"d": payload},
+		})
+		pipe.Expire(ctx, key, b.ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return add.Val(), nil
+}
+
+// Since reads every channel's stream after afterID
+func (b *RedisBacklog) Since(ctx context.Context, channels []string, afterID string) ([]BacklogEntry, bool, error) {
+	if expired(afterID, b.ttl) {
+		return nil, false, nil
+	}
+
+	type reads struct {
+		after  *redis.XMessageSliceCmd
+		oldest *redis.XMessageSliceCmd
+		length *redis.IntCmd
+	}
+	cmds := make([]reads, len(channels))
+	_, err := b.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, ch := range channels {
+			key := backlogKeyPrefix + ch
+			cmds[i] = reads{
+				after:  pipe.XRange(ctx, key, "("+afterID, "+"),
+				oldest: pipe.XRangeN(ctx, key, "-", "+", 1),
+				length: pipe.XLen(ctx, key),
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, false, err
+	}
+
+	var entries []BacklogEntry
+	for i, ch := range channels {
+		// A full stream whose oldest entry is newer than afterID has dropped
+		// entries the caller never saw
+		oldest := cmds[i].oldest.Val()
+		if cmds[i].length.Val() >= int64(b.size) && len(oldest) > 0 && CompareIDs(oldest[0].ID, afterID) > 0 {
+			return nil, false, nil
+		}
+		for _, msg := range cmds[i].after.Val() {
+			payload, _ := msg.Values["d"].(string)
+			entries = append(entries, BacklogEntry{ID: msg.ID, Channel: ch, Payload: []byte(payload)})
+		}
+	}
+
+	sortEntries(entries)
+	return entries, true, nil
+}
+
+// MemoryBacklog is an in-process Backlog
+type MemoryBacklog struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	channels map[string]*memoryStream
+	lastMS   uint64
+	seq      uint64
+}
+
+type memoryStream struct {
+	entries   []BacklogEntry
+	trimmed   bool // entries have been dropped to respect size
+	updatedAt time.Time
+}
+
+// NewMemoryBacklog creates an in-process backlog
+func NewMemoryBacklog(size int, ttl time.Duration) *MemoryBacklog {
+	return &MemoryBacklog{size: size, ttl: ttl, channels: make(map[string]*memoryStream)}
+}
+
+// Append adds a payload to the channel, dropping the oldest beyond size
+func (b *MemoryBacklog) Append(ctx context.Context, channel string, payload []byte) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	ms := uint64(now.UnixMilli())
+	if ms <= b.lastMS {
+		ms = b.lastMS
+		b.seq++
+	} else {
+		b.lastMS = ms
+		b.seq = 0
+	}
+	id := fmt.Sprintf("%d-%d", ms, b.seq)
+
+	stream, ok := b.channels[channel]
+	if !ok || now.Sub(stream.updatedAt) > b.ttl {
+		stream = &memoryStream{}
+		b.channels[channel] = stream
+	}
+	stream.entries = append(stream.entries, BacklogEntry{ID: id, Channel: channel, Payload: payload})
+	if len(stream.entries) > b.size {
+		stream.entries = stream.entries[len(stream.entries)-b.size:]
+		stream.trimmed = true
+	}
+	stream.updatedAt = now
+	return id, nil
+}
+
+// Since reads every channel after afterID
+func (b *MemoryBacklog) Since(ctx context.Context, channels []string, afterID string) ([]BacklogEntry, bool, error) {
+	if expired(afterID, b.ttl) {
+		return nil, false, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []BacklogEntry
+	for _, ch := range channels {
+		stream, ok := b.channels[ch]
+		if !ok || time.Since(stream.updatedAt) > b.ttl {
+			continue
+		}
+		if stream.trimmed && CompareIDs(stream.entries[0].ID, afterID) > 0 {
+			return nil, false, nil
+		}
+		for _, e := range stream.entries {
+			if CompareIDs(e.ID, afterID) > 0 {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	sortEntries(entries)
+	return entries, true, nil
+}
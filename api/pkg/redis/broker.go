@@ -0,0 +1,174 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/chattycathy/api/pkg/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// Messages buffered between the broker and its consumer
+const brokerBufferSize = 256
+
+// Message is a payload received on a subscribed channel
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// Broker publishes payloads to named channels and delivers the payloads of
+// channels this process has subscribed to. Delivery is at most once: messages
+// published while nobody is subscribed, or that a slow consumer cannot keep up
+// with, are lost.
+type Broker interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(ctx context.Context, channels ...string) error
+	Unsubscribe(ctx context.Context, channels ...string) error
+	// Messages returns the stream of received messages; it is closed by Close
+	Messages() <-chan *Message
+	Close() error
+}
+
+// NewBroker creates a broker for the configured driver: "redis" fans out
+// across every replica connected to the same Redis, "memory" stays in-process
+// for single-instance setups and tests
+func NewBroker(driver string) (Broker, error) {
+	switch driver {
+	case "", "redis":
+		if Client == nil {
+			return nil, fmt.Errorf("redis broker requires a Redis connection")
+		}
+		return NewRedisBroker(Client), nil
+	case "memory":
+		return NewMemoryBroker(), nil
+	default:
+		return nil, fmt.Errorf("unknown broker driver: %s", driver)
+	}
+}
+
+// RedisBroker is a Broker backed by Redis Pub/Sub
+type RedisBroker struct {
+	client   *redis.Client
+	pubsub   *redis.PubSub
+	messages chan *Message
+}
+
+// NewRedisBroker creates a broker sharing the given client's connection pool.
+// Subscriptions use a dedicated connection.
+func NewRedisBroker(client *redis.Client) *RedisBroker {
+	b := &RedisBroker{
+		client:   client,
+		pubsub:   client.Subscribe(context.Background()),
+		messages: make(chan *Message, brokerBufferSize),
+	}
+	go b.receive()
+	return b
+}
+
+// receive copies messages from the subscription until it is closed
+func (b *RedisBroker) receive() {
+	defer close(b.messages)
+	for msg := range b.pubsub.Channel(redis.WithChannelSize(brokerBufferSize)) {
+		b.messages <- &Message{Channel: msg.Channel, Payload: []byte(msg.Payload)}
+	}
+}
+
+// Publish sends a payload to every subscriber of the channel, on any replica
+func (b *RedisBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	return b.client.Publish(ctx, channel, payload).Err()
+}
+
+// Subscribe starts receiving the given channels
+func (b *RedisBroker) Subscribe(ctx context.Context, channels ...string) error {
+	return b.pubsub.Subscribe(ctx, channels...)
+}
+
+// Unsubscribe stops receiving the given channels
+func (b *RedisBroker) Unsubscribe(ctx context.Context, channels ...string) error {
+	return b.pubsub.Unsubscribe(ctx, channels...)
+}
+
+// Messages returns the stream of received messages
+func (b *RedisBroker) Messages() <-chan *Message {
+	return b.messages
+}
+
+// Close ends the subscription
+func (b *RedisBroker) Close() error {
+	return b.pubsub.Close()
+}
+
+// MemoryBroker is an in-process Broker. Only subscriptions made on the same
+// broker receive its messages.
+type MemoryBroker struct {
+	mu       sync.RWMutex
+	channels map[string]bool
+	closed   bool
+	messages chan *Message
+}
+
+// NewMemoryBroker creates an in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		channels: make(map[string]bool),
+		messages: make(chan *Message, brokerBufferSize),
+	}
+}
+
+// Publish delivers a payload if the channel is subscribed. Like Redis, a
+// consumer that falls a full buffer behind loses messages.
+func (b *MemoryBroker) Publish(ctx context.Context, channel string, payload []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return fmt.Errorf("broker closed")
+	}
+	if !b.channels[channel] {
+		return nil
+	}
+
+	select {
+	case b.messages <- &Message{Channel: channel, Payload: payload}:
+	default:
+		logger.Warn().Str("channel", channel).Msg("Broker buffer full, dropping message")
+	}
+	return nil
+}
+
+// Subscribe starts receiving the given channels
+func (b *MemoryBroker) Subscribe(ctx context.Context, channels ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range channels {
+		b.channels[ch] = true
+	}
+	return nil
+}
+
+// Unsubscribe stops receiving the given channels
+func (b *MemoryBroker) Unsubscribe(ctx context.Context, channels ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range channels {
+		delete(b.channels, ch)
+	}
+	return nil
+}
+
+// Messages returns the stream of received messages
+func (b *MemoryBroker) Messages() <-chan *Message {
+	return b.messages
+}
+
+// Close stops delivery and closes the message stream
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.messages)
+	}
+	return nil
+}
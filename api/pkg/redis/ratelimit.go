@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const rateLimitPrefix = "rate_limit:"
+
+// Allow counts a hit against a fixed-window rate limit and reports whether it
+// is within limit hits per window. When it is not, retryAfter is how long
+// until the window resets.
+func Allow(ctx context.Context, key string, limit int, window time.Duration) (allowed bool, retryAfter time.Duration, err error) {
+	if Client == nil {
+		return false, 0, fmt.Errorf("redis client not initialized")
+	}
+
+	key = rateLimitPrefix + key
+	pipe := Client.TxPipeline()
+	hits := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, window)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, 0, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+
+	if hits.Val() <= int64(limit) {
+		return true, 0, nil
+	}
+	return false, ttl.Val(), nil
+}
+
+// Exhausted reports whether a rate limit has counted limit hits in the current
+// window, without counting one. When it has, retryAfter is how long until the
+// window resets.
+func Exhausted(ctx context.Context, key string, limit int) (exhausted bool, retryAfter time.Duration, err error) {
+	if Client == nil {
+		return false, 0, fmt.Errorf("redis client not initialized")
+	}
+
+	key = rateLimitPrefix + key
+	pipe := Client.Pipeline()
+	hits := pipe.Get(ctx, key)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, 0, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+
+	n, err := hits.Int()
+	if errors.Is(err, redis.Nil) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+	if n < limit {
+		return false, 0, nil
+	}
+	return true, ttl.Val(), nil
+}
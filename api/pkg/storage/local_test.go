@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T) *LocalStorage {
+	t.Helper()
+	s, err := NewLocalStorage(t.TempDir(), "http://api.localhost/api/v1/files/", []byte("test-signing-key"))
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	return s
+}
+
+// signedParams returns the key, expires and signature of a local signed URL
+func signedParams(t *testing.T, s *LocalStorage, key string, expiry time.Duration) (string, string, string) {
+	t.Helper()
+	signed, err := s.SignedURL(key, expiry)
+	if err != nil {
+		t.Fatalf("SignedURL: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("SignedURL returned an invalid URL %q: %v", signed, err)
+	}
+	gotKey := strings.TrimPrefix(u.Path, "/api/v1/files/")
+	return gotKey, u.Query().Get("expires"), u.Query().Get("signature")
+}
+
+func TestLocalSignedURL(t *testing.T) {
+	s := newTestLocal(t)
+	key, expires, signature := signedParams(t, s, "attachments/1/a.png", time.Hour)
+
+	if key != "attachments/1/a.png" {
+		t.Errorf("signed URL is for %q, want attachments/1/a.png", key)
+	}
+	if !s.Verify(key, expires, signature) {
+		t.Error("Verify rejected a fresh signed URL")
+	}
+
+	unix, _ := strconv.ParseInt(expires, 10, 64)
+	later := strconv.FormatInt(unix+3600, 10)
+	tests := []struct {
+		name                    string
+		key, expires, signature string
+	}{
+		{"other key", "attachments/1/b.png", expires, signature},
+		{"extended expiry", key, later, signature},
+		{"tampered signature", key, expires, strings.Repeat("0", len(signature))},
+		{"missing signature", key, expires, ""},
+		{"invalid expiry", key, "soon", signature},
+	}
+	for _, tt := range tests {
+		if s.Verify(tt.key, tt.expires, tt.signature) {
+			t.Errorf("%s: Verify accepted it", tt.name)
+		}
+	}
+
+	other, _ := NewLocalStorage(t.TempDir(), "http://api.localhost/api/v1/files", []byte("other-key"))
+	if other.Verify(key, expires, signature) {
+		t.Error("Verify accepted a URL signed with another key")
+	}
+}
+
+func TestLocalSignedURLExpires(t *testing.T) {
+	s := newTestLocal(t)
+	key, expires, signature := signedParams(t, s, "attachments/1/a.png", -time.Second)
+	if s.Verify(key, expires, signature) {
+		t.Error("Verify accepted an expired signed URL")
+	}
+}
+
+func TestLocalRejectsKeysOutsideDir(t *testing.T) {
+	s := newTestLocal(t)
+	for _, key := range []string{"", "../secret", "a/../../b", "/etc/passwd", "a//b"} {
+		if _, err := s.SignedURL(key, time.Hour); err == nil {
+			t.Errorf("SignedURL(%q) succeeded, want an invalid key error", key)
+		}
+		if err := s.Put(context.Background(), key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) succeeded, want an invalid key error", key)
+		}
+	}
+}
+
+func TestLocalPutOpenDelete(t *testing.T) {
+	s := newTestLocal(t)
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "attachments/1/a.txt", strings.NewReader("hello world"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	rc, err := s.Open(ctx, "attachments/1/a.txt")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(got) != "hello" {
+		t.Errorf("Open = %q, want %q", got, "hello")
+	}
+
+	if err := s.Delete(ctx, "attachments/1/a.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Open(ctx, "attachments/1/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "attachments/1/a.txt"); err != nil {
+		t.Errorf("Delete of a missing object = %v, want nil", err)
+	}
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/chattycathy/api/pkg/logger"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps binary objects under string keys
+type Storage interface {
+	// Put stores size bytes from r under key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open returns the contents of an object
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL anyone can download the object from until expiry
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// Config holds storage configuration
+type Config struct {
+	Driver string // "local" or "s3"
+
+	// Local driver
+	Dir        string // directory objects are written to
+	PublicURL  string // URL the API serves local objects under, e.g. http://api.localhost/api/v1/files
+	SigningKey string // secret for signing download URLs
+
+	// S3 driver, for AWS or any S3-compatible service such as MinIO
+	Endpoint        string // e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // address buckets as <endpoint>/<bucket> rather than <bucket>.<host>
+}
+
+// New creates a storage backend for the configured driver
+func New(cfg *Config) (Storage, error) {
+	switch cfg.Driver {
+	case "", "local":
+		key := []byte(cfg.SigningKey)
+		if len(key) == 0 {
+			logger.Warn().Msg("STORAGE_SIGNING_KEY is not set; download links will stop working on restart")
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return nil, fmt.Errorf("failed to generate signing key: %w", err)
+			}
+		}
+		return NewLocalStorage(cfg.Dir, cfg.PublicURL, key)
+	case "s3":
+		if cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+			return nil, fmt.Errorf("s3 storage requires a bucket and credentials")
+		}
+		return NewS3Storage(cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.AccessKeyID, cfg.SecretAccessKey, cfg.PathStyle)
+	default:
+		return nil, fmt.Errorf("unknown storage driver: %s", cfg.Driver)
+	}
+}